@@ -0,0 +1,561 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oklog/ulid/v2"
+)
+
+// 返金の受付と記録を守る。決済サービスへの依頼中は refundMu を離し、
+// 依頼中のライドを refundingRides に入れて同じライドへの返金を受け付けない
+var (
+	refundMu       sync.Mutex
+	refundingRides = map[string]string{}
+)
+
+var errRefundInProgress = fiber.NewError(http.StatusConflict, "another refund for this ride is in progress")
+
+// beginRefund は返金額を決めてライドを返金中にする。refundMu を取って呼ぶ
+func beginRefund(ride *Ride, req *adminPostRideRefundRequest, idempotencyKey string) (int, error) {
+	if _, ok := refundingRides[ride.ID]; ok {
+		return 0, errRefundInProgress
+	}
+	for rideID, key := range refundingRides {
+		if key == idempotencyKey && rideID != ride.ID {
+			return 0, fiber.NewError(http.StatusConflict, "Idempotency-Key is already used for another ride")
+		}
+	}
+	if status, _ := getLatestRideStatus(ride.ID); status != "COMPLETED" {
+		return 0, fiber.NewError(http.StatusBadRequest, "ride is not charged yet")
+	}
+
+	charged := getRideChargedFare(ride)
+	amount := 0
+	switch req.Type {
+	case "FULL":
+		amount = charged
+	case "PARTIAL":
+		if req.Amount <= 0 || req.Amount > charged {
+			return 0, fiber.NewError(http.StatusBadRequest, "amount must be between 1 and the charged fare")
+		}
+		amount = req.Amount
+	case "ADJUSTMENT":
+		// 正しい運賃との差額を返金する。運賃が上がる場合は差額を追加で請求する
+		if req.Fare < 0 {
+			return 0, fiber.NewError(http.StatusBadRequest, "fare must not be negative")
+		}
+		amount = charged - req.Fare
+	default:
+		return 0, fiber.NewError(http.StatusBadRequest, "type must be one of FULL, PARTIAL, ADJUSTMENT")
+	}
+	if amount == 0 {
+		return 0, fiber.NewError(http.StatusBadRequest, "nothing to refund")
+	}
+	refundingRides[ride.ID] = idempotencyKey
+	return amount, nil
+}
+
+func endRefund(rideID string) {
+	refundMu.Lock()
+	defer refundMu.Unlock()
+	delete(refundingRides, rideID)
+}
+
+func adminPostRideRefund(c *fiber.Ctx) error {
+	ctx := c.Context()
+	rideID := c.Params("ride_id")
+
+	idempotencyKey := c.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		return fiber.NewError(http.StatusBadRequest, "Idempotency-Key header is required")
+	}
+
+	req := &adminPostRideRefundRequest{}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	refundMu.Lock()
+	if refund, ok := getRideRefundByIdempotencyKey(idempotencyKey); ok {
+		refundMu.Unlock()
+		if refund.RideID != rideID {
+			return fiber.NewError(http.StatusConflict, "Idempotency-Key is already used for another ride")
+		}
+		return c.Status(http.StatusOK).JSON(toAdminRideRefund(refund))
+	}
+	ride, ok := getRide(rideID)
+	if !ok {
+		refundMu.Unlock()
+		return fiber.NewError(http.StatusNotFound, "ride not found")
+	}
+	amount, err := beginRefund(ride, req, idempotencyKey)
+	refundMu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer endRefund(ride.ID)
+
+	token, ok := getPaymentToken(ride.UserID)
+	if !ok {
+		return fiber.NewError(http.StatusBadRequest, "payment token not registered")
+	}
+	if amount > 0 {
+		err := requestPaymentGatewayPostRefund(ctx, paymentGatewayURL, idempotencyKey, token, &paymentGatewayPostRefundRequest{
+			Amount: amount,
+		})
+		if err != nil {
+			return fiber.NewError(http.StatusBadGateway, err.Error())
+		}
+	} else {
+		err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, idempotencyKey, token, &paymentGatewayPostPaymentRequest{
+			Amount: -amount,
+		})
+		if err != nil {
+			return fiber.NewError(http.StatusBadGateway, err.Error())
+		}
+	}
+
+	refund := &RideRefund{
+		ID:             ulid.Make().String(),
+		RideID:         ride.ID,
+		Type:           req.Type,
+		Amount:         amount,
+		Reason:         req.Reason,
+		IdempotencyKey: idempotencyKey,
+		CreatedAt:      time.Now(),
+	}
+	refundMu.Lock()
+	addRideRefund(refund)
+	refundMu.Unlock()
+	if err := postRideRefund(ride, amount, refund.CreatedAt); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+
+	// 通知チャネルが詰まっていても待たない
+	if !tryPublishAppChan(ride.UserID, &Notif{Ride: ride, Refund: refund}) {
+		slog.Error("dropped refund notification",
+			"ride_id", ride.ID,
+			"user_id", ride.UserID,
+			"refund_id", refund.ID,
+		)
+	}
+
+	return c.Status(http.StatusCreated).JSON(toAdminRideRefund(refund))
+}
+
+func adminGetRideRefunds(c *fiber.Ctx) error {
+	ride, ok := getRide(c.Params("ride_id"))
+	if !ok {
+		return fiber.NewError(http.StatusNotFound, "ride not found")
+	}
+
+	refunds, _ := listRideRefunds(ride.ID)
+	res := adminGetRideRefundsResponse{
+		Fare:        ride.Fare,
+		ChargedFare: getRideChargedFare(ride),
+		Refunds:     []adminRideRefund{},
+	}
+	for _, r := range refunds {
+		res.Refunds = append(res.Refunds, toAdminRideRefund(r))
+	}
+	return c.Status(http.StatusOK).JSON(res)
+}
+
+func toAdminRideRefund(refund *RideRefund) adminRideRefund {
+	return adminRideRefund{
+		ID:        refund.ID,
+		RideID:    refund.RideID,
+		Type:      refund.Type,
+		Amount:    refund.Amount,
+		Reason:    refund.Reason,
+		CreatedAt: refund.CreatedAt.UnixMilli(),
+	}
+}
+
+func adminGetPricing(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(pricing.Load().Config())
+}
+
+func adminPutPricing(c *fiber.Ctx) error {
+	ctx := c.Context()
+	config, err := parsePricingConfig(c.Body())
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := putJSONSetting(ctx, pricingSettingName, config); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	pricing.Store(NewPricingEngine(config))
+	return c.Status(http.StatusOK).JSON(config)
+}
+
+func adminGetSurge(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(adminGetSurgeResponse{
+		Config: surgePricer.Config(),
+		Zones:  surgePricer.Status(),
+	})
+}
+
+func adminPutSurgeConfig(c *fiber.Ctx) error {
+	ctx := c.Context()
+	config := SurgeConfig{}
+	if err := c.BodyParser(&config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateSurgeConfig(config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := putJSONSetting(ctx, surgeSettingName, config); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	surgePricer.SetConfig(config)
+	return c.Status(http.StatusOK).JSON(config)
+}
+
+func adminGetFleetConfig(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(fleetHub.Config())
+}
+
+func adminPutFleetConfig(c *fiber.Ctx) error {
+	ctx := c.Context()
+	config := FleetConfig{}
+	if err := c.BodyParser(&config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateFleetConfig(config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := putJSONSetting(ctx, fleetSettingName, config); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	fleetHub.SetConfig(config)
+	return c.Status(http.StatusOK).JSON(config)
+}
+
+func adminGetScheduleConfig(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(scheduledRides.Config())
+}
+
+func adminPutScheduleConfig(c *fiber.Ctx) error {
+	ctx := c.Context()
+	config := ScheduleConfig{}
+	if err := c.BodyParser(&config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateScheduleConfig(config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := putJSONSetting(ctx, scheduleSettingName, config); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	scheduledRides.SetConfig(config)
+	return c.Status(http.StatusOK).JSON(config)
+}
+
+func adminGetPoolConfig(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(ridePools.Config())
+}
+
+func adminPutPoolConfig(c *fiber.Ctx) error {
+	ctx := c.Context()
+	config := PoolConfig{}
+	if err := c.BodyParser(&config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := validatePoolConfig(config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := putJSONSetting(ctx, poolSettingName, config); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	ridePools.SetConfig(config)
+	return c.Status(http.StatusOK).JSON(config)
+}
+
+func adminGetETAConfig(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(etaService.Config())
+}
+
+func adminPutETAConfig(c *fiber.Ctx) error {
+	ctx := c.Context()
+	config := ETAConfig{}
+	if err := c.BodyParser(&config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateETAConfig(config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := putJSONSetting(ctx, etaSettingName, config); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	etaService.SetConfig(config)
+	return c.Status(http.StatusOK).JSON(config)
+}
+
+func adminGetETAAccuracy(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(etaService.Report())
+}
+
+func adminGetMatchingConfig(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(matchingConfig.Load())
+}
+
+func adminPutMatchingConfig(c *fiber.Ctx) error {
+	ctx := c.Context()
+	config := MatchingConfig{}
+	if err := c.BodyParser(&config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateMatchingConfig(config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := putJSONSetting(ctx, matchingSettingName, config); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	matchingConfig.Store(&config)
+	return c.Status(http.StatusOK).JSON(config)
+}
+
+func adminGetOfferConfig(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(rideOffers.Config())
+}
+
+func adminPutOfferConfig(c *fiber.Ctx) error {
+	ctx := c.Context()
+	config := OfferConfig{}
+	if err := c.BodyParser(&config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateOfferConfig(config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := putJSONSetting(ctx, offerSettingName, config); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	rideOffers.SetConfig(config)
+	return c.Status(http.StatusOK).JSON(config)
+}
+
+func adminGetWatchdogConfig(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(rideWatchdog.Config())
+}
+
+func adminPutWatchdogConfig(c *fiber.Ctx) error {
+	ctx := c.Context()
+	config := WatchdogConfig{}
+	if err := c.BodyParser(&config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateWatchdogConfig(config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := putJSONSetting(ctx, watchdogSettingName, config); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	rideWatchdog.SetConfig(config)
+	return c.Status(http.StatusOK).JSON(config)
+}
+
+// adminGetWatchdogEvents は監視が完了・割り当て直し・記録したライドを新しい順に返す
+func adminGetWatchdogEvents(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(adminGetWatchdogEventsResponse{
+		Events: rideWatchdog.Events(),
+	})
+}
+
+func adminGetPendingReviews(c *fiber.Ctx) error {
+	res := adminGetReviewsResponse{Reviews: []reviewResponse{}}
+	for _, r := range reviewStore.Pending() {
+		res.Reviews = append(res.Reviews, toReviewResponse(r))
+	}
+	return c.Status(http.StatusOK).JSON(res)
+}
+
+func adminPostReviewApprove(c *fiber.Ctx) error {
+	return moderateReview(c, true)
+}
+
+func adminPostReviewReject(c *fiber.Ctx) error {
+	return moderateReview(c, false)
+}
+
+func moderateReview(c *fiber.Ctx, approve bool) error {
+	req := &adminPostReviewModerationRequest{}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+	}
+	review, err := reviewStore.Moderate(c.Params("review_id"), approve, req.Reason, time.Now())
+	if errors.Is(err, errReviewNotFound) {
+		return fiber.NewError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return fiber.NewError(http.StatusConflict, err.Error())
+	}
+	return c.Status(http.StatusOK).JSON(toReviewResponse(review))
+}
+
+func adminGetReviewModerationConfig(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(reviewStore.Config())
+}
+
+func adminPutReviewModerationConfig(c *fiber.Ctx) error {
+	ctx := c.Context()
+	config := ReviewModerationConfig{}
+	if err := c.BodyParser(&config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := putJSONSetting(ctx, reviewSettingName, config); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	reviewStore.SetConfig(config)
+	return c.Status(http.StatusOK).JSON(config)
+}
+
+func adminPutSurgeOverride(c *fiber.Ctx) error {
+	req := &adminPutSurgeOverrideRequest{}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if req.Multiplier != 0 && req.Multiplier < 1 {
+		return fiber.NewError(http.StatusBadRequest, "multiplier must be 0 (clear) or at least 1")
+	}
+	if req.DurationSeconds < 0 {
+		return fiber.NewError(http.StatusBadRequest, "duration_seconds must not be negative")
+	}
+	surgePricer.Override(req.Zone, req.Multiplier, time.Duration(req.DurationSeconds)*time.Second)
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func adminPostCampaigns(c *fiber.Ctx) error {
+	req := &adminPostCampaignsRequest{}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if req.Code == "" || req.Name == "" {
+		return fiber.NewError(http.StatusBadRequest, "required fields(code, name) are empty")
+	}
+	if _, ok := getCouponCampaignByCode(req.Code); ok {
+		return fiber.NewError(http.StatusConflict, "code is already used by another campaign")
+	}
+
+	campaign := &CouponCampaign{
+		ID:           ulid.Make().String(),
+		Code:         req.Code,
+		Name:         req.Name,
+		DiscountType: req.DiscountType,
+		Amount:       req.Amount,
+		Percent:      req.Percent,
+		MinFare:      req.MinFare,
+		MaxUses:      req.MaxUses,
+		Stackable:    req.Stackable,
+		CreatedAt:    time.Now(),
+	}
+	if req.ExpiresAt != nil {
+		expiresAt := time.UnixMilli(*req.ExpiresAt)
+		campaign.ExpiresAt = &expiresAt
+	}
+	if err := campaign.validate(); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	// 登録した後は利用数が更新されうるので、登録前の内容を返す
+	res := *campaign
+	createCouponCampaign(campaign)
+
+	return c.Status(http.StatusCreated).JSON(res)
+}
+
+func adminGetCampaigns(c *fiber.Ctx) error {
+	campaigns := []CouponCampaign{}
+	for _, campaign := range listCouponCampaigns() {
+		campaigns = append(campaigns, campaign.snapshot())
+	}
+	slices.SortFunc(campaigns, func(a, b CouponCampaign) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return c.Status(http.StatusOK).JSON(adminGetCampaignsResponse{Campaigns: campaigns})
+}
+
+func adminGetLedgerReport(c *fiber.Ctx) error {
+	res := adminGetLedgerReportResponse{
+		Entries:  ledger.Len(),
+		Accounts: ledger.Balances(),
+	}
+	for _, b := range res.Accounts {
+		res.TotalDebit += b.Debit
+		res.TotalCredit += b.Credit
+		switch {
+		case b.Account == accountCash:
+			res.Cash = b.Balance
+		case b.Account == accountPlatformRevenue:
+			res.PlatformRevenue = -b.Balance
+		case b.Account == accountPromotionExpense:
+			res.PromotionExpense = b.Balance
+		case strings.HasPrefix(b.Account, accountOwnerPayable+":"):
+			res.OwnerPayable -= b.Balance
+		}
+	}
+	// ライドごとに請求した額と台帳の現金が一致すれば帳尻が合っている
+	res.UnreconciledRides = reconcileRides()
+	res.Balanced = res.TotalDebit == res.TotalCredit && len(res.UnreconciledRides) == 0
+	return c.Status(http.StatusOK).JSON(res)
+}
+
+func adminPutPayoutConfig(c *fiber.Ctx) error {
+	ctx := c.Context()
+	req := &adminPutPayoutConfigRequest{}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if req.CommissionBasisPoints < 0 || req.CommissionBasisPoints > 10000 {
+		return fiber.NewError(http.StatusBadRequest, "commission_basis_points must be between 0 and 10000")
+	}
+	config := PayoutConfig{Period: req.Period, Timezone: req.Timezone}
+	if err := validatePayoutConfig(config); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	lc := LedgerConfig{CommissionBasisPoints: req.CommissionBasisPoints}
+	if err := putJSONSetting(ctx, ledgerSettingName, lc); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if err := putJSONSetting(ctx, payoutSettingName, config); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	// 手数料率の変更はこれ以降に記帳する取引から適用される
+	ledgerConfig.Store(&lc)
+	payoutConfig.Store(&config)
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func adminPostStatementFinalize(c *fiber.Ctx) error {
+	statement, ok := getStatement(c.Params("statement_id"))
+	if !ok {
+		return fiber.NewError(http.StatusNotFound, "statement not found")
+	}
+	if err := finalizeStatement(statement, time.Now()); err != nil {
+		return fiber.NewError(http.StatusConflict, err.Error())
+	}
+	return c.Status(http.StatusOK).JSON(toOwnerStatementSummary(statement))
+}
+
+func adminPostStatementPay(c *fiber.Ctx) error {
+	statement, ok := getStatement(c.Params("statement_id"))
+	if !ok {
+		return fiber.NewError(http.StatusNotFound, "statement not found")
+	}
+	if err := payStatement(statement, time.Now()); err != nil {
+		if errors.Is(err, errStatementNotFinalized) {
+			return fiber.NewError(http.StatusConflict, err.Error())
+		}
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	return c.Status(http.StatusOK).JSON(toOwnerStatementSummary(statement))
+}
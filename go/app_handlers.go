@@ -2,8 +2,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -19,11 +22,21 @@ func appPostUsers(c *fiber.Ctx) error {
 		return fiber.NewError(http.StatusBadRequest, "required fields(username, firstname, lastname, date_of_birth) are empty")
 	}
 
+	now := time.Now()
+	invitationCode := ""
+	if req.InvitationCode != nil {
+		invitationCode = *req.InvitationCode
+	}
+
 	userID := ulid.Make().String()
-	accessToken := secureRandomStr(32)
-	invitationCode := secureRandomStr(15)
+	// 招待コードの枠はユーザーを作る前に確保する
+	if invitationCode != "" {
+		if err := registerReferral(invitationCode, userID, now); err != nil {
+			return invitationCodeError(err)
+		}
+	}
 
-	now := time.Now()
+	accessToken := secureRandomStr(32)
 	user := &User{
 		ID:             userID,
 		Username:       req.Username,
@@ -31,36 +44,20 @@ func appPostUsers(c *fiber.Ctx) error {
 		Lastname:       req.LastName,
 		DateOfBirth:    req.DateOfBirth,
 		AccessToken:    accessToken,
-		InvitationCode: invitationCode,
+		InvitationCode: secureRandomStr(15),
 		CreatedAt:      now,
 		UpdatedAt:      now,
 	}
 	createUser(userID, user)
-	createUserInv(invitationCode, user)
+	createUserInv(user.InvitationCode, user)
 	createUserRideStatus(userID, true)
 
 	// 初回登録キャンペーンのクーポンを付与
-	addUnusedCoupon(userID, 3000)
+	grantCoupon(userID, signupCampaignID, "CP_NEW2024", now)
 
 	// 招待コードを使った登録
-	if req.InvitationCode != nil && *req.InvitationCode != "" {
-		// 招待する側の招待数をチェック
-		count, _ := getInvCouponCount(*req.InvitationCode)
-		if count >= 3 {
-			return fiber.NewError(http.StatusInternalServerError, "この招待コードは使用できません。")
-		}
-
-		// ユーザーチェック
-		inviter, ok := getUserInv(*req.InvitationCode)
-		if !ok {
-			return fiber.NewError(http.StatusInternalServerError, "この招待コードは使用できません。")
-		}
-
-		// 招待クーポン付与
-		incInvCouponCount(*req.InvitationCode)
-		addUnusedCoupon(userID, 1500)
-		// 招待した人にもRewardを付与
-		addUnusedCoupon(inviter.ID, 1000)
+	if invitationCode != "" {
+		grantInviteeCoupon(invitationCode, userID, now)
 	}
 
 	createAppAccessToken(accessToken, user)
@@ -71,10 +68,20 @@ func appPostUsers(c *fiber.Ctx) error {
 	})
 	return c.Status(http.StatusCreated).JSON(&appPostUsersResponse{
 		ID:             userID,
-		InvitationCode: invitationCode,
+		InvitationCode: user.InvitationCode,
 	})
 }
 
+func invitationCodeError(err error) error {
+	switch {
+	case errors.Is(err, errInvitationCodeNotFound), errors.Is(err, errInvitationCodeExhausted):
+		return fiber.NewError(http.StatusBadRequest, "この招待コードは使用できません。")
+	case errors.Is(err, errInvitationRateLimited):
+		return fiber.NewError(http.StatusTooManyRequests, err.Error())
+	}
+	return fiber.NewError(http.StatusInternalServerError, err.Error())
+}
+
 func appPostPaymentMethods(c *fiber.Ctx) error {
 	ctx := c.Context()
 	req := &appPostPaymentMethodsRequest{}
@@ -96,42 +103,142 @@ func appGetRides(c *fiber.Ctx) error {
 	ctx := c.Context()
 	user := ctx.UserValue("user").(*User)
 
+	// 互換性のため status を指定しなければ完了したライドだけを返す
+	statuses := map[string]bool{"COMPLETED": true}
+	if c.Query("status") != "" {
+		statuses = map[string]bool{}
+		for _, s := range strings.Split(c.Query("status"), ",") {
+			if !slices.Contains(allRideStatuses, s) {
+				return fiber.NewError(http.StatusBadRequest, "invalid status")
+			}
+			statuses[s] = true
+		}
+	}
+	if c.QueryBool("include_in_progress") {
+		for _, s := range allRideStatuses {
+			if s != "COMPLETED" {
+				statuses[s] = true
+			}
+		}
+	}
+	since := time.Unix(0, 0)
+	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	if c.Query("since") != "" {
+		parsed, err := strconv.ParseInt(c.Query("since"), 10, 64)
+		if err != nil {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+		since = time.UnixMilli(parsed)
+	}
+	if c.Query("until") != "" {
+		parsed, err := strconv.ParseInt(c.Query("until"), 10, 64)
+		if err != nil {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+		until = time.UnixMilli(parsed)
+	}
+	// limit を指定しなければ従来どおり全件返す
+	limit, err := strconv.Atoi(c.Query("limit", "0"))
+	if err != nil || limit < 0 {
+		return fiber.NewError(http.StatusBadRequest, "limit is invalid")
+	}
+	cursor := c.Query("cursor")
+
 	rideIDs, _ := listRideIDsUserID(user.ID)
+	// ride_id は ULID なので作成順に並んでいる。新しいものから cursor より前を返す
+	end := len(rideIDs)
+	if cursor != "" {
+		end, _ = slices.BinarySearch(rideIDs, cursor)
+	}
 
-	items := []getAppRidesResponseItem{}
-	for _, rideID := range rideIDs {
+	res := &getAppRidesResponse{Rides: []getAppRidesResponseItem{}}
+	for i := end - 1; i >= 0; i-- {
+		rideID := rideIDs[i]
 		status, _ := getLatestRideStatus(rideID)
-		if status != "COMPLETED" {
+		if !statuses[status] {
 			continue
 		}
-		ride, _ := getRide(rideID)
-
-		item := getAppRidesResponseItem{
-			ID:                    ride.ID,
-			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
-			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
-			Fare:                  ride.Fare,
-			Evaluation:            *ride.Evaluation,
-			RequestedAt:           ride.CreatedAt.UnixMilli(),
-			CompletedAt:           ride.UpdatedAt.UnixMilli(),
+		ride, ok := getRide(rideID)
+		if !ok {
+			continue
 		}
+		if ride.CreatedAt.Before(since) {
+			// これより前のライドはすべて範囲外
+			break
+		}
+		if ride.CreatedAt.After(until.Add(999 * time.Microsecond)) {
+			continue
+		}
+		if limit > 0 && len(res.Rides) == limit {
+			res.NextCursor = res.Rides[len(res.Rides)-1].ID
+			break
+		}
+		res.Rides = append(res.Rides, toAppRidesResponseItem(ride, status))
+	}
 
-		item.Chair = getAppRidesResponseItemChair{}
-
-		chair, _ := getChair(ride.ChairID.String)
-		item.Chair.ID = chair.ID
-		item.Chair.Name = chair.Name
-		item.Chair.Model = chair.Model
+	return c.Status(http.StatusOK).JSON(res)
+}
 
-		owner, _ := getOwner(chair.OwnerID)
-		item.Chair.Owner = owner.Name
+var allRideStatuses = []string{"MATCHING", "ENROUTE", "PICKUP", "CARRYING", "ARRIVED", "COMPLETED"}
+
+func toAppRidesResponseItem(ride *Ride, status string) getAppRidesResponseItem {
+	item := getAppRidesResponseItem{
+		ID:                    ride.ID,
+		PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+		DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+		Waypoints:             ride.Waypoints,
+		Pooled:                ride.Pooled,
+		ChairClass:            ride.ChairClass,
+		Fare:                  ride.Fare,
+		Status:                status,
+		RequestedAt:           ride.CreatedAt.UnixMilli(),
+	}
+	if ride.Evaluation != nil {
+		item.Evaluation = *ride.Evaluation
+	}
+	if status == "COMPLETED" {
+		item.CompletedAt = ride.UpdatedAt.UnixMilli()
+	}
 
-		items = append(items, item)
+	if !ride.ChairID.Valid {
+		return item
+	}
+	chair, ok := getChair(ride.ChairID.String)
+	if !ok {
+		return item
+	}
+	item.Chair = getAppRidesResponseItemChair{
+		ID:    chair.ID,
+		Name:  chair.Name,
+		Model: chair.Model,
 	}
+	if owner, ok := ownerCache.Load(chair.OwnerID); ok {
+		item.Chair.Owner = owner.(*Owner).Name
+	}
+	return item
+}
 
-	return c.Status(http.StatusOK).JSON(&getAppRidesResponse{
-		Rides: items,
-	})
+func appGetRide(c *fiber.Ctx) error {
+	user := c.Context().UserValue("user").(*User)
+	ride, ok := getRide(c.Params("ride_id"))
+	if !ok || ride.UserID != user.ID {
+		return fiber.NewError(http.StatusNotFound, "ride not found")
+	}
+	status, _ := getLatestRideStatus(ride.ID)
+	res := &getAppRideResponse{
+		getAppRidesResponseItem: toAppRidesResponseItem(ride, status),
+		Breakdown:               ride.FareBreakdown,
+		Timeline:                []getAppRideResponseTimeline{},
+	}
+	for _, e := range listRideStatusHistory(ride.ID) {
+		res.Timeline = append(res.Timeline, getAppRideResponseTimeline{
+			Status:      e.Status,
+			Stop:        e.Stop,
+			StopArrived: e.Stop > 0,
+			CreatedAt:   e.CreatedAt.UnixMilli(),
+		})
+	}
+	return c.Status(http.StatusOK).JSON(res)
 }
 
 func appPostRides(c *fiber.Ctx) error {
@@ -143,22 +250,58 @@ func appPostRides(c *fiber.Ctx) error {
 	if req.PickupCoordinate == nil || req.DestinationCoordinate == nil {
 		return fiber.NewError(http.StatusBadRequest, "required fields(pickup_coordinate, destination_coordinate) are empty")
 	}
+	if err := validateWaypoints(req.Waypoints); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	// 相乗りでは停車地の予定を椅子ごとに組むので、経由地や予約とは組み合わせられない
+	if req.Pooled && (len(req.Waypoints) > 0 || req.PickupAt != nil) {
+		return fiber.NewError(http.StatusBadRequest, "pooled rides cannot have waypoints or pickup_at")
+	}
+	// 指名した椅子が乗車時刻に空いているとは限らないので、予約では椅子のクラスだけ指定できる
+	if req.PreferredChairID != "" && req.PickupAt != nil {
+		return fiber.NewError(http.StatusBadRequest, "preferred_chair_id cannot be used with pickup_at")
+	}
+	chairClass, err := resolveChairClass(req.ChairClass, req.PreferredChairID)
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
 
 	user := ctx.UserValue("user").(*User)
 	rideID := ulid.Make().String()
 
+	now := time.Now()
+
+	// 予約ライドは乗車中でも受け付ける
+	if req.PickupAt != nil {
+		pickupAt := time.UnixMilli(*req.PickupAt)
+		config := scheduledRides.Config()
+		// 投入までの猶予がないものはすぐに配車する
+		if pickupAt.After(now.Add(time.Duration(config.LeadTimeSeconds) * time.Second)) {
+			return appPostScheduledRide(c, user, req, chairClass, pickupAt, config, now)
+		}
+		if pickupAt.Before(now.Add(-time.Minute)) {
+			return fiber.NewError(http.StatusBadRequest, "pickup_at is in the past")
+		}
+	}
+
 	isFree, _ := getUserRideStatus(user.ID)
 	if !isFree {
 		return fiber.NewError(http.StatusConflict, "ride already exists")
 	}
-	now := time.Now()
 
-	discount, ok := getUnusedCoupon(user.ID)
-	if ok {
-		useUnusedCoupon(user.ID)
+	var quote *FareQuote
+	if req.QuoteID != "" {
+		q, err := redeemFareQuote(req.QuoteID, user.ID, *req.PickupCoordinate, *req.DestinationCoordinate, req.Waypoints, chairClass, now)
+		if errors.Is(err, errInvalidQuote) {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+		if err != nil {
+			return fiber.NewError(http.StatusConflict, err.Error())
+		}
+		quote = q
 	}
-	meteredFare := farePerDistance * calculateDistance(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
+
 	ride := &Ride{
 		ID:                   rideID,
 		UserID:               user.ID,
@@ -166,22 +309,122 @@ func appPostRides(c *fiber.Ctx) error {
 		PickupLongitude:      req.PickupCoordinate.Longitude,
 		DestinationLatitude:  req.DestinationCoordinate.Latitude,
 		DestinationLongitude: req.DestinationCoordinate.Longitude,
+		Waypoints:            req.Waypoints,
+		Pooled:               req.Pooled,
+		ChairClass:           chairClass,
+		PreferredChairID:     req.PreferredChairID,
 		CreatedAt:            now,
 		UpdatedAt:            now,
-		Fare:                 initialFare + discountedMeteredFare,
 	}
-	createRide(rideID, ride)
-	addRideIDsUserID(user.ID, rideID)
+	if err := prepareRide(ride, quote, now); err != nil {
+		return fiber.NewError(http.StatusConflict, err.Error())
+	}
 	waitingRides.Add(ride)
 
 	processRideStatus(ride, "MATCHING")
 
 	return c.Status(http.StatusAccepted).JSON(&appPostRidesResponse{
-		RideID: rideID,
-		Fare:   ride.Fare,
+		RideID:    rideID,
+		Fare:      ride.Fare,
+		Breakdown: ride.FareBreakdown,
 	})
 }
 
+// appPostScheduledRide は乗車時刻まで予約ライドとして持っておき、時刻が近づいたら配車待ちに入れる
+func appPostScheduledRide(c *fiber.Ctx, user *User, req *appPostRidesRequest, chairClass string, pickupAt time.Time, config ScheduleConfig, now time.Time) error {
+	if req.QuoteID != "" {
+		return fiber.NewError(http.StatusBadRequest, "quote_id cannot be used for scheduled rides")
+	}
+	if pickupAt.After(now.Add(time.Duration(config.MaxAdvanceHours) * time.Hour)) {
+		return fiber.NewError(http.StatusBadRequest, fmt.Sprintf("pickup_at must be within %d hours", config.MaxAdvanceHours))
+	}
+	// 運賃は投入時に確定する。ここでは乗車時刻の料金表での目安を返す
+	in := FareInput{
+		PickupLatitude:       req.PickupCoordinate.Latitude,
+		PickupLongitude:      req.PickupCoordinate.Longitude,
+		DestinationLatitude:  req.DestinationCoordinate.Latitude,
+		DestinationLongitude: req.DestinationCoordinate.Longitude,
+		Waypoints:            req.Waypoints,
+		Class:                chairClass,
+		At:                   pickupAt,
+		Surge:                1,
+	}
+	engine := pricing.Load()
+	in.Discount = getCouponWallet(user.ID).Preview(engine.Quote(in), now)
+	r := &ScheduledRide{
+		ID:            ulid.Make().String(),
+		UserID:        user.ID,
+		Pickup:        *req.PickupCoordinate,
+		Destination:   *req.DestinationCoordinate,
+		Waypoints:     req.Waypoints,
+		ChairClass:    chairClass,
+		PickupAt:      pickupAt,
+		Status:        scheduledRideStatusScheduled,
+		EstimatedFare: engine.Quote(in),
+		CreatedAt:     now,
+	}
+	scheduledRides.Add(r)
+
+	pickupAtMillis := pickupAt.UnixMilli()
+	return c.Status(http.StatusAccepted).JSON(&appPostRidesResponse{
+		RideID:    r.ID,
+		Fare:      r.EstimatedFare.Total,
+		Breakdown: r.EstimatedFare,
+		PickupAt:  &pickupAtMillis,
+	})
+}
+
+func appGetScheduledRides(c *fiber.Ctx) error {
+	ctx := c.Context()
+	user := ctx.UserValue("user").(*User)
+
+	res := appGetScheduledRidesResponse{ScheduledRides: []appScheduledRide{}}
+	for _, r := range scheduledRides.ListByUser(user.ID) {
+		res.ScheduledRides = append(res.ScheduledRides, toAppScheduledRide(&r, ""))
+	}
+	return c.Status(http.StatusOK).JSON(res)
+}
+
+func appDeleteScheduledRide(c *fiber.Ctx) error {
+	ctx := c.Context()
+	user := ctx.UserValue("user").(*User)
+
+	err := scheduledRides.Cancel(user.ID, c.Params("ride_id"))
+	if errors.Is(err, errScheduledRideNotFound) {
+		return fiber.NewError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return fiber.NewError(http.StatusConflict, err.Error())
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// prepareRide は運賃を確定してライドを登録する。配車待ちに入れるのは呼び出し側で行う
+func prepareRide(ride *Ride, quote *FareQuote, now time.Time) error {
+	// クーポンはここでは予約だけして、決済が成功した時点で使用済みにする
+	wallet := getCouponWallet(ride.UserID)
+	if quote != nil {
+		// 見積もり後に料金表が変わっても見積もった運賃で確定する。
+		// ただし見積もりの割引を出せるだけのクーポンが残っていなければ受け付けない
+		if quote.Fare.Discount > 0 && wallet.Reserve(ride.ID, quote.Fare, quote.Fare.Discount, now) < quote.Fare.Discount {
+			wallet.Release(ride.ID)
+			return errQuoteDiscountUnavailable
+		}
+		ride.FareBreakdown = quote.Fare
+	} else {
+		surge := surgePricer.Multiplier(ride.PickupLatitude, ride.PickupLongitude)
+		fare := calculateRideFare(ride, 0, surge)
+		// 最低運賃で割引が減る分も含めて、実際に使える割引の分だけクーポンを予約する
+		limit := calculateRideFare(ride, fare.Metered+fare.Surcharge, surge).Discount
+		discount := wallet.Reserve(ride.ID, fare, limit, now)
+		ride.FareBreakdown = calculateRideFare(ride, discount, surge)
+	}
+	ride.Fare = ride.FareBreakdown.Total
+	createRide(ride.ID, ride)
+	addRideIDsUserID(ride.UserID, ride.ID)
+	return nil
+}
+
 func appPostRidesEstimatedFare(c *fiber.Ctx) error {
 	ctx := c.Context()
 	req := &appPostRidesEstimatedFareRequest{}
@@ -191,21 +434,58 @@ func appPostRidesEstimatedFare(c *fiber.Ctx) error {
 	if req.PickupCoordinate == nil || req.DestinationCoordinate == nil {
 		return fiber.NewError(http.StatusBadRequest, "required fields(pickup_coordinate, destination_coordinate) are empty")
 	}
+	if err := validateWaypoints(req.Waypoints); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	chairClass, err := resolveChairClass(req.ChairClass, req.PreferredChairID)
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
 
 	user := ctx.UserValue("user").(*User)
 
-	discount := 0
-	if amount, ok := getUnusedCoupon(user.ID); ok {
-		discount = amount
+	now := time.Now()
+	in := FareInput{
+		PickupLatitude:       req.PickupCoordinate.Latitude,
+		PickupLongitude:      req.PickupCoordinate.Longitude,
+		DestinationLatitude:  req.DestinationCoordinate.Latitude,
+		DestinationLongitude: req.DestinationCoordinate.Longitude,
+		Waypoints:            req.Waypoints,
+		Class:                chairClass,
+		At:                   now,
+		Surge:                surgePricer.Multiplier(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude),
 	}
-	meteredFare := farePerDistance * calculateDistance(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
-	discounted := initialFare + discountedMeteredFare
-
-	return c.Status(http.StatusOK).JSON(&appPostRidesEstimatedFareResponse{
-		Fare:     discounted,
-		Discount: meteredFare - discountedMeteredFare,
+	engine := pricing.Load()
+	in.Discount = getCouponWallet(user.ID).Preview(engine.Quote(in), now)
+	fare := engine.Quote(in)
+	expiresAt := now.Add(fareQuoteTTL).UnixMilli()
+	quoteID, err := issueFareQuote(&FareQuote{
+		UserID:                user.ID,
+		PickupCoordinate:      *req.PickupCoordinate,
+		DestinationCoordinate: *req.DestinationCoordinate,
+		Waypoints:             req.Waypoints,
+		ChairClass:            chairClass,
+		Fare:                  fare,
+		ExpiresAt:             expiresAt,
+		Nonce:                 secureRandomStr(8),
 	})
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+
+	res := &appPostRidesEstimatedFareResponse{
+		QuoteID:         quoteID,
+		QuoteExpiresAt:  expiresAt,
+		Fare:            fare.Total,
+		Discount:        fare.Discount,
+		SurgeMultiplier: fare.SurgeMultiplier,
+		Breakdown:       fare,
+	}
+	if eta, ok := etaService.Forecast(*req.PickupCoordinate, req.Waypoints, *req.DestinationCoordinate, now); ok {
+		res.PickupETA = toETAMillis(eta.PickupAt)
+		res.ArrivalETA = toETAMillis(eta.ArrivalAt)
+	}
+	return c.Status(http.StatusOK).JSON(res)
 }
 
 func appPostRideEvaluatation(c *fiber.Ctx) error {
@@ -219,6 +499,9 @@ func appPostRideEvaluatation(c *fiber.Ctx) error {
 	if req.Evaluation < 1 || req.Evaluation > 5 {
 		return fiber.NewError(http.StatusBadRequest, "evaluation must be between 1 and 5")
 	}
+	if err := validateReview(req.Review, req.Tags); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
 
 	ride, ok := getRide(rideID)
 	if !ok {
@@ -229,15 +512,13 @@ func appPostRideEvaluatation(c *fiber.Ctx) error {
 	if status != "ARRIVED" {
 		return fiber.NewError(http.StatusBadRequest, "not arrived yet")
 	}
-	if ride.ChairID.Valid {
-		addChairStats(ride.ChairID.String, req.Evaluation)
+	// 評価を待たずに自動で完了にしている最中なら受け付けない
+	if !beginRideCompletion(ride.ID) {
+		return fiber.NewError(http.StatusConflict, "ride is already being completed")
 	}
-	ride.Evaluation = &req.Evaluation
-	ride.UpdatedAt = time.Now()
-	createRide(rideID, ride)
-
 	token, ok := getPaymentToken(ride.UserID)
 	if !ok {
+		abortRideCompletion(ride.ID)
 		return fiber.NewError(http.StatusBadRequest, "payment token not registered")
 	}
 
@@ -246,16 +527,40 @@ func appPostRideEvaluatation(c *fiber.Ctx) error {
 	}
 
 	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, rideID, token, paymentGatewayRequest); err != nil {
+		abortRideCompletion(ride.ID)
 		if errors.Is(err, erroredUpstream) {
 			return fiber.NewError(http.StatusBadGateway, err.Error())
 		}
 		return fiber.NewError(http.StatusInternalServerError, err.Error())
 	}
 
+	// 評価は決済が成功してから記録する。失敗したら評価し直してもらう
+	ride.Evaluation = &req.Evaluation
+	ride.UpdatedAt = time.Now()
+	createRide(rideID, ride)
+	recordChairRide(ride, ride.UpdatedAt)
+	getCouponWallet(ride.UserID).Commit(ride.ID)
+
 	defer processRideStatus(ride, "COMPLETED")
 
-	return c.Status(http.StatusOK).JSON(&appPostRideEvaluationResponse{
+	res := &appPostRideEvaluationResponse{
 		CompletedAt: ride.UpdatedAt.UnixMilli(),
+	}
+	if review := postReview(ride, req.Review, req.Tags, ride.UpdatedAt); review != nil {
+		res.ReviewID = review.ID
+		res.ReviewStatus = review.Status
+	}
+	return c.Status(http.StatusOK).JSON(res)
+}
+
+// appGetRating は椅子から受けた評価の集計を返す
+func appGetRating(c *fiber.Ctx) error {
+	user := c.Context().UserValue("user").(*User)
+	count, average, histogram := getRiderReputation(user.ID).Summary()
+	return c.Status(http.StatusOK).JSON(&appGetRatingResponse{
+		Count:     count,
+		Average:   average,
+		Histogram: histogram,
 	})
 }
 
@@ -306,6 +611,7 @@ func appGetNearbyChairs(c *fiber.Ctx) error {
 				ID:    chair.ID,
 				Name:  chair.Name,
 				Model: chair.Model,
+				Class: pricing.Load().ClassOf(chair),
 				CurrentCoordinate: Coordinate{
 					Latitude:  chairLocation.Latitude,
 					Longitude: chairLocation.Longitude,
@@ -319,3 +625,104 @@ func appGetNearbyChairs(c *fiber.Ctx) error {
 		RetrievedAt: retrievedAt.UnixMilli(),
 	})
 }
+
+func appPostCoupons(c *fiber.Ctx) error {
+	ctx := c.Context()
+	req := &appPostCouponsRequest{}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if req.Code == "" {
+		return fiber.NewError(http.StatusBadRequest, "code is required but was empty")
+	}
+
+	user := ctx.UserValue("user").(*User)
+	now := time.Now()
+	coupon, err := redeemCouponCode(user.ID, req.Code, now)
+	switch {
+	case errors.Is(err, errCampaignNotFound):
+		return fiber.NewError(http.StatusNotFound, err.Error())
+	case errors.Is(err, errCampaignExpired), errors.Is(err, errCampaignExhausted):
+		return fiber.NewError(http.StatusGone, err.Error())
+	case errors.Is(err, errCampaignAlreadyUsed):
+		return fiber.NewError(http.StatusConflict, err.Error())
+	case err != nil:
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.Status(http.StatusCreated).JSON(toAppCoupon(coupon, now))
+}
+
+func appGetCoupons(c *fiber.Ctx) error {
+	ctx := c.Context()
+	user := ctx.UserValue("user").(*User)
+
+	now := time.Now()
+	res := appGetCouponsResponse{Coupons: []appCoupon{}}
+	for _, coupon := range getCouponWallet(user.ID).List() {
+		res.Coupons = append(res.Coupons, toAppCoupon(coupon, now))
+	}
+	return c.Status(http.StatusOK).JSON(res)
+}
+
+func toAppCoupon(coupon *UserCoupon, now time.Time) appCoupon {
+	res := appCoupon{
+		Code:      coupon.Code,
+		Status:    coupon.status(now),
+		CreatedAt: coupon.CreatedAt.UnixMilli(),
+	}
+	if campaign, ok := getCouponCampaign(coupon.CampaignID); ok {
+		res.Name = campaign.Name
+		res.DiscountType = campaign.DiscountType
+		res.Amount = campaign.Amount
+		res.Percent = campaign.Percent
+		res.MinFare = campaign.MinFare
+		res.Stackable = campaign.Stackable
+		if campaign.ExpiresAt != nil {
+			expiresAt := campaign.ExpiresAt.UnixMilli()
+			res.ExpiresAt = &expiresAt
+		}
+	}
+	return res
+}
+
+func appGetReferrals(c *fiber.Ctx) error {
+	ctx := c.Context()
+	user := ctx.UserValue("user").(*User)
+
+	config := referralConfig.Load()
+	res := appGetReferralsResponse{
+		InvitationCode: user.InvitationCode,
+		MaxInvitations: config.MaxInvitations,
+		Referrals:      []appReferral{},
+	}
+	if campaign, ok := getCouponCampaign(config.InviterCampaignID); ok {
+		res.RewardPerReferral = campaign.Amount
+	}
+	for _, r := range listReferralsByInviter(user.ID) {
+		item := appReferral{
+			Status:    r.Status,
+			Reason:    r.Reason,
+			CreatedAt: r.CreatedAt.UnixMilli(),
+		}
+		if invitee, ok := getUser(r.InviteeID); ok {
+			item.InviteeName = invitee.Username
+		}
+		if r.RewardedAt != nil {
+			rewardedAt := r.RewardedAt.UnixMilli()
+			item.RewardedAt = &rewardedAt
+		}
+		switch r.Status {
+		case referralStatusPending:
+			res.Pending++
+		case referralStatusRewarded:
+			res.Rewarded++
+			res.TotalReward += res.RewardPerReferral
+		case referralStatusRejected:
+			res.Rejected++
+		}
+		res.Invited++
+		res.Referrals = append(res.Referrals, item)
+	}
+	return c.Status(http.StatusOK).JSON(res)
+}
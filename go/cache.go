@@ -1,6 +1,8 @@
 package main
 
 import (
+	"log/slog"
+	"slices"
 	"sync"
 	"time"
 )
@@ -9,11 +11,12 @@ type Notif struct {
 	Ride         *Ride
 	RideStatusID string
 	RideStatus   string
-}
-
-type ChairStats struct {
-	RideCount       int
-	TotalEvaluation float64
+	Refund       *RideRefund
+	// 予約ライドの通知では Ride は nil になる
+	Scheduled     *ScheduledRide
+	ScheduleEvent string
+	// 経由地に着いたときの経由地の番号 (1 始まり)
+	Stop int
 }
 
 type Location struct {
@@ -26,29 +29,31 @@ type TotalDistance struct {
 	UpdatedAt     time.Time
 }
 
-type ChairSale struct {
-	Sale      int
-	UpdatedAt time.Time
-}
-
 var (
 	latestRideStatus        = sync.Map{}
 	latestRide              = sync.Map{}
 	latestChairLocation     = sync.Map{}
-	chairStats              = sync.Map{}
+	chairRideHistories      = sync.Map{}
 	chairTotalDistance      = sync.Map{}
+	chairActivities         = sync.Map{}
+	chairActivityLog        = NewChairActivityLog()
 	appNotifChan            = sync.Map{}
 	chairNotifChan          = sync.Map{}
-	chairSale               = sync.Map{}
 	chairAccessToken        = sync.Map{}
 	appAccessToken          = sync.Map{}
 	ownerAccessToken        = sync.Map{}
 	ownerCache              = sync.Map{}
 	ownerChairRegisterToken = sync.Map{}
+	chairRegisterTickets    = sync.Map{}
 	chairsOwnerID           = sync.Map{}
 	chairCache              = sync.Map{}
 	invCouponCount          = sync.Map{}
-	unusedCoupons           = sync.Map{}
+	couponCampaigns         = sync.Map{}
+	couponCampaignCodes     = sync.Map{}
+	userCoupons             = sync.Map{}
+	referralsByInvitee      = sync.Map{}
+	referralsByInviter      = sync.Map{}
+	paymentTokenUsers       = sync.Map{}
 	rideDiscount            = sync.Map{}
 	userCache               = sync.Map{}
 	userInv                 = sync.Map{}
@@ -56,6 +61,16 @@ var (
 	paymentToken            = sync.Map{}
 	userRideStatus          = sync.Map{}
 	rideIDsUserID           = sync.Map{}
+	rideStatusHistory       = sync.Map{}
+	riderReputations        = sync.Map{}
+	ownerRiderPolicies      = sync.Map{}
+	rideRefunds             = sync.Map{}
+	refundIdempotencyKey    = sync.Map{}
+	usedQuotes              = sync.Map{}
+	completingRides         = sync.Map{}
+	ledger                  = NewLedger()
+	ownerStatements         = sync.Map{}
+	statementCache          = sync.Map{}
 	freeChairs              = NewFreeChairs()
 	waitingRides            = NewWaitingRides()
 )
@@ -64,20 +79,30 @@ func initCache() {
 	latestRideStatus = sync.Map{}
 	latestRide = sync.Map{}
 	latestChairLocation = sync.Map{}
-	chairStats = sync.Map{}
+	chairRideHistories = sync.Map{}
 	chairTotalDistance = sync.Map{}
+	chairActivities = sync.Map{}
+	chairActivityLog = NewChairActivityLog()
 	appNotifChan = sync.Map{}
 	chairNotifChan = sync.Map{}
-	chairSale = sync.Map{}
 	chairAccessToken = sync.Map{}
 	appAccessToken = sync.Map{}
 	ownerAccessToken = sync.Map{}
 	ownerCache = sync.Map{}
 	ownerChairRegisterToken = sync.Map{}
+	chairRegisterTickets = sync.Map{}
 	chairsOwnerID = sync.Map{}
 	chairCache = sync.Map{}
 	invCouponCount = sync.Map{}
-	unusedCoupons = sync.Map{}
+	couponCampaigns = sync.Map{}
+	couponCampaignCodes = sync.Map{}
+	userCoupons = sync.Map{}
+	referralsByInvitee = sync.Map{}
+	referralsByInviter = sync.Map{}
+	paymentTokenUsers = sync.Map{}
+	for _, campaign := range builtinCouponCampaigns() {
+		createCouponCampaign(campaign)
+	}
 	rideDiscount = sync.Map{}
 	userCache = sync.Map{}
 	userInv = sync.Map{}
@@ -85,6 +110,16 @@ func initCache() {
 	paymentToken = sync.Map{}
 	userRideStatus = sync.Map{}
 	rideIDsUserID = sync.Map{}
+	rideStatusHistory = sync.Map{}
+	riderReputations = sync.Map{}
+	ownerRiderPolicies = sync.Map{}
+	rideRefunds = sync.Map{}
+	refundIdempotencyKey = sync.Map{}
+	usedQuotes = sync.Map{}
+	completingRides = sync.Map{}
+	ledger = NewLedger()
+	ownerStatements = sync.Map{}
+	statementCache = sync.Map{}
 	freeChairs = NewFreeChairs()
 	waitingRides = NewWaitingRides()
 	chairSpeedbyName = map[string]int{
@@ -158,6 +193,39 @@ func createLatestRideStatus(rideID string, status string) {
 	latestRideStatus.Store(rideID, status)
 }
 
+type RideStatusEvent struct {
+	Status    string
+	Stop      int
+	CreatedAt time.Time
+}
+
+type RideStatusHistory struct {
+	events []RideStatusEvent
+	mu     sync.Mutex
+}
+
+func addRideStatusHistory(rideID string, status string, stop int, at time.Time) {
+	history, ok := rideStatusHistory.Load(rideID)
+	if !ok {
+		history, _ = rideStatusHistory.LoadOrStore(rideID, &RideStatusHistory{})
+	}
+	h := history.(*RideStatusHistory)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, RideStatusEvent{Status: status, Stop: stop, CreatedAt: at})
+}
+
+func listRideStatusHistory(rideID string) []RideStatusEvent {
+	history, ok := rideStatusHistory.Load(rideID)
+	if !ok {
+		return []RideStatusEvent{}
+	}
+	h := history.(*RideStatusHistory)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.events)
+}
+
 func getLatestRide(chairID string) (*Ride, bool) {
 	ride, ok := latestRide.Load(chairID)
 	if !ok {
@@ -174,8 +242,23 @@ func deleteLatestRide(chairID string) {
 	latestRide.Delete(chairID)
 }
 
+// releaseLatestRide は椅子の最新のライドが ride のままなら外す。次のライドが割り当て済みなら何もしない
+func releaseLatestRide(chairID string, ride *Ride) bool {
+	return latestRide.CompareAndDelete(chairID, ride)
+}
+
 func processRideStatus(ride *Ride, status string) {
+	processRideStatusAt(ride, status, time.Now())
+}
+
+// processRideStatusAt は now の時点の状態として記録する。まとめて送られた座標での乗車・到着は
+// 座標を記録した時刻になる
+func processRideStatusAt(ride *Ride, status string, now time.Time) {
 	createLatestRideStatus(ride.ID, status)
+	addRideStatusHistory(ride.ID, status, 0, now)
+	trackPooledRide(ride, status)
+	etaService.Observe(ride, status, now)
+	etaService.Update(ride, status, now)
 	// id := ulid.Make().String()
 	notif := &Notif{
 		Ride: ride,
@@ -185,10 +268,35 @@ func processRideStatus(ride *Ride, status string) {
 	publishAppChan(ride.UserID, notif)
 	if ride.ChairID.Valid {
 		publishChairChan(ride.ChairID.String, notif)
+		if chair, ok := getChair(ride.ChairID.String); ok {
+			switch status {
+			case "CARRYING":
+				getChairActivity(chair).StartCarrying(now)
+			case "ARRIVED", "COMPLETED", "CANCELED":
+				getChairActivity(chair).StopCarrying(now)
+			}
+		}
+	}
+	publishFleetRideStatus(ride)
+	if status == "CANCELED" {
+		// 決済まで進まなかったライドのクーポンは使えるように戻す
+		rideOffers.Forget(ride.ID)
+		getCouponWallet(ride.UserID).Release(ride.ID)
 	}
 	if status == "COMPLETED" {
-		createChairSale(ride)
+		rideOffers.Forget(ride.ID)
+		// 決済は済んでいるので完了は取り消さず、台帳に記帳できなかったことを残す
+		if err := postRideCharge(ride); err != nil {
+			slog.Error("failed to post ride charge",
+				"ride_id", ride.ID,
+				"user_id", ride.UserID,
+				"chair_id", ride.ChairID.String,
+				"fare", ride.Fare,
+				"error", err,
+			)
+		}
 		createUserRideStatus(ride.UserID, true)
+		completeReferral(ride.UserID, ride.UpdatedAt)
 	}
 }
 
@@ -214,25 +322,28 @@ func publishAppChan(userID string, notif *Notif) {
 	getAppChan(userID) <- notif
 }
 
+// tryPublishAppChan は利用者が通知を受け取っていなくても待たずに返す
+func tryPublishAppChan(userID string, notif *Notif) bool {
+	select {
+	case getAppChan(userID) <- notif:
+		return true
+	default:
+		return false
+	}
+}
+
 func publishChairChan(chairID string, notif *Notif) {
 	getChairChan(chairID) <- notif
 }
 
-func getChairSale(chairID string) ([]*ChairSale, bool) {
-	sales, ok := chairSale.Load(chairID)
-	if !ok {
-		return []*ChairSale{}, false
+// tryPublishChairChan は椅子が通知を受け取っていなくても待たずに返す
+func tryPublishChairChan(chairID string, notif *Notif) bool {
+	select {
+	case getChairChan(chairID) <- notif:
+		return true
+	default:
+		return false
 	}
-	return sales.([]*ChairSale), ok
-}
-
-func createChairSale(ride *Ride) {
-	chairSales, _ := getChairSale(ride.ChairID.String)
-	chairSales = append(chairSales, &ChairSale{
-		Sale:      calculateSale(*ride),
-		UpdatedAt: ride.UpdatedAt,
-	})
-	chairSale.Store(ride.ChairID.String, chairSales)
 }
 
 func createChairLocation(chairID string, chairLocation *ChairLocation) {
@@ -266,26 +377,44 @@ func createChairTotalDistance(chairID string, distance int, now time.Time) {
 	})
 }
 
-func getChairStatsCache(chairID string) (*ChairStats, bool) {
-	stats, ok := chairStats.Load(chairID)
+func getChairRideHistory(chairID string) *ChairRideHistory {
+	history, ok := chairRideHistories.Load(chairID)
 	if !ok {
-		return nil, false
+		history, _ = chairRideHistories.LoadOrStore(chairID, NewChairRideHistory())
+	}
+	return history.(*ChairRideHistory)
+}
+
+func getRiderReputation(userID string) *RiderReputation {
+	reputation, ok := riderReputations.Load(userID)
+	if !ok {
+		reputation, _ = riderReputations.LoadOrStore(userID, &RiderReputation{})
+	}
+	return reputation.(*RiderReputation)
+}
+
+func getOwnerRiderPolicy(ownerID string) RiderPolicy {
+	policy, ok := ownerRiderPolicies.Load(ownerID)
+	if !ok {
+		return RiderPolicy{Mode: riderPolicyOff}
 	}
-	return stats.(*ChairStats), ok
+	return policy.(RiderPolicy)
+}
+
+func setOwnerRiderPolicy(ownerID string, policy RiderPolicy) {
+	ownerRiderPolicies.Store(ownerID, policy)
 }
 
-func addChairStats(chairID string, evaluation int) {
-	stats, ok := getChairStatsCache(chairID)
+func getChairActivity(chair *Chair) *ChairActivity {
+	activity, ok := chairActivities.Load(chair.ID)
 	if !ok {
-		chairStats.Store(chairID, &ChairStats{
-			RideCount:       1,
-			TotalEvaluation: float64(evaluation),
-		})
-		return
+		activity, _ = chairActivities.LoadOrStore(chair.ID, NewChairActivity(chair.IsActive, chair.CreatedAt))
 	}
-	stats.RideCount++
-	stats.TotalEvaluation += float64(evaluation)
-	chairStats.Store(chairID, stats)
+	return activity.(*ChairActivity)
+}
+
+func createChairActivity(chairID string, activity *ChairActivity) {
+	chairActivities.Store(chairID, activity)
 }
 
 func getChairAccessToken(token string) (*Chair, bool) {
@@ -300,6 +429,10 @@ func createChairAccessToken(token string, chair *Chair) {
 	chairAccessToken.Store(token, chair)
 }
 
+func deleteChairAccessToken(token string) {
+	chairAccessToken.Delete(token)
+}
+
 func getAppAccessToken(token string) (*User, bool) {
 	user, ok := appAccessToken.Load(token)
 	if !ok {
@@ -382,6 +515,9 @@ func createOwner(ownerID string, owner *Owner) {
 
 func getOwnerChairRegisterToken(chairRegisterToken string) (*Owner, bool) {
 	owner, ok := ownerChairRegisterToken.Load(chairRegisterToken)
+	if !ok {
+		return nil, false
+	}
 	return owner.(*Owner), ok
 }
 
@@ -389,6 +525,23 @@ func createOwnerChairRegisterToken(chairRegisterToken string, owner *Owner) {
 	ownerChairRegisterToken.Store(chairRegisterToken, owner)
 }
 
+func deleteOwnerChairRegisterToken(chairRegisterToken string) {
+	ownerChairRegisterToken.Delete(chairRegisterToken)
+}
+
+func createChairRegisterTicket(ticket *ChairRegisterTicket) {
+	chairRegisterTickets.Store(ticket.Token, ticket)
+}
+
+// 使い捨てなので取り出すと同時に消す
+func takeChairRegisterTicket(token string) (*ChairRegisterTicket, bool) {
+	ticket, ok := chairRegisterTickets.LoadAndDelete(token)
+	if !ok {
+		return nil, false
+	}
+	return ticket.(*ChairRegisterTicket), ok
+}
+
 func getChairsOwnerID(ownerID string) ([]*Chair, bool) {
 	chairs, ok := chairsOwnerID.Load(ownerID)
 	if !ok {
@@ -407,8 +560,22 @@ func createChairsOwnerID(ownerID string, chair *Chair) {
 	chairsOwnerID.Store(ownerID, chairs)
 }
 
+func deleteChairsOwnerID(ownerID string, chairID string) {
+	tmp, _ := getChairsOwnerID(ownerID)
+	chairs := []*Chair{}
+	for _, c := range tmp {
+		if c.ID != chairID {
+			chairs = append(chairs, c)
+		}
+	}
+	chairsOwnerID.Store(ownerID, chairs)
+}
+
 func getChair(chairID string) (*Chair, bool) {
 	chair, ok := chairCache.Load(chairID)
+	if !ok {
+		return nil, false
+	}
 	return chair.(*Chair), ok
 }
 
@@ -416,6 +583,10 @@ func createChair(chairID string, chair *Chair) {
 	chairCache.Store(chairID, chair)
 }
 
+func deleteChair(chairID string) {
+	chairCache.Delete(chairID)
+}
+
 func getInvCouponCount(code string) (int, bool) {
 	count, ok := invCouponCount.Load(code)
 	if !ok {
@@ -432,72 +603,44 @@ func incInvCouponCount(code string) {
 	invCouponCount.Store(code, count+1)
 }
 
-type UnusedCouponAmount struct {
-	list []int
-	head int
-	mu   sync.Mutex
-}
-
-func NewUnusedCouponAmount() *UnusedCouponAmount {
-	return &UnusedCouponAmount{
-		list: []int{},
-		head: 0,
-		mu:   sync.Mutex{},
+func getCouponCampaign(campaignID string) (*CouponCampaign, bool) {
+	campaign, ok := couponCampaigns.Load(campaignID)
+	if !ok {
+		return nil, false
 	}
+	return campaign.(*CouponCampaign), ok
 }
 
-func (u *UnusedCouponAmount) Len() int {
-	u.mu.Lock()
-	defer u.mu.Unlock()
-	return len(u.list) - u.head
-}
-
-func (u *UnusedCouponAmount) Add(amount int) {
-	u.mu.Lock()
-	defer u.mu.Unlock()
-	u.list = append(u.list, amount)
-}
-
-func (u *UnusedCouponAmount) Front() int {
-	u.mu.Lock()
-	defer u.mu.Unlock()
-	return u.list[u.head]
+func getCouponCampaignByCode(code string) (*CouponCampaign, bool) {
+	campaign, ok := couponCampaignCodes.Load(code)
+	if !ok {
+		return nil, false
+	}
+	return campaign.(*CouponCampaign), ok
 }
 
-func (u *UnusedCouponAmount) Remove() {
-	u.mu.Lock()
-	defer u.mu.Unlock()
-	u.head++
+func listCouponCampaigns() []*CouponCampaign {
+	campaigns := []*CouponCampaign{}
+	couponCampaigns.Range(func(_, v any) bool {
+		campaigns = append(campaigns, v.(*CouponCampaign))
+		return true
+	})
+	return campaigns
 }
 
-func addUnusedCoupon(userID string, amount int) {
-	unusedCouponAmount := NewUnusedCouponAmount()
-	if tmp, ok := unusedCoupons.Load(userID); ok {
-		unusedCouponAmount = tmp.(*UnusedCouponAmount)
+func createCouponCampaign(campaign *CouponCampaign) {
+	couponCampaigns.Store(campaign.ID, campaign)
+	if campaign.Code != "" {
+		couponCampaignCodes.Store(campaign.Code, campaign)
 	}
-	unusedCouponAmount.Add(amount)
-	unusedCoupons.Store(userID, unusedCouponAmount)
 }
 
-func getUnusedCoupon(userID string) (int, bool) {
-	unusedCouponAmount := NewUnusedCouponAmount()
-	tmp, ok := unusedCoupons.Load(userID)
+func getCouponWallet(userID string) *CouponWallet {
+	wallet, ok := userCoupons.Load(userID)
 	if !ok {
-		return 0, false
+		wallet, _ = userCoupons.LoadOrStore(userID, NewCouponWallet())
 	}
-	unusedCouponAmount = tmp.(*UnusedCouponAmount)
-	if unusedCouponAmount.Len() == 0 {
-		return 0, false
-	}
-	return unusedCouponAmount.Front(), true
-}
-
-func useUnusedCoupon(userID string) {
-	unusedCouponAmount := NewUnusedCouponAmount()
-	if tmp, ok := unusedCoupons.Load(userID); ok {
-		unusedCouponAmount = tmp.(*UnusedCouponAmount)
-	}
-	unusedCouponAmount.Remove()
+	return wallet.(*CouponWallet)
 }
 
 func getRideDiscount(rideID string) (int, bool) {
@@ -558,6 +701,42 @@ func getPaymentToken(userID string) (string, bool) {
 
 func createPaymentToken(userID string, token string) {
 	paymentToken.Store(userID, token)
+	users := listPaymentTokenUsers(token)
+	for _, u := range users {
+		if u == userID {
+			return
+		}
+	}
+	paymentTokenUsers.Store(token, append(users, userID))
+}
+
+func listPaymentTokenUsers(token string) []string {
+	users, ok := paymentTokenUsers.Load(token)
+	if !ok {
+		return []string{}
+	}
+	return users.([]string)
+}
+
+func getReferralByInvitee(inviteeID string) (*Referral, bool) {
+	referral, ok := referralsByInvitee.Load(inviteeID)
+	if !ok {
+		return nil, false
+	}
+	return referral.(*Referral), ok
+}
+
+func listReferralsByInviter(inviterID string) []*Referral {
+	referrals, ok := referralsByInviter.Load(inviterID)
+	if !ok {
+		return []*Referral{}
+	}
+	return referrals.([]*Referral)
+}
+
+func createReferral(referral *Referral) {
+	referralsByInvitee.Store(referral.InviteeID, referral)
+	referralsByInviter.Store(referral.InviterID, append(listReferralsByInviter(referral.InviterID), referral))
 }
 
 func getUserRideStatus(userID string) (bool, bool) {
@@ -590,6 +769,59 @@ func addRideIDsUserID(userID string, rideID string) {
 	rideIDsUserID.Store(userID, rideIDs)
 }
 
+func listRideRefunds(rideID string) ([]*RideRefund, bool) {
+	refunds, ok := rideRefunds.Load(rideID)
+	if !ok {
+		return []*RideRefund{}, false
+	}
+	return refunds.([]*RideRefund), ok
+}
+
+func addRideRefund(refund *RideRefund) {
+	refunds, _ := listRideRefunds(refund.RideID)
+	refunds = append(refunds, refund)
+	rideRefunds.Store(refund.RideID, refunds)
+	refundIdempotencyKey.Store(refund.IdempotencyKey, refund)
+}
+
+func getRideRefundByIdempotencyKey(key string) (*RideRefund, bool) {
+	refund, ok := refundIdempotencyKey.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return refund.(*RideRefund), ok
+}
+
+// 返金・調整を差し引いた実際の請求額
+func getRideChargedFare(ride *Ride) int {
+	fare := ride.Fare
+	refunds, _ := listRideRefunds(ride.ID)
+	for _, r := range refunds {
+		fare -= r.Amount
+	}
+	return fare
+}
+
+func getOwnerStatements(ownerID string) *OwnerStatements {
+	statements, ok := ownerStatements.Load(ownerID)
+	if !ok {
+		statements, _ = ownerStatements.LoadOrStore(ownerID, NewOwnerStatements())
+	}
+	return statements.(*OwnerStatements)
+}
+
+func getStatement(statementID string) (*Statement, bool) {
+	statement, ok := statementCache.Load(statementID)
+	if !ok {
+		return nil, false
+	}
+	return statement.(*Statement), ok
+}
+
+func createStatement(statement *Statement) {
+	statementCache.Store(statement.ID, statement)
+}
+
 type WaitingRides struct {
 	cache map[string]*Ride
 	mu    sync.Mutex
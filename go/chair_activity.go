@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+type ChairActivityPeriod struct {
+	Active    bool
+	StartedAt time.Time
+	EndedAt   *time.Time
+}
+
+type ChairActivityStatus struct {
+	Active       bool
+	ActiveSince  time.Time
+	Uptime       time.Duration
+	CarryingTime time.Duration
+	IdleTime     time.Duration
+	Utilization  float64
+	LastSeenAt   *time.Time
+}
+
+// ChairActivity は椅子の稼働状態の履歴と、稼働時間・乗車中の時間の累計を持つ
+type ChairActivity struct {
+	periods       []ChairActivityPeriod
+	uptime        time.Duration
+	carryingSince *time.Time
+	carryingTime  time.Duration
+	lastSeenAt    *time.Time
+	mu            sync.Mutex
+}
+
+func NewChairActivity(active bool, since time.Time) *ChairActivity {
+	return &ChairActivity{
+		periods: []ChairActivityPeriod{{Active: active, StartedAt: since}},
+		mu:      sync.Mutex{},
+	}
+}
+
+func (a *ChairActivity) current() *ChairActivityPeriod {
+	return &a.periods[len(a.periods)-1]
+}
+
+// SetActive は状態が変わったときだけ期間を区切り、true を返す
+func (a *ChairActivity) SetActive(active bool, at time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cur := a.current()
+	if cur.Active == active {
+		return false
+	}
+	if at.Before(cur.StartedAt) {
+		at = cur.StartedAt
+	}
+	cur.EndedAt = &at
+	if cur.Active {
+		a.uptime += at.Sub(cur.StartedAt)
+	}
+	a.periods = append(a.periods, ChairActivityPeriod{Active: active, StartedAt: at})
+	return true
+}
+
+func (a *ChairActivity) StartCarrying(at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.carryingSince == nil {
+		a.carryingSince = &at
+	}
+}
+
+func (a *ChairActivity) StopCarrying(at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.carryingSince == nil {
+		return
+	}
+	a.carryingTime += at.Sub(*a.carryingSince)
+	a.carryingSince = nil
+}
+
+func (a *ChairActivity) Seen(at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastSeenAt = &at
+}
+
+func (a *ChairActivity) Status(now time.Time) ChairActivityStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cur := a.current()
+	uptime := a.uptime
+	if cur.Active {
+		uptime += now.Sub(cur.StartedAt)
+	}
+	carrying := a.carryingTime
+	if a.carryingSince != nil {
+		carrying += now.Sub(*a.carryingSince)
+	}
+	status := ChairActivityStatus{
+		Active:       cur.Active,
+		ActiveSince:  cur.StartedAt,
+		Uptime:       uptime,
+		CarryingTime: carrying,
+		IdleTime:     max(uptime-carrying, 0),
+		LastSeenAt:   a.lastSeenAt,
+	}
+	if uptime > 0 {
+		status.Utilization = min(float64(carrying)/float64(uptime), 1)
+	}
+	return status
+}
+
+func (a *ChairActivity) Periods() []ChairActivityPeriod {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.periods)
+}
+
+// setChairActive は椅子の稼働状態を更新し、変化があれば履歴として記録する
+func setChairActive(chair *Chair, active bool, now time.Time) {
+	chair.IsActive = active
+	if getChairActivity(chair).SetActive(active, now) {
+		chairActivityLog.Add(&ChairActivityEvent{
+			ID:        ulid.Make().String(),
+			ChairID:   chair.ID,
+			IsActive:  active,
+			CreatedAt: now,
+		})
+		fleetHub.Publish(chair, true, now)
+	}
+}
+
+// ChairActivityLog は稼働状態の変更をまとめて DB に書き出すためのバッファ
+// 書き出しにこの回数続けて失敗したら、溜まっているイベントを捨てる
+const maxChairActivityFlushRetries = 5
+
+type ChairActivityLog struct {
+	events []*ChairActivityEvent
+	// 続けて書き出しに失敗した回数
+	failures int
+	mu       sync.Mutex
+}
+
+func NewChairActivityLog() *ChairActivityLog {
+	return &ChairActivityLog{
+		events: []*ChairActivityEvent{},
+		mu:     sync.Mutex{},
+	}
+}
+
+func (l *ChairActivityLog) Add(event *ChairActivityEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+// Flush は溜まっているイベントを書き出す。失敗したら書き出せなかった件数と、
+// 失敗が続いて捨てた件数を返す
+func (l *ChairActivityLog) Flush(ctx context.Context) (pending int, dropped int, err error) {
+	l.mu.Lock()
+	events := l.events
+	l.events = []*ChairActivityEvent{}
+	l.mu.Unlock()
+	if len(events) == 0 {
+		return 0, 0, nil
+	}
+	_, err = db.NamedExecContext(ctx, "INSERT INTO chair_activity_events (id, chair_id, is_active, created_at) VALUES (:id, :chair_id, :is_active, :created_at)", events)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == nil {
+		l.failures = 0
+		return 0, 0, nil
+	}
+	l.failures++
+	if l.failures >= maxChairActivityFlushRetries {
+		l.failures = 0
+		return 0, len(events), err
+	}
+	// 書き出せなかった分は次回に回す
+	l.events = append(events, l.events...)
+	return len(events), 0, err
+}
+
+func startChairActivityFlushLoop() {
+	ticker := time.NewTicker(1 * time.Second)
+	for range ticker.C {
+		pending, dropped, err := chairActivityLog.Flush(context.Background())
+		if err != nil {
+			slog.Error("failed to flush chair activity events",
+				"pending", pending,
+				"dropped", dropped,
+				"error", err,
+			)
+		}
+	}
+}
+
+func loadChairActivityEvents(ctx context.Context) error {
+	events := []ChairActivityEvent{}
+	if err := db.SelectContext(ctx, &events, "SELECT * FROM chair_activity_events ORDER BY created_at"); err != nil {
+		return err
+	}
+	for _, e := range events {
+		chair, ok := getChair(e.ChairID)
+		if !ok {
+			continue
+		}
+		chair.IsActive = e.IsActive
+		getChairActivity(chair).SetActive(e.IsActive, e.CreatedAt)
+	}
+	return nil
+}
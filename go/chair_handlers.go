@@ -18,14 +18,14 @@ func chairPostChairs(c *fiber.Ctx) error {
 		return fiber.NewError(http.StatusBadRequest, "some of required fields(name, model, chair_register_token) are empty")
 	}
 
-	owner, ok := getOwnerChairRegisterToken(req.ChairRegisterToken)
+	now := time.Now()
+	owner, ok := resolveChairRegisterToken(req.ChairRegisterToken, now)
 	if !ok {
 		return fiber.NewError(http.StatusUnauthorized, "invalid chair_register_token")
 	}
 
 	chairID := ulid.Make().String()
 	accessToken := secureRandomStr(32)
-	now := time.Now()
 	chair := &Chair{
 		ID:          chairID,
 		OwnerID:     owner.ID,
@@ -38,6 +38,7 @@ func chairPostChairs(c *fiber.Ctx) error {
 		Speed:       getChairSpeedbyName(req.Model),
 	}
 	createChair(chairID, chair)
+	createChairActivity(chairID, NewChairActivity(false, now))
 	createChairAccessToken(accessToken, chair)
 	createChairsOwnerID(owner.ID, chair)
 
@@ -61,10 +62,19 @@ func chairPostActivity(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err != nil {
 		return fiber.NewError(http.StatusBadRequest)
 	}
+	now := time.Now()
 	if req.IsActive {
-		freeChairs.Add(chair)
+		if !chairDispatchable(chair) {
+			return fiber.NewError(http.StatusForbidden, "chair is suspended or retired by the owner")
+		}
+		setChairActive(chair, true, now)
+		// 予約ライドのために確保されている椅子は空き椅子に戻さない
+		if !scheduledRides.IsReserved(chair.ID) {
+			freeChairs.Add(chair)
+		}
 		return c.SendStatus(http.StatusNoContent)
 	}
+	setChairActive(chair, false, now)
 	freeChairs.Remove(chair.ID)
 	return c.SendStatus(http.StatusNoContent)
 }
@@ -72,43 +82,11 @@ func chairPostActivity(c *fiber.Ctx) error {
 func chairPostCoordinate(c *fiber.Ctx) error {
 	ctx := c.Context()
 	req := &Coordinate{}
-	chairPostCoordinateBindJSON(c.Body(), req)
-	// if err := c.BodyParser(&req); err != nil {
-	// 	return fiber.NewError(http.StatusBadRequest)
-	// }
+	if err := parseCoordinate(c.Body(), req); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
 	now := time.Now()
-	defer func() {
-		chair := ctx.UserValue("chair").(*Chair)
-
-		ride := &Ride{}
-		ride, ok := getLatestRide(chair.ID)
-		if ok {
-			status, _ := getLatestRideStatus(ride.ID)
-			if status != "COMPLETED" && status != "CANCELED" {
-				if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
-					processRideStatus(ride, "PICKUP")
-				}
-
-				if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
-					processRideStatus(ride, "ARRIVED")
-				}
-			}
-		}
-
-		chairLocation := &ChairLocation{
-			ID:        "dummy",
-			ChairID:   chair.ID,
-			Latitude:  req.Latitude,
-			Longitude: req.Longitude,
-			CreatedAt: now,
-		}
-		before, ok := getLatestChairLocation(chair.ID)
-		createChairLocation(chair.ID, chairLocation)
-		if ok {
-			distance := calculateDistance(before.Latitude, before.Longitude, req.Latitude, req.Longitude)
-			createChairTotalDistance(chair.ID, distance, now)
-		}
-	}()
+	defer applyChairCoordinate(ctx.UserValue("chair").(*Chair), *req, now)
 	// return c.Status(http.StatusOK).JSON(&chairPostCoordinateResponse{
 	// 	RecordedAt: now.UnixMilli(),
 	// })
@@ -117,6 +95,96 @@ func chairPostCoordinate(c *fiber.Ctx) error {
 	return c.SendStatus(http.StatusOK)
 }
 
+// chairPostCoordinates はまとめて送られた座標を記録した順に 1 つずつ反映する
+func chairPostCoordinates(c *fiber.Ctx) error {
+	chair := c.Context().UserValue("chair").(*Chair)
+	points, err := parseCoordinateBatch(c.Body(), make([]TimedCoordinate, 0, 16))
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	now := time.Now()
+	last := time.Time{}
+	if l, ok := getLatestChairLocation(chair.ID); ok {
+		last = l.CreatedAt
+	}
+	if err := validateCoordinateBatch(points, last, now); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	res := chairPostCoordinatesResponse{RecordedAt: make([]int64, 0, len(points))}
+	for _, p := range points {
+		at := time.UnixMilli(p.Timestamp)
+		applyChairCoordinate(chair, p.Coordinate, at)
+		res.RecordedAt = append(res.RecordedAt, at.UnixMilli())
+	}
+	return c.Status(http.StatusOK).JSON(res)
+}
+
+// applyChairCoordinate は椅子の位置を at の時点のものとして記録し、乗車・到着を判定する
+func applyChairCoordinate(chair *Chair, coord Coordinate, at time.Time) {
+	// 相乗り中は受け持っているライドそれぞれについて乗車地点・降車地点を見る
+	for _, ride := range chairRides(chair.ID) {
+		status, _ := getLatestRideStatus(ride.ID)
+		if status != "COMPLETED" && status != "CANCELED" {
+			if coord.Latitude == ride.PickupLatitude && coord.Longitude == ride.PickupLongitude && status == "ENROUTE" {
+				processRideStatusAt(ride, "PICKUP", at)
+			}
+
+			if status == "CARRYING" {
+				arriveAtNextStop(ride, coord, at)
+			}
+		}
+	}
+
+	chairLocation := &ChairLocation{
+		ID:        "dummy",
+		ChairID:   chair.ID,
+		Latitude:  coord.Latitude,
+		Longitude: coord.Longitude,
+		CreatedAt: at,
+	}
+	before, ok := getLatestChairLocation(chair.ID)
+	createChairLocation(chair.ID, chairLocation)
+	publishFleetLocation(chair, at)
+	if ok {
+		distance := calculateDistance(before.Latitude, before.Longitude, coord.Latitude, coord.Longitude)
+		createChairTotalDistance(chair.ID, distance, at)
+		if chairOnRide(chair.ID) {
+			etaService.ObserveMove(chair.ID, distance, at.Sub(before.CreatedAt))
+		}
+	}
+	refreshRideETAs(chair, at)
+}
+
+// chairPostRideEvaluation は椅子が降車した利用者を評価する。1 つのライドにつき 1 回だけ
+func chairPostRideEvaluation(c *fiber.Ctx) error {
+	ctx := c.Context()
+	chair := ctx.UserValue("chair").(*Chair)
+
+	req := &chairPostRideEvaluationRequest{}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if req.Evaluation < 1 || req.Evaluation > maxChairEvaluation {
+		return fiber.NewError(http.StatusBadRequest, "evaluation must be between 1 and 5")
+	}
+
+	ride, ok := getRide(c.Params("ride_id"))
+	if !ok || ride.ChairID.String != chair.ID {
+		return fiber.NewError(http.StatusNotFound, "ride not found")
+	}
+	status, _ := getLatestRideStatus(ride.ID)
+	if status != "ARRIVED" && status != "COMPLETED" {
+		return fiber.NewError(http.StatusBadRequest, "ride has not arrived yet")
+	}
+	if !evaluateRider(ride, req.Evaluation) {
+		return fiber.NewError(http.StatusConflict, "rider already evaluated")
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
+
 func chairPostRideStatus(c *fiber.Ctx) error {
 	ctx := c.Context()
 	rideID := c.Params("ride_id")
@@ -141,10 +209,32 @@ func chairPostRideStatus(c *fiber.Ctx) error {
 	switch req.Status {
 	// Acknowledge the ride
 	case "ENROUTE":
+		// 申し出を受ける。断った・時間切れになった申し出はもう受けられない
+		if !rideOffers.Accept(ride.ID, chair.ID) {
+			switch status, _ := getLatestRideStatus(ride.ID); status {
+			case "MATCHING":
+				return fiber.NewError(http.StatusConflict, "offer has expired")
+			case "ENROUTE":
+				// 受けた後の再送は何もしない
+				return c.SendStatus(http.StatusNoContent)
+			default:
+				return fiber.NewError(http.StatusConflict, "ride has already been acknowledged")
+			}
+		}
 		targetStatus = "ENROUTE"
+	// Decline the offered ride
+	case "DECLINED":
+		if !declineOffer(ride, chair.ID, time.Now()) {
+			return fiber.NewError(http.StatusConflict, "no pending offer for this ride")
+		}
+		return c.SendStatus(http.StatusNoContent)
 	// After Picking up user
 	case "CARRYING":
 		status, _ := getLatestRideStatus(ride.ID)
+		// 経由地を出るときの CARRYING は乗車中のままなので何もしない
+		if status == "CARRYING" && ride.WaypointsReached > 0 {
+			return c.SendStatus(http.StatusNoContent)
+		}
 		if status != "PICKUP" {
 			return fiber.NewError(http.StatusBadRequest, "chair has not arrived yet")
 		}
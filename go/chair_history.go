@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultChairHistoryLimit = 20
+	maxChairHistoryLimit     = 100
+	defaultChairRatingWindow = 10
+	maxChairEvaluation       = 5
+)
+
+type ChairRideRecord struct {
+	RideID   string
+	Fare     int
+	Distance int
+	Duration time.Duration
+	// 評価されずに自動で完了したライドでは nil
+	Evaluation  *int
+	Pickup      Coordinate
+	Destination Coordinate
+	RequestedAt time.Time
+	CompletedAt time.Time
+}
+
+// ChairRideHistory は完了したライドを完了順に持つ。評価の集計は評価されたライドだけで行い、
+// 評価の累積和を持っておき、直近 N 件の平均を O(1) で返す
+type ChairRideHistory struct {
+	rides      []ChairRideRecord
+	recorded   map[string]struct{}
+	cumulative []int
+	histogram  [maxChairEvaluation]int
+	mu         sync.RWMutex
+}
+
+func NewChairRideHistory() *ChairRideHistory {
+	return &ChairRideHistory{
+		rides:      []ChairRideRecord{},
+		recorded:   map[string]struct{}{},
+		cumulative: []int{0},
+		mu:         sync.RWMutex{},
+	}
+}
+
+// Add はライドを記録する。同じライドは一度しか記録しない
+func (h *ChairRideHistory) Add(record ChairRideRecord) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.recorded[record.RideID]; ok {
+		return false
+	}
+	h.recorded[record.RideID] = struct{}{}
+	h.rides = append(h.rides, record)
+	if record.Evaluation != nil {
+		h.cumulative = append(h.cumulative, h.cumulative[len(h.cumulative)-1]+*record.Evaluation)
+		h.histogram[*record.Evaluation-1]++
+	}
+	return true
+}
+
+func (h *ChairRideHistory) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.rides)
+}
+
+// Rated は評価されたライドの件数を返す
+func (h *ChairRideHistory) Rated() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.cumulative) - 1
+}
+
+// Average は評価されたライドのうち直近 window 件の評価の平均を返す。window が 0 以下なら全件
+func (h *ChairRideHistory) Average(window int) float64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := len(h.cumulative) - 1
+	if window <= 0 || window > n {
+		window = n
+	}
+	if window == 0 {
+		return 0
+	}
+	return float64(h.cumulative[n]-h.cumulative[n-window]) / float64(window)
+}
+
+func (h *ChairRideHistory) Histogram() [maxChairEvaluation]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.histogram
+}
+
+// Page は新しい順に offset 件目から limit 件を返す
+func (h *ChairRideHistory) Page(offset, limit int) []ChairRideRecord {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	records := []ChairRideRecord{}
+	for i := len(h.rides) - 1 - offset; i >= 0 && len(records) < limit; i-- {
+		records = append(records, h.rides[i])
+	}
+	return records
+}
+
+func recordChairRide(ride *Ride, completedAt time.Time) {
+	if !ride.ChairID.Valid {
+		return
+	}
+	getChairRideHistory(ride.ChairID.String).Add(ChairRideRecord{
+		RideID:      ride.ID,
+		Fare:        ride.FareBreakdown.Gross(),
+		Distance:    rideDistance(ride),
+		Duration:    completedAt.Sub(ride.CreatedAt),
+		Evaluation:  ride.Evaluation,
+		Pickup:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+		Destination: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+		RequestedAt: ride.CreatedAt,
+		CompletedAt: completedAt,
+	})
+}
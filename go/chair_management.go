@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultChairRegisterTicketTTL = 1 * time.Hour
+	maxChairRegisterTicketTTL     = 7 * 24 * time.Hour
+)
+
+var (
+	errChairNotFound   = errors.New("chair not found")
+	errChairOnRide     = errors.New("chair has a ride in progress")
+	errChairHasHistory = errors.New("chair has completed rides; retire it instead")
+	errChairRetired    = errors.New("chair is retired")
+)
+
+// ChairRegisterTicket は 1 回だけ使える有効期限付きの椅子登録トークン
+type ChairRegisterTicket struct {
+	Token     string
+	OwnerID   string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// 椅子の状態を変える操作は chairAccessToken, chairsOwnerID, chairCache, freeChairs を
+// まとめて書き換えるので直列にする
+var chairManagementMu sync.Mutex
+
+func getOwnedChair(owner *Owner, chairID string) (*Chair, error) {
+	chair, ok := getChair(chairID)
+	if !ok || chair.OwnerID != owner.ID {
+		return nil, errChairNotFound
+	}
+	return chair, nil
+}
+
+func chairOnRide(chairID string) bool {
+	ride, ok := getLatestRide(chairID)
+	if !ok {
+		return false
+	}
+	status, _ := getLatestRideStatus(ride.ID)
+	return status != "COMPLETED" && status != "CANCELED"
+}
+
+// chairDispatchable はライド完了後などに椅子を空き椅子に戻してよいかを返す
+func chairDispatchable(chair *Chair) bool {
+	return !chair.Suspended && chair.RetiredAt == nil
+}
+
+func renameChair(chair *Chair, name string, now time.Time) {
+	chairManagementMu.Lock()
+	defer chairManagementMu.Unlock()
+	chair.Name = name
+	chair.UpdatedAt = now
+}
+
+// suspendChair は椅子を配車対象から外す。走行中のライドはそのまま続けさせる
+func suspendChair(chair *Chair, now time.Time) {
+	chairManagementMu.Lock()
+	defer chairManagementMu.Unlock()
+	chair.Suspended = true
+	setChairActive(chair, false, now)
+	chair.UpdatedAt = now
+	freeChairs.Remove(chair.ID)
+}
+
+// resumeChair は停止を解除する。配車対象に戻るのは椅子が再び稼働を開始してから
+func resumeChair(chair *Chair, now time.Time) error {
+	chairManagementMu.Lock()
+	defer chairManagementMu.Unlock()
+	if chair.RetiredAt != nil {
+		return errChairRetired
+	}
+	chair.Suspended = false
+	chair.UpdatedAt = now
+	return nil
+}
+
+// retireChair は椅子を引退させ、アクセストークンも無効にする。売上などの履歴は残す
+func retireChair(chair *Chair, now time.Time) error {
+	chairManagementMu.Lock()
+	defer chairManagementMu.Unlock()
+	if chair.RetiredAt != nil {
+		return errChairRetired
+	}
+	freeChairs.Remove(chair.ID)
+	if chairOnRide(chair.ID) {
+		return errChairOnRide
+	}
+	deleteChairAccessToken(chair.AccessToken)
+	chair.AccessToken = ""
+	setChairActive(chair, false, now)
+	chair.RetiredAt = &now
+	chair.UpdatedAt = now
+	return nil
+}
+
+// removeChair は一度もライドを完了していない椅子だけを消す
+func removeChair(chair *Chair) error {
+	chairManagementMu.Lock()
+	defer chairManagementMu.Unlock()
+	if getChairRideHistory(chair.ID).Count() > 0 || ledger.ChairSalesSeries(chair.ID) != nil {
+		return errChairHasHistory
+	}
+	freeChairs.Remove(chair.ID)
+	if chairOnRide(chair.ID) {
+		return errChairOnRide
+	}
+	deleteChairAccessToken(chair.AccessToken)
+	deleteChairsOwnerID(chair.OwnerID, chair.ID)
+	deleteChair(chair.ID)
+	return nil
+}
+
+// reissueChairAccessToken は古いトークンを無効にして新しいトークンを発行する
+func reissueChairAccessToken(chair *Chair, now time.Time) (string, error) {
+	chairManagementMu.Lock()
+	defer chairManagementMu.Unlock()
+	if chair.RetiredAt != nil {
+		return "", errChairRetired
+	}
+	token := secureRandomStr(32)
+	deleteChairAccessToken(chair.AccessToken)
+	chair.AccessToken = token
+	chair.UpdatedAt = now
+	createChairAccessToken(token, chair)
+	return token, nil
+}
+
+func rotateChairRegisterToken(owner *Owner, now time.Time) string {
+	chairManagementMu.Lock()
+	defer chairManagementMu.Unlock()
+	token := secureRandomStr(32)
+	deleteOwnerChairRegisterToken(owner.ChairRegisterToken)
+	owner.ChairRegisterToken = token
+	owner.UpdatedAt = now
+	createOwnerChairRegisterToken(token, owner)
+	return token
+}
+
+func issueChairRegisterTicket(owner *Owner, ttl time.Duration, now time.Time) *ChairRegisterTicket {
+	ticket := &ChairRegisterTicket{
+		Token:     secureRandomStr(32),
+		OwnerID:   owner.ID,
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+	createChairRegisterTicket(ticket)
+	return ticket
+}
+
+// resolveChairRegisterToken はオーナーの登録トークンか、未使用で期限内の使い捨てトークンならオーナーを返す
+func resolveChairRegisterToken(token string, now time.Time) (*Owner, bool) {
+	if owner, ok := getOwnerChairRegisterToken(token); ok {
+		return owner, true
+	}
+	ticket, ok := takeChairRegisterTicket(token)
+	if !ok || !now.Before(ticket.ExpiresAt) {
+		return nil, false
+	}
+	owner, ok := ownerCache.Load(ticket.OwnerID)
+	if !ok {
+		return nil, false
+	}
+	return owner.(*Owner), true
+}
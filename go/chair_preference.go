@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const matchingSettingName = "matching_config"
+
+type MatchingConfig struct {
+	// 椅子のクラスや指名した椅子で配車できないまま、この秒数が経ったら条件を外す。0 なら外さない
+	PreferenceFallbackSeconds int `json:"preference_fallback_seconds"`
+}
+
+func defaultMatchingConfig() MatchingConfig {
+	return MatchingConfig{
+		PreferenceFallbackSeconds: 60,
+	}
+}
+
+func validateMatchingConfig(config MatchingConfig) error {
+	if config.PreferenceFallbackSeconds < 0 {
+		return errors.New("preference_fallback_seconds must not be negative")
+	}
+	return nil
+}
+
+func loadMatchingConfig(ctx context.Context) (MatchingConfig, error) {
+	config := defaultMatchingConfig()
+	found, err := getJSONSetting(ctx, matchingSettingName, &config)
+	if err != nil || !found {
+		return config, err
+	}
+	return config, validateMatchingConfig(config)
+}
+
+// マッチング中に読むので、入れ替えは Store で行う
+var matchingConfig atomic.Pointer[MatchingConfig]
+
+func init() {
+	config := defaultMatchingConfig()
+	matchingConfig.Store(&config)
+}
+
+var (
+	errUnknownChairClass         = errors.New("unknown chair_class")
+	errPreferredChairNotFound    = errors.New("preferred chair not found")
+	errPreferredChairUnavailable = errors.New("preferred chair is not available")
+	errConflictingPreference     = errors.New("chair_class and preferred_chair_id cannot be used together")
+)
+
+// resolveChairClass は利用者の指定から運賃に使う椅子のクラス (料金表の名前) を決める。
+// 椅子を指名したときはその椅子のクラスになる
+func resolveChairClass(chairClass, preferredChairID string) (string, error) {
+	if chairClass != "" && preferredChairID != "" {
+		return "", errConflictingPreference
+	}
+	if preferredChairID != "" {
+		chair, ok := getChair(preferredChairID)
+		if !ok {
+			return "", errPreferredChairNotFound
+		}
+		if !chairDispatchable(chair) {
+			return "", errPreferredChairUnavailable
+		}
+		return pricing.Load().ClassOf(chair), nil
+	}
+	if chairClass == "" {
+		return "", nil
+	}
+	if _, ok := pricing.Load().Tariff(chairClass); !ok {
+		return "", errUnknownChairClass
+	}
+	return chairClass, nil
+}
+
+// preferenceExpired は配車の条件を外して、どの椅子でも割り当ててよくなったかを返す
+func preferenceExpired(ride *Ride, now time.Time) bool {
+	config := matchingConfig.Load()
+	if config.PreferenceFallbackSeconds == 0 {
+		return false
+	}
+	return !now.Before(ride.CreatedAt.Add(time.Duration(config.PreferenceFallbackSeconds) * time.Second))
+}
+
+// rideAcceptsChair は椅子がライドの指定した条件を満たすかを返す
+func rideAcceptsChair(ride *Ride, chair *Chair, now time.Time) bool {
+	// 申し出を断った・返事をしなかった椅子には同じライドを申し出ない
+	if rideOffers.Excluded(ride.ID, chair.ID) {
+		return false
+	}
+	if ride.PreferredChairID == "" && ride.ChairClass == "" {
+		return true
+	}
+	if preferenceExpired(ride, now) {
+		return true
+	}
+	if ride.PreferredChairID != "" {
+		return chair.ID == ride.PreferredChairID
+	}
+	return pricing.Load().InClass(chair, ride.ChairClass)
+}
+
+// repriceOnAssign は割り当てた椅子の料金表の方が安ければ運賃を下げる。
+// 受付時には椅子が決まっていないので、高くなる場合は受付時の運賃のままにする。
+// 指定したクラスの椅子を割り当てたときは指定どおりの運賃なので変えない
+func repriceOnAssign(ride *Ride, chair *Chair) {
+	engine := pricing.Load()
+	if ride.ChairClass != "" && engine.InClass(chair, ride.ChairClass) {
+		return
+	}
+	fare := calculateChairFare(ride, chair, ride.FareBreakdown.Discount, ride.FareBreakdown.SurgeMultiplier)
+	if fare.Total < ride.FareBreakdown.Total {
+		ride.FareBreakdown = fare
+		ride.Fare = fare.Total
+		if ride.ChairClass != "" {
+			ride.ChairClass = engine.ClassOf(chair)
+		}
+	}
+}
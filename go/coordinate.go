@@ -0,0 +1,388 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// 椅子が報告できる座標の範囲
+const coordinateLimit = 1000
+
+// 一度にまとめて送れる座標の数
+const maxCoordinateBatch = 100
+
+// 知らないキーの値を読み飛ばすときの入れ子の深さの上限。encoding/json と同じ
+const maxJSONDepth = 10000
+
+// まとめて送られた座標の時刻が、サーバーの時計よりこれだけ進んでいても受け付ける
+const maxCoordinateClockSkew = 5 * time.Second
+
+var (
+	errCoordinateSyntax   = errors.New("invalid JSON")
+	errCoordinateNotInt   = errors.New("latitude and longitude must be integers")
+	errCoordinateMissing  = errors.New("latitude and longitude are required")
+	errCoordinateOutRange = errors.New("latitude and longitude must be between -1000 and 1000")
+	errTimestampInvalid   = errors.New("timestamp must be a non-negative integer in milliseconds")
+	errTimestampMissing   = errors.New("timestamp is required")
+	errBatchEmpty         = errors.New("coordinates must not be empty")
+	errBatchTooLarge      = errors.New("too many coordinates")
+	errBatchOutOfOrder    = errors.New("timestamps must be in order and not before the last reported coordinate")
+	errBatchFuture        = errors.New("timestamp is in the future")
+)
+
+// TimedCoordinate は椅子が記録した時刻つきの座標
+type TimedCoordinate struct {
+	Coordinate
+	Timestamp int64
+}
+
+// parseCoordinate は {"latitude":1,"longitude":2} の形の JSON を読む。
+// キーの順序や空白、知らないキーは問わない。読むときにメモリを確保しない
+func parseCoordinate(b []byte, coord *Coordinate) error {
+	i, err := parseCoordinateObject(b, skipJSONSpace(b, 0), coord, nil)
+	if err != nil {
+		return err
+	}
+	if skipJSONSpace(b, i) != len(b) {
+		return errCoordinateSyntax
+	}
+	return nil
+}
+
+// parseCoordinateBatch は時刻つきの座標の配列を読んで points に足す。
+// [{"latitude":1,"longitude":2,"timestamp":1733000000000}, ...] の形で、順序はそのまま保つ
+func parseCoordinateBatch(b []byte, points []TimedCoordinate) ([]TimedCoordinate, error) {
+	i := skipJSONSpace(b, 0)
+	if i >= len(b) || b[i] != '[' {
+		return points, errCoordinateSyntax
+	}
+	i = skipJSONSpace(b, i+1)
+	if i < len(b) && b[i] == ']' {
+		return points, errBatchEmpty
+	}
+	for {
+		if len(points) == maxCoordinateBatch {
+			return points, errBatchTooLarge
+		}
+		p := TimedCoordinate{Timestamp: -1}
+		var err error
+		if i, err = parseCoordinateObject(b, i, &p.Coordinate, &p.Timestamp); err != nil {
+			return points, err
+		}
+		if p.Timestamp < 0 {
+			return points, errTimestampMissing
+		}
+		points = append(points, p)
+		i = skipJSONSpace(b, i)
+		if i >= len(b) {
+			return points, errCoordinateSyntax
+		}
+		if b[i] == ']' {
+			break
+		}
+		if b[i] != ',' {
+			return points, errCoordinateSyntax
+		}
+		i = skipJSONSpace(b, i+1)
+	}
+	if skipJSONSpace(b, i+1) != len(b) {
+		return points, errCoordinateSyntax
+	}
+	return points, nil
+}
+
+// validateCoordinateBatch は座標の時刻が last 以降で古い順に並び、now より先に進みすぎていないかを確かめる
+func validateCoordinateBatch(points []TimedCoordinate, last time.Time, now time.Time) error {
+	for _, p := range points {
+		at := time.UnixMilli(p.Timestamp)
+		if at.Before(last) {
+			return errBatchOutOfOrder
+		}
+		if at.After(now.Add(maxCoordinateClockSkew)) {
+			return errBatchFuture
+		}
+		last = at
+	}
+	return nil
+}
+
+// parseCoordinateObject は b[i] から始まるオブジェクトを読み、読み終えた次の位置を返す。
+// timestamp が nil なら timestamp のキーも知らないキーとして読み飛ばす
+func parseCoordinateObject(b []byte, i int, coord *Coordinate, timestamp *int64) (int, error) {
+	if i >= len(b) || b[i] != '{' {
+		return i, errCoordinateSyntax
+	}
+	i = skipJSONSpace(b, i+1)
+	hasLatitude, hasLongitude := false, false
+	if i < len(b) && b[i] == '}' {
+		return i + 1, errCoordinateMissing
+	}
+	for {
+		var key [len("longitude")]byte
+		n, next, err := parseJSONKey(b, i, key[:])
+		if err != nil {
+			return next, err
+		}
+		i = skipJSONSpace(b, next)
+		if i >= len(b) || b[i] != ':' {
+			return i, errCoordinateSyntax
+		}
+		i = skipJSONSpace(b, i+1)
+
+		switch string(key[:n]) {
+		case "latitude":
+			coord.Latitude, i, err = parseCoordinateValue(b, i)
+			hasLatitude = true
+		case "longitude":
+			coord.Longitude, i, err = parseCoordinateValue(b, i)
+			hasLongitude = true
+		case "timestamp":
+			if timestamp == nil {
+				i, err = skipJSONValue(b, i, 0)
+				break
+			}
+			*timestamp, i, err = parseTimestamp(b, i)
+		default:
+			i, err = skipJSONValue(b, i, 0)
+		}
+		if err != nil {
+			return i, err
+		}
+
+		i = skipJSONSpace(b, i)
+		if i >= len(b) {
+			return i, errCoordinateSyntax
+		}
+		if b[i] == '}' {
+			i++
+			break
+		}
+		if b[i] != ',' {
+			return i, errCoordinateSyntax
+		}
+		i = skipJSONSpace(b, i+1)
+	}
+	if !hasLatitude || !hasLongitude {
+		return i, errCoordinateMissing
+	}
+	return i, nil
+}
+
+func skipJSONSpace(b []byte, i int) int {
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t' || b[i] == '\n' || b[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// parseJSONKey は文字列を読んで key に書き、書いた長さを返す。
+// key に収まらない文字列は知らないキーなので、長さは key より長い値になる
+func parseJSONKey(b []byte, i int, key []byte) (int, int, error) {
+	if i >= len(b) || b[i] != '"' {
+		return 0, i, errCoordinateSyntax
+	}
+	i++
+	n := 0
+	for i < len(b) {
+		ch := b[i]
+		switch {
+		case ch == '"':
+			if n > len(key) {
+				return 0, i + 1, nil
+			}
+			return n, i + 1, nil
+		case ch < 0x20:
+			return 0, i, errCoordinateSyntax
+		case ch == '\\':
+			var err error
+			ch, i, err = unescapeJSONChar(b, i)
+			if err != nil {
+				return 0, i, err
+			}
+		default:
+			i++
+		}
+		if n < len(key) {
+			key[n] = ch
+		}
+		n++
+	}
+	return 0, i, errCoordinateSyntax
+}
+
+// unescapeJSONChar は b[i] の \ から始まるエスケープを読む。
+// キーの比較にだけ使うので、ASCII 以外の文字は 0 として扱う
+func unescapeJSONChar(b []byte, i int) (byte, int, error) {
+	if i+1 >= len(b) {
+		return 0, i, errCoordinateSyntax
+	}
+	switch b[i+1] {
+	case '"', '\\', '/':
+		return b[i+1], i + 2, nil
+	case 'b', 'f', 'n', 'r', 't':
+		return 0, i + 2, nil
+	case 'u':
+		if i+6 > len(b) {
+			return 0, i, errCoordinateSyntax
+		}
+		r := 0
+		for _, h := range b[i+2 : i+6] {
+			switch {
+			case '0' <= h && h <= '9':
+				r = r<<4 | int(h-'0')
+			case 'a' <= h && h <= 'f':
+				r = r<<4 | int(h-'a'+10)
+			case 'A' <= h && h <= 'F':
+				r = r<<4 | int(h-'A'+10)
+			default:
+				return 0, i, errCoordinateSyntax
+			}
+		}
+		if r < 0x80 {
+			return byte(r), i + 6, nil
+		}
+		return 0, i + 6, nil
+	}
+	return 0, i, errCoordinateSyntax
+}
+
+// parseCoordinateValue は整数を読む。小数や指数を含む数は JSON としては正しくても受け付けない
+func parseCoordinateValue(b []byte, i int) (int, int, error) {
+	sign := 1
+	if i < len(b) && b[i] == '-' {
+		sign = -1
+		i++
+	}
+	if i >= len(b) || b[i] < '0' || b[i] > '9' {
+		if sign == 1 && i < len(b) && (b[i] == '"' || b[i] == 'n' || b[i] == 't' || b[i] == 'f' || b[i] == '[' || b[i] == '{') {
+			return 0, i, errCoordinateNotInt
+		}
+		return 0, i, errCoordinateSyntax
+	}
+	// 先頭の 0 の後に数字は続けられない
+	if b[i] == '0' && i+1 < len(b) && '0' <= b[i+1] && b[i+1] <= '9' {
+		return 0, i, errCoordinateSyntax
+	}
+	n := 0
+	outOfRange := false
+	for ; i < len(b) && '0' <= b[i] && b[i] <= '9'; i++ {
+		if !outOfRange {
+			n = n*10 + int(b[i]-'0')
+			outOfRange = n > coordinateLimit
+		}
+	}
+	if i < len(b) && (b[i] == '.' || b[i] == 'e' || b[i] == 'E') {
+		return 0, i, errCoordinateNotInt
+	}
+	if outOfRange {
+		return 0, i, errCoordinateOutRange
+	}
+	return sign * n, i, nil
+}
+
+func parseTimestamp(b []byte, i int) (int64, int, error) {
+	if i >= len(b) || b[i] < '0' || b[i] > '9' || (b[i] == '0' && i+1 < len(b) && '0' <= b[i+1] && b[i+1] <= '9') {
+		return 0, i, errTimestampInvalid
+	}
+	var n int64
+	start := i
+	for ; i < len(b) && '0' <= b[i] && b[i] <= '9'; i++ {
+		n = n*10 + int64(b[i]-'0')
+	}
+	// ミリ秒の UNIX 時刻は 15 桁あれば足りる。それより長いものは桁あふれを避けて受け付けない
+	if i-start > 15 || (i < len(b) && (b[i] == '.' || b[i] == 'e' || b[i] == 'E')) {
+		return 0, i, errTimestampInvalid
+	}
+	return n, i, nil
+}
+
+// skipJSONValue は知らないキーの値を読み飛ばす
+func skipJSONValue(b []byte, i int, depth int) (int, error) {
+	if depth > maxJSONDepth || i >= len(b) {
+		return i, errCoordinateSyntax
+	}
+	switch ch := b[i]; {
+	case ch == '"':
+		var none [0]byte
+		_, next, err := parseJSONKey(b, i, none[:])
+		return next, err
+	case ch == '{' || ch == '[':
+		end := byte('}')
+		if ch == '[' {
+			end = ']'
+		}
+		i = skipJSONSpace(b, i+1)
+		if i < len(b) && b[i] == end {
+			return i + 1, nil
+		}
+		for {
+			var err error
+			if ch == '{' {
+				var none [0]byte
+				if _, i, err = parseJSONKey(b, i, none[:]); err != nil {
+					return i, err
+				}
+				i = skipJSONSpace(b, i)
+				if i >= len(b) || b[i] != ':' {
+					return i, errCoordinateSyntax
+				}
+				i = skipJSONSpace(b, i+1)
+			}
+			if i, err = skipJSONValue(b, i, depth+1); err != nil {
+				return i, err
+			}
+			i = skipJSONSpace(b, i)
+			if i >= len(b) {
+				return i, errCoordinateSyntax
+			}
+			if b[i] == end {
+				return i + 1, nil
+			}
+			if b[i] != ',' {
+				return i, errCoordinateSyntax
+			}
+			i = skipJSONSpace(b, i+1)
+		}
+	case ch == '-' || ('0' <= ch && ch <= '9'):
+		return skipJSONNumber(b, i)
+	}
+	for _, lit := range [...]string{"true", "false", "null"} {
+		if len(b)-i >= len(lit) && string(b[i:i+len(lit)]) == lit {
+			return i + len(lit), nil
+		}
+	}
+	return i, errCoordinateSyntax
+}
+
+func skipJSONNumber(b []byte, i int) (int, error) {
+	digits := func(i int) (int, bool) {
+		start := i
+		for i < len(b) && '0' <= b[i] && b[i] <= '9' {
+			i++
+		}
+		return i, i > start
+	}
+	if b[i] == '-' {
+		i++
+	}
+	start := i
+	i, ok := digits(i)
+	if !ok || (b[start] == '0' && i-start > 1) {
+		return i, errCoordinateSyntax
+	}
+	if i < len(b) && b[i] == '.' {
+		if i, ok = digits(i + 1); !ok {
+			return i, errCoordinateSyntax
+		}
+	}
+	if i < len(b) && (b[i] == 'e' || b[i] == 'E') {
+		i++
+		if i < len(b) && (b[i] == '+' || b[i] == '-') {
+			i++
+		}
+		if i, ok = digits(i); !ok {
+			return i, errCoordinateSyntax
+		}
+	}
+	return i, nil
+}
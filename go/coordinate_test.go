@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+func TestParseCoordinate(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want Coordinate
+		err  error
+	}{
+		// 以前の固定位置での切り出しが前提にしていた形。カンマの位置が 13〜15 バイト目になる
+		{name: "one digit", body: `{"latitude":5,"longitude":260}`, want: Coordinate{Latitude: 5, Longitude: 260}},
+		{name: "two digits", body: `{"latitude":27,"longitude":-3}`, want: Coordinate{Latitude: 27, Longitude: -3}},
+		{name: "negative", body: `{"latitude":-27,"longitude":260}`, want: Coordinate{Latitude: -27, Longitude: 260}},
+		{name: "three digits", body: `{"latitude":270,"longitude":0}`, want: Coordinate{Latitude: 270, Longitude: 0}},
+		// 以前の切り出しでは読めなかった形
+		{name: "four digits", body: `{"latitude":-1000,"longitude":1000}`, want: Coordinate{Latitude: -1000, Longitude: 1000}},
+		{name: "whitespace", body: " {\n\t\"latitude\" : 1 ,\r\n \"longitude\" : 2 } ", want: Coordinate{Latitude: 1, Longitude: 2}},
+		{name: "reordered", body: `{"longitude":260,"latitude":-27}`, want: Coordinate{Latitude: -27, Longitude: 260}},
+		{name: "unknown keys", body: `{"id":"x\"y","latitude":1,"meta":{"a":[1,2.5e3,null,true,false,{}]},"longitude":2}`, want: Coordinate{Latitude: 1, Longitude: 2}},
+		{name: "escaped key", body: `{"lat\u0069tude":1,"longitude":2}`, want: Coordinate{Latitude: 1, Longitude: 2}},
+		{name: "duplicate key", body: `{"latitude":1,"longitude":2,"latitude":3}`, want: Coordinate{Latitude: 3, Longitude: 2}},
+		{name: "negative zero", body: `{"latitude":-0,"longitude":0}`, want: Coordinate{}},
+		{name: "timestamp ignored", body: `{"latitude":1,"longitude":2,"timestamp":"now"}`, want: Coordinate{Latitude: 1, Longitude: 2}},
+
+		{name: "empty", body: ``, err: errCoordinateSyntax},
+		{name: "not an object", body: `[1,2]`, err: errCoordinateSyntax},
+		{name: "empty object", body: `{}`, err: errCoordinateMissing},
+		{name: "missing longitude", body: `{"latitude":1}`, err: errCoordinateMissing},
+		{name: "trailing garbage", body: `{"latitude":1,"longitude":2}x`, err: errCoordinateSyntax},
+		{name: "trailing comma", body: `{"latitude":1,"longitude":2,}`, err: errCoordinateSyntax},
+		{name: "missing comma", body: `{"latitude":1 "longitude":2}`, err: errCoordinateSyntax},
+		{name: "truncated", body: `{"latitude":-27,"longitude":26`, err: errCoordinateSyntax},
+		{name: "leading zero", body: `{"latitude":01,"longitude":2}`, err: errCoordinateSyntax},
+		{name: "lone minus", body: `{"latitude":-,"longitude":2}`, err: errCoordinateSyntax},
+		{name: "fraction", body: `{"latitude":1.5,"longitude":2}`, err: errCoordinateNotInt},
+		{name: "exponent", body: `{"latitude":1e2,"longitude":2}`, err: errCoordinateNotInt},
+		{name: "string", body: `{"latitude":"1","longitude":2}`, err: errCoordinateNotInt},
+		{name: "null", body: `{"latitude":null,"longitude":2}`, err: errCoordinateNotInt},
+		{name: "too large", body: `{"latitude":1001,"longitude":2}`, err: errCoordinateOutRange},
+		{name: "too small", body: `{"latitude":1,"longitude":-1001}`, err: errCoordinateOutRange},
+		{name: "overflow", body: `{"latitude":99999999999999999999999,"longitude":2}`, err: errCoordinateOutRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Coordinate{}
+			err := parseCoordinate([]byte(tt.body), &got)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("parseCoordinate(%q) error = %v, want %v", tt.body, err, tt.err)
+			}
+			if err == nil && got != tt.want {
+				t.Fatalf("parseCoordinate(%q) = %+v, want %+v", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCoordinateBatch(t *testing.T) {
+	point := func(lat, lon int, ts int64) TimedCoordinate {
+		return TimedCoordinate{Coordinate: Coordinate{Latitude: lat, Longitude: lon}, Timestamp: ts}
+	}
+	batch := func(n int) (string, []TimedCoordinate) {
+		b := []byte{'['}
+		points := []TimedCoordinate{}
+		for i := range n {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, `{"latitude":1,"longitude":2,"timestamp":`...)
+			b = strconv.AppendInt(b, int64(i), 10)
+			b = append(b, '}')
+			points = append(points, point(1, 2, int64(i)))
+		}
+		return string(append(b, ']')), points
+	}
+	limitBody, limitPoints := batch(maxCoordinateBatch)
+	overBody, _ := batch(maxCoordinateBatch + 1)
+	tests := []struct {
+		name string
+		body string
+		want []TimedCoordinate
+		err  error
+	}{
+		{name: "one", body: `[{"latitude":1,"longitude":2,"timestamp":1733000000000}]`, want: []TimedCoordinate{point(1, 2, 1733000000000)}},
+		{name: "whitespace", body: " [ {\"timestamp\":5,\"longitude\":2,\"latitude\":1} ,\n{\"latitude\":3,\"longitude\":4,\"timestamp\":6} ] ", want: []TimedCoordinate{point(1, 2, 5), point(3, 4, 6)}},
+		// 時刻の順序は読むときには見ない。並びはそのまま返す
+		{name: "out of order timestamps", body: `[{"latitude":1,"longitude":2,"timestamp":20},{"latitude":3,"longitude":4,"timestamp":10}]`, want: []TimedCoordinate{point(1, 2, 20), point(3, 4, 10)}},
+		{name: "limit", body: limitBody, want: limitPoints},
+
+		{name: "empty array", body: `[]`, err: errBatchEmpty},
+		{name: "empty array with spaces", body: ` [ ] `, err: errBatchEmpty},
+		{name: "over the limit", body: overBody, err: errBatchTooLarge},
+		{name: "not an array", body: `{"latitude":1,"longitude":2,"timestamp":1}`, err: errCoordinateSyntax},
+		{name: "bad point in the middle", body: `[{"latitude":1,"longitude":2,"timestamp":1},{"latitude":1.5,"longitude":2,"timestamp":2},{"latitude":1,"longitude":2,"timestamp":3}]`, err: errCoordinateNotInt},
+		{name: "out of range in the middle", body: `[{"latitude":1,"longitude":2,"timestamp":1},{"latitude":1001,"longitude":2,"timestamp":2},{"latitude":1,"longitude":2,"timestamp":3}]`, err: errCoordinateOutRange},
+		{name: "missing timestamp", body: `[{"latitude":1,"longitude":2}]`, err: errTimestampMissing},
+		{name: "negative timestamp", body: `[{"latitude":1,"longitude":2,"timestamp":-1}]`, err: errTimestampInvalid},
+		{name: "fractional timestamp", body: `[{"latitude":1,"longitude":2,"timestamp":1.5}]`, err: errTimestampInvalid},
+		{name: "trailing comma", body: `[{"latitude":1,"longitude":2,"timestamp":1},]`, err: errCoordinateSyntax},
+		{name: "trailing garbage", body: `[{"latitude":1,"longitude":2,"timestamp":1}]x`, err: errCoordinateSyntax},
+		{name: "truncated", body: `[{"latitude":1,"longitude":2,"timestamp":1}`, err: errCoordinateSyntax},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCoordinateBatch([]byte(tt.body), nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("parseCoordinateBatch(%q) error = %v, want %v", tt.body, err, tt.err)
+			}
+			if err == nil && !slices.Equal(got, tt.want) {
+				t.Fatalf("parseCoordinateBatch(%q) = %+v, want %+v", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateCoordinateBatch(t *testing.T) {
+	now := time.UnixMilli(1733000000000)
+	at := func(d time.Duration) TimedCoordinate {
+		return TimedCoordinate{Timestamp: now.Add(d).UnixMilli()}
+	}
+	tests := []struct {
+		name   string
+		points []TimedCoordinate
+		last   time.Time
+		err    error
+	}{
+		{name: "in order", points: []TimedCoordinate{at(-3 * time.Second), at(-2 * time.Second), at(-time.Second)}},
+		{name: "same timestamp", points: []TimedCoordinate{at(-time.Second), at(-time.Second)}},
+		{name: "equal to the last reported", points: []TimedCoordinate{at(-time.Second)}, last: now.Add(-time.Second)},
+		{name: "within clock skew", points: []TimedCoordinate{at(maxCoordinateClockSkew)}},
+
+		{name: "out of order", points: []TimedCoordinate{at(-time.Second), at(-2 * time.Second)}, err: errBatchOutOfOrder},
+		{name: "before the last reported", points: []TimedCoordinate{at(-2 * time.Second)}, last: now.Add(-time.Second), err: errBatchOutOfOrder},
+		{name: "in the future", points: []TimedCoordinate{at(-time.Second), at(maxCoordinateClockSkew + time.Millisecond)}, err: errBatchFuture},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateCoordinateBatch(tt.points, tt.last, now); !errors.Is(err, tt.err) {
+				t.Fatalf("validateCoordinateBatch() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+// referenceCoordinate は encoding/json で読んだ latitude と longitude を返す。
+// 整数で範囲内の値が両方そろっていなければ ok は false
+func referenceCoordinate(b []byte) (Coordinate, bool, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	m := map[string]any{}
+	if err := d.Decode(&m); err != nil {
+		return Coordinate{}, false, err
+	}
+	if _, err := d.Token(); err == nil {
+		return Coordinate{}, false, errors.New("trailing data")
+	}
+	value := func(key string) (int, bool) {
+		n, ok := m[key].(json.Number)
+		if !ok {
+			return 0, false
+		}
+		v, err := strconv.Atoi(string(n))
+		return v, err == nil && -coordinateLimit <= v && v <= coordinateLimit
+	}
+	lat, latOK := value("latitude")
+	lon, lonOK := value("longitude")
+	return Coordinate{Latitude: lat, Longitude: lon}, latOK && lonOK, nil
+}
+
+func FuzzParseCoordinate(f *testing.F) {
+	f.Add([]byte(`{"latitude":-27,"longitude":260}`))
+	f.Add([]byte(`{"longitude":5,"latitude":0}`))
+	f.Add([]byte(` {"a":[{"b":1e5}],"latitude":-1000,"longitude":1000} `))
+	f.Add([]byte(`{"latitude":1.5,"longitude":2}`))
+	f.Add([]byte(`{"latitude":1,"longitude":2}`))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		got := Coordinate{}
+		err := parseCoordinate(b, &got)
+		want, wantOK, refErr := referenceCoordinate(b)
+		if err == nil {
+			if refErr != nil || !wantOK {
+				t.Fatalf("accepted %q, but encoding/json gives %+v, %v", b, want, refErr)
+			}
+			if got != want {
+				t.Fatalf("parseCoordinate(%q) = %+v, encoding/json = %+v", b, got, want)
+			}
+			return
+		}
+		// 同じキーが何度も出てくると、途中の値が不正でも encoding/json は最後の値だけを見る。
+		// エスケープでも同じキーを作れるので、どちらもない入力で受け付けるべきものを拒んでいないかを見る
+		if refErr == nil && wantOK && !bytes.ContainsRune(b, '\\') &&
+			bytes.Count(b, []byte(`"latitude"`)) == 1 && bytes.Count(b, []byte(`"longitude"`)) == 1 {
+			t.Fatalf("rejected %q with %v, but encoding/json reads %+v", b, err, want)
+		}
+	})
+}
+
+func BenchmarkParseCoordinate(b *testing.B) {
+	body := []byte(`{"latitude":-27,"longitude":260}`)
+	b.Run("parseCoordinate", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			c := Coordinate{}
+			if err := parseCoordinate(body, &c); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("sonic", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			c := Coordinate{}
+			if err := sonic.Unmarshal(body, &c); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("encoding/json", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			c := Coordinate{}
+			if err := json.Unmarshal(body, &c); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
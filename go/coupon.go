@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	couponDiscountAmount  = "AMOUNT"
+	couponDiscountPercent = "PERCENT"
+)
+
+// 既存データのクーポンコードの接頭辞に対応する組み込みキャンペーン
+const (
+	signupCampaignID           = "CP"
+	invitationCampaignID       = "INV"
+	invitationRewardCampaignID = "RWD"
+)
+
+var (
+	errCampaignNotFound    = errors.New("coupon code not found")
+	errCampaignExpired     = errors.New("coupon campaign has expired")
+	errCampaignExhausted   = errors.New("coupon campaign has reached its maximum uses")
+	errCampaignAlreadyUsed = errors.New("coupon campaign already redeemed")
+)
+
+type CouponCampaign struct {
+	ID           string     `json:"id"`
+	Code         string     `json:"code"`
+	Name         string     `json:"name"`
+	DiscountType string     `json:"discount_type"`
+	Amount       int        `json:"amount"`
+	Percent      int        `json:"percent"`
+	MinFare      int        `json:"min_fare"`
+	MaxUses      int        `json:"max_uses"`
+	Stackable    bool       `json:"stackable"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Uses         int        `json:"uses"`
+}
+
+func (c *CouponCampaign) validate() error {
+	switch c.DiscountType {
+	case couponDiscountAmount:
+		if c.Amount <= 0 {
+			return errors.New("amount must be positive")
+		}
+	case couponDiscountPercent:
+		if c.Percent <= 0 || c.Percent > 100 {
+			return errors.New("percent must be between 1 and 100")
+		}
+	default:
+		return errors.New("discount_type must be AMOUNT or PERCENT")
+	}
+	if c.MinFare < 0 || c.MaxUses < 0 {
+		return errors.New("min_fare and max_uses must not be negative")
+	}
+	return nil
+}
+
+type UserCoupon struct {
+	Code       string
+	UserID     string
+	CampaignID string
+	CreatedAt  time.Time
+	// 配車要求時に予約し、決済が成功した時点で使用済みにする
+	ReservedBy string
+	UsedBy     string
+}
+
+func (u *UserCoupon) status(now time.Time) string {
+	switch {
+	case u.UsedBy != "":
+		return "USED"
+	case u.ReservedBy != "":
+		return "RESERVED"
+	}
+	if campaign, ok := getCouponCampaign(u.CampaignID); ok && campaign.ExpiresAt != nil && now.After(*campaign.ExpiresAt) {
+		return "EXPIRED"
+	}
+	return "AVAILABLE"
+}
+
+// 割引額はキャンペーンの定義から計算する。fare は割引対象となる距離料金と割増料金の合計
+func (u *UserCoupon) discount(fare int) int {
+	campaign, ok := getCouponCampaign(u.CampaignID)
+	if !ok {
+		return 0
+	}
+	if campaign.DiscountType == couponDiscountPercent {
+		return fare * campaign.Percent / 100
+	}
+	return campaign.Amount
+}
+
+type CouponWallet struct {
+	coupons []*UserCoupon
+	mu      sync.Mutex
+}
+
+func NewCouponWallet() *CouponWallet {
+	return &CouponWallet{
+		coupons: []*UserCoupon{},
+		mu:      sync.Mutex{},
+	}
+}
+
+func (w *CouponWallet) Add(coupon *UserCoupon) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.coupons = append(w.coupons, coupon)
+	slices.SortStableFunc(w.coupons, func(a, b *UserCoupon) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+}
+
+func (w *CouponWallet) List() []*UserCoupon {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Clone(w.coupons)
+}
+
+// selectCoupons は古い順に適用可能なクーポンを選ぶ。
+// 先頭のクーポンが併用不可ならそれだけを、併用可なら併用可のクーポンをすべて使う
+func (w *CouponWallet) selectCoupons(fare FareBreakdown, now time.Time) []*UserCoupon {
+	gross := fare.Base + fare.Metered + fare.Surcharge
+	selected := []*UserCoupon{}
+	for _, c := range w.coupons {
+		if c.UsedBy != "" || c.ReservedBy != "" {
+			continue
+		}
+		campaign, ok := getCouponCampaign(c.CampaignID)
+		if !ok {
+			continue
+		}
+		if campaign.ExpiresAt != nil && now.After(*campaign.ExpiresAt) {
+			continue
+		}
+		if gross < campaign.MinFare {
+			continue
+		}
+		if len(selected) == 0 {
+			selected = append(selected, c)
+			if !campaign.Stackable {
+				break
+			}
+			continue
+		}
+		if campaign.Stackable {
+			selected = append(selected, c)
+		}
+	}
+	return selected
+}
+
+func (w *CouponWallet) Preview(fare FareBreakdown, now time.Time) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	discount := 0
+	for _, c := range w.selectCoupons(fare, now) {
+		discount += c.discount(fare.Metered + fare.Surcharge)
+	}
+	return discount
+}
+
+// Reserve は選んだクーポンを古い順に、割引の合計が limit に届くまで予約する。
+// limit は運賃に適用できる割引の上限で、それを超える分のクーポンは使わずに残す
+func (w *CouponWallet) Reserve(rideID string, fare FareBreakdown, limit int, now time.Time) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	discount := 0
+	for _, c := range w.selectCoupons(fare, now) {
+		if discount >= limit {
+			break
+		}
+		d := c.discount(fare.Metered + fare.Surcharge)
+		if d <= 0 {
+			continue
+		}
+		discount += d
+		c.ReservedBy = rideID
+	}
+	return min(discount, limit)
+}
+
+func (w *CouponWallet) Commit(rideID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, c := range w.coupons {
+		if c.ReservedBy == rideID {
+			c.ReservedBy = ""
+			c.UsedBy = rideID
+		}
+	}
+}
+
+func (w *CouponWallet) Release(rideID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, c := range w.coupons {
+		if c.ReservedBy == rideID {
+			c.ReservedBy = ""
+		}
+	}
+}
+
+func (w *CouponWallet) hasCampaign(campaignID string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, c := range w.coupons {
+		if c.CampaignID == campaignID {
+			return true
+		}
+	}
+	return false
+}
+
+func builtinCouponCampaigns() []*CouponCampaign {
+	return []*CouponCampaign{
+		{ID: signupCampaignID, Name: "初回登録キャンペーン", DiscountType: couponDiscountAmount, Amount: 3000},
+		{ID: invitationCampaignID, Name: "招待キャンペーン", DiscountType: couponDiscountAmount, Amount: 1500},
+		{ID: invitationRewardCampaignID, Name: "招待報酬", DiscountType: couponDiscountAmount, Amount: 1000},
+	}
+}
+
+func couponCampaignIDFromCode(code string) string {
+	prefix, _, _ := strings.Cut(code, "_")
+	if _, ok := getCouponCampaign(prefix); ok {
+		return prefix
+	}
+	return invitationRewardCampaignID
+}
+
+// campaignMu はキャンペーンの利用数を守る
+var campaignMu sync.Mutex
+
+// snapshot は利用数の更新と重ならないようにキャンペーンを写し取る
+func (c *CouponCampaign) snapshot() CouponCampaign {
+	campaignMu.Lock()
+	defer campaignMu.Unlock()
+	return *c
+}
+
+func grantCoupon(userID string, campaignID string, code string, now time.Time) *UserCoupon {
+	coupon := &UserCoupon{
+		Code:       code,
+		UserID:     userID,
+		CampaignID: campaignID,
+		CreatedAt:  now,
+	}
+	getCouponWallet(userID).Add(coupon)
+	return coupon
+}
+
+// redeemCouponCode は利用者が入力したコードでキャンペーンのクーポンを受け取る
+func redeemCouponCode(userID string, code string, now time.Time) (*UserCoupon, error) {
+	campaign, ok := getCouponCampaignByCode(code)
+	if !ok {
+		return nil, errCampaignNotFound
+	}
+	campaignMu.Lock()
+	defer campaignMu.Unlock()
+	if campaign.ExpiresAt != nil && now.After(*campaign.ExpiresAt) {
+		return nil, errCampaignExpired
+	}
+	if campaign.MaxUses > 0 && campaign.Uses >= campaign.MaxUses {
+		return nil, errCampaignExhausted
+	}
+	wallet := getCouponWallet(userID)
+	if wallet.hasCampaign(campaign.ID) {
+		return nil, errCampaignAlreadyUsed
+	}
+	campaign.Uses++
+	return grantCoupon(userID, campaign.ID, campaign.Code, now), nil
+}
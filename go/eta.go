@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+const etaSettingName = "eta_config"
+
+type ETAConfig struct {
+	// 走行の実績がまだない椅子について、Speed 1 あたり 1 秒に進む距離
+	DefaultMovesPerSecond float64 `json:"default_moves_per_second"`
+	// 走行の実績から速さを更新するときの新しい値の重み
+	PaceSmoothing float64 `json:"pace_smoothing"`
+	// 位置の更新で予測がこれ以上変わったら、利用者に現在の状態をもう一度通知する。0 なら通知しない
+	PushThresholdMillis int `json:"push_threshold_ms"`
+}
+
+func defaultETAConfig() ETAConfig {
+	return ETAConfig{
+		DefaultMovesPerSecond: 1,
+		PaceSmoothing:         0.2,
+		PushThresholdMillis:   0,
+	}
+}
+
+func validateETAConfig(config ETAConfig) error {
+	if config.DefaultMovesPerSecond <= 0 {
+		return errors.New("default_moves_per_second must be positive")
+	}
+	if config.PaceSmoothing <= 0 || config.PaceSmoothing > 1 {
+		return errors.New("pace_smoothing must be in (0, 1]")
+	}
+	if config.PushThresholdMillis < 0 {
+		return errors.New("push_threshold_ms must not be negative")
+	}
+	return nil
+}
+
+func loadETAConfig(ctx context.Context) (ETAConfig, error) {
+	config := defaultETAConfig()
+	found, err := getJSONSetting(ctx, etaSettingName, &config)
+	if err != nil || !found {
+		return config, err
+	}
+	return config, validateETAConfig(config)
+}
+
+type RideETA struct {
+	PickupAt  *time.Time
+	ArrivalAt *time.Time
+}
+
+// rideETAState は最新の予測と、精度を測るための最初の予測を持つ。
+// 乗車の予測は椅子が割り当てられたとき、到着の予測は乗車したときのものを使う
+type rideETAState struct {
+	current          RideETA
+	predictedPickup  *time.Time
+	pickupPredictAt  time.Time
+	predictedArrival *time.Time
+	arrivalPredictAt time.Time
+}
+
+type etaAccuracy struct {
+	count       int
+	sumAbsError time.Duration
+	sumError    time.Duration
+	maxAbsError time.Duration
+	// 予測した時点から実際の時刻までの長さに対する誤差の割合の合計
+	sumRelError float64
+}
+
+func (a *etaAccuracy) observe(predicted, actual, predictedAt time.Time) {
+	diff := actual.Sub(predicted)
+	abs := diff.Abs()
+	a.count++
+	a.sumError += diff
+	a.sumAbsError += abs
+	a.maxAbsError = max(a.maxAbsError, abs)
+	if horizon := actual.Sub(predictedAt); horizon > 0 {
+		a.sumRelError += float64(abs) / float64(horizon)
+	}
+}
+
+func (a *etaAccuracy) report() adminGetETAAccuracyItem {
+	item := adminGetETAAccuracyItem{Count: a.count}
+	if a.count == 0 {
+		return item
+	}
+	item.MeanAbsErrorMillis = (a.sumAbsError / time.Duration(a.count)).Milliseconds()
+	item.MeanErrorMillis = (a.sumError / time.Duration(a.count)).Milliseconds()
+	item.MaxAbsErrorMillis = a.maxAbsError.Milliseconds()
+	item.MeanRelativeError = a.sumRelError / float64(a.count)
+	return item
+}
+
+// ETAService は椅子の走行の実績から速さを学習し、ライドの乗車・到着の時刻を予測する
+type ETAService struct {
+	config  ETAConfig
+	paces   map[string]float64
+	rides   map[string]*rideETAState
+	pickup  etaAccuracy
+	arrival etaAccuracy
+	mu      sync.Mutex
+}
+
+func NewETAService(config ETAConfig) *ETAService {
+	return &ETAService{
+		config: config,
+		paces:  map[string]float64{},
+		rides:  map[string]*rideETAState{},
+		mu:     sync.Mutex{},
+	}
+}
+
+var etaService = NewETAService(defaultETAConfig())
+
+// Reset は学習した速さと精度の集計を捨てて設定を入れ替える
+func (s *ETAService) Reset(config ETAConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	s.paces = map[string]float64{}
+	s.rides = map[string]*rideETAState{}
+	s.pickup = etaAccuracy{}
+	s.arrival = etaAccuracy{}
+}
+
+func (s *ETAService) Config() ETAConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+func (s *ETAService) SetConfig(config ETAConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+}
+
+// ObserveMove は椅子の位置の更新から 1 秒あたりに進む距離を学習する。
+// 止まっていた時間を含めないよう、ライド中で間隔が短いものだけを使う
+func (s *ETAService) ObserveMove(chairID string, distance int, elapsed time.Duration) {
+	if distance <= 0 || elapsed <= 0 || elapsed > 5*time.Second {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pace := float64(distance) / elapsed.Seconds()
+	if prev, ok := s.paces[chairID]; ok {
+		pace = prev + s.config.PaceSmoothing*(pace-prev)
+	}
+	s.paces[chairID] = pace
+}
+
+func (s *ETAService) travel(chair *Chair, distance int) time.Duration {
+	pace, ok := s.paces[chair.ID]
+	if !ok {
+		pace = float64(max(chair.Speed, 1)) * s.config.DefaultMovesPerSecond
+	}
+	return time.Duration(math.Ceil(float64(distance) / pace * float64(time.Second)))
+}
+
+// Update はライドの状態と椅子の位置から予測を更新し、前回の予測からの変化を返す
+func (s *ETAService) Update(ride *Ride, status string, now time.Time) (RideETA, time.Duration) {
+	if !ride.ChairID.Valid {
+		return RideETA{}, 0
+	}
+	chair, ok := getChair(ride.ChairID.String)
+	if !ok {
+		return RideETA{}, 0
+	}
+	l, ok := getLatestChairLocation(chair.ID)
+	if !ok {
+		return RideETA{}, 0
+	}
+	toPickup, toArrival, ok := remainingDistances(ride, status, Coordinate{Latitude: l.Latitude, Longitude: l.Longitude})
+	if !ok {
+		return RideETA{}, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	eta := RideETA{}
+	if toPickup >= 0 {
+		pickupAt := now.Add(s.travel(chair, toPickup))
+		eta.PickupAt = &pickupAt
+	}
+	arrivalAt := now.Add(s.travel(chair, toArrival))
+	eta.ArrivalAt = &arrivalAt
+
+	state, ok := s.rides[ride.ID]
+	if !ok {
+		state = &rideETAState{}
+		s.rides[ride.ID] = state
+	}
+	changed := etaChange(state.current, eta)
+	state.current = eta
+	if state.predictedPickup == nil && eta.PickupAt != nil {
+		state.predictedPickup = eta.PickupAt
+		state.pickupPredictAt = now
+	}
+	if state.predictedArrival == nil && eta.PickupAt == nil {
+		state.predictedArrival = eta.ArrivalAt
+		state.arrivalPredictAt = now
+	}
+	return eta, changed
+}
+
+func etaChange(before, after RideETA) time.Duration {
+	diff := func(a, b *time.Time) time.Duration {
+		if a == nil || b == nil {
+			return 0
+		}
+		return a.Sub(*b).Abs()
+	}
+	return max(diff(before.PickupAt, after.PickupAt), diff(before.ArrivalAt, after.ArrivalAt))
+}
+
+// Observe は乗車・到着の実際の時刻を最初の予測と突き合わせる
+func (s *ETAService) Observe(ride *Ride, status string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.rides[ride.ID]
+	switch status {
+	case "PICKUP":
+		if ok && state.predictedPickup != nil {
+			s.pickup.observe(*state.predictedPickup, now, state.pickupPredictAt)
+		}
+	case "ARRIVED":
+		if ok && state.predictedArrival != nil {
+			s.arrival.observe(*state.predictedArrival, now, state.arrivalPredictAt)
+		}
+		delete(s.rides, ride.ID)
+	case "COMPLETED", "CANCELED":
+		delete(s.rides, ride.ID)
+	}
+}
+
+func (s *ETAService) Get(rideID string) (RideETA, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.rides[rideID]
+	if !ok {
+		return RideETA{}, false
+	}
+	return state.current, true
+}
+
+func (s *ETAService) Report() adminGetETAAccuracyResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return adminGetETAAccuracyResponse{
+		Pickup:  s.pickup.report(),
+		Arrival: s.arrival.report(),
+	}
+}
+
+// Forecast はまだ椅子が決まっていないライドについて、最も近い空き椅子が向かった場合の時刻を返す
+func (s *ETAService) Forecast(pickup Coordinate, waypoints []Coordinate, destination Coordinate, now time.Time) (RideETA, bool) {
+	freeChairs.Lock()
+	chairs := freeChairs.List()
+	freeChairs.Unlock()
+	var nearest *Chair
+	nearestDistance := -1
+	for _, c := range chairs {
+		l, ok := getLatestChairLocation(c.ID)
+		if !ok {
+			continue
+		}
+		d := calculateDistance(l.Latitude, l.Longitude, pickup.Latitude, pickup.Longitude)
+		if nearestDistance < 0 || d < nearestDistance {
+			nearest, nearestDistance = c, d
+		}
+	}
+	if nearest == nil {
+		return RideETA{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pickupAt := now.Add(s.travel(nearest, nearestDistance))
+	arrivalAt := pickupAt.Add(s.travel(nearest, routeDistance(pickup, waypoints, destination)))
+	return RideETA{PickupAt: &pickupAt, ArrivalAt: &arrivalAt}, true
+}
+
+// remainingDistances は椅子の現在地から乗車地点・到着地点までの残りの距離を返す。
+// 乗車済みなら乗車地点までの距離は -1
+func remainingDistances(ride *Ride, status string, from Coordinate) (int, int, bool) {
+	pickup := Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+	destination := Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}
+	if stops := poolStopsOf(ride); stops != nil {
+		return poolRemainingDistances(ride.ID, from, stops)
+	}
+	switch status {
+	case "MATCHING", "ENROUTE":
+		toPickup := calculateDistance(from.Latitude, from.Longitude, pickup.Latitude, pickup.Longitude)
+		return toPickup, toPickup + routeDistance(pickup, ride.Waypoints, destination), true
+	case "PICKUP":
+		return -1, routeDistance(pickup, ride.Waypoints, destination), true
+	case "CARRYING":
+		return -1, routeDistance(from, ride.Waypoints[ride.WaypointsReached:], destination), true
+	}
+	return 0, 0, false
+}
+
+// poolRemainingDistances は相乗りの停車地の予定に沿って残りの距離を求める
+func poolRemainingDistances(rideID string, from Coordinate, stops []PoolStop) (int, int, bool) {
+	toPickup := -1
+	distance := 0
+	for _, s := range stops {
+		distance += calculateDistance(from.Latitude, from.Longitude, s.Coordinate.Latitude, s.Coordinate.Longitude)
+		from = s.Coordinate
+		if s.RideID != rideID {
+			continue
+		}
+		if s.Type == poolStopPickup {
+			toPickup = distance
+			continue
+		}
+		return toPickup, distance, true
+	}
+	return 0, 0, false
+}
+
+// refreshRideETAs は椅子の位置が更新されたときに、受け持っているライドの予測を更新する
+func refreshRideETAs(chair *Chair, now time.Time) {
+	threshold := time.Duration(etaService.Config().PushThresholdMillis) * time.Millisecond
+	for _, ride := range chairRides(chair.ID) {
+		status, _ := getLatestRideStatus(ride.ID)
+		_, changed := etaService.Update(ride, status, now)
+		if threshold > 0 && changed >= threshold {
+			go publishAppChan(ride.UserID, &Notif{Ride: ride, RideStatus: status})
+		}
+	}
+}
+
+func toETAMillis(t *time.Time) *int64 {
+	if t == nil {
+		return nil
+	}
+	millis := t.UnixMilli()
+	return &millis
+}
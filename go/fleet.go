@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+const fleetSettingName = "fleet_stream_config"
+
+type FleetConfig struct {
+	// 同じ椅子の位置更新を配信する最短の間隔。ライドの状態変化はすぐに配信する
+	MinIntervalMillis int `json:"min_interval_ms"`
+}
+
+func defaultFleetConfig() FleetConfig {
+	return FleetConfig{
+		MinIntervalMillis: 1000,
+	}
+}
+
+func validateFleetConfig(config FleetConfig) error {
+	if config.MinIntervalMillis < 0 {
+		return errors.New("min_interval_ms must not be negative")
+	}
+	return nil
+}
+
+func loadFleetConfig(ctx context.Context) (FleetConfig, error) {
+	config := defaultFleetConfig()
+	found, err := getJSONSetting(ctx, fleetSettingName, &config)
+	if err != nil || !found {
+		return config, err
+	}
+	return config, validateFleetConfig(config)
+}
+
+// FleetSubscriber は配信待ちの椅子の状態を椅子ごとに最新の 1 件だけ持つ。
+// 読み出しが遅れても古い位置は捨てられるだけで、配信が詰まることはない
+type FleetSubscriber struct {
+	ownerID string
+	pending map[string]ownerFleetChair
+	order   []string
+	notify  chan struct{}
+	mu      sync.Mutex
+}
+
+func (s *FleetSubscriber) push(state ownerFleetChair) {
+	s.mu.Lock()
+	if _, ok := s.pending[state.ChairID]; !ok {
+		s.order = append(s.order, state.ChairID)
+	}
+	s.pending[state.ChairID] = state
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *FleetSubscriber) drain() []ownerFleetChair {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states := make([]ownerFleetChair, 0, len(s.order))
+	for _, chairID := range s.order {
+		states = append(states, s.pending[chairID])
+	}
+	s.pending = map[string]ownerFleetChair{}
+	s.order = s.order[:0]
+	return states
+}
+
+type fleetChairThrottle struct {
+	chair  *Chair
+	sentAt time.Time
+	dirty  bool
+}
+
+type FleetHub struct {
+	config      FleetConfig
+	chairs      map[string]*fleetChairThrottle
+	subscribers map[string]map[*FleetSubscriber]struct{}
+	mu          sync.Mutex
+}
+
+func NewFleetHub(config FleetConfig) *FleetHub {
+	return &FleetHub{
+		config:      config,
+		chairs:      map[string]*fleetChairThrottle{},
+		subscribers: map[string]map[*FleetSubscriber]struct{}{},
+		mu:          sync.Mutex{},
+	}
+}
+
+var fleetHub = NewFleetHub(defaultFleetConfig())
+
+// Reset は初期化時に呼ぶ。接続中の購読者はそのまま残す
+func (h *FleetHub) Reset(config FleetConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.config = config
+	h.chairs = map[string]*fleetChairThrottle{}
+}
+
+func (h *FleetHub) SetConfig(config FleetConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.config = config
+}
+
+func (h *FleetHub) Config() FleetConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.config
+}
+
+func (h *FleetHub) Subscribe(ownerID string) *FleetSubscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := &FleetSubscriber{
+		ownerID: ownerID,
+		pending: map[string]ownerFleetChair{},
+		notify:  make(chan struct{}, 1),
+	}
+	if _, ok := h.subscribers[ownerID]; !ok {
+		h.subscribers[ownerID] = map[*FleetSubscriber]struct{}{}
+	}
+	h.subscribers[ownerID][s] = struct{}{}
+	return s
+}
+
+func (h *FleetHub) Unsubscribe(s *FleetSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers[s.ownerID], s)
+	if len(h.subscribers[s.ownerID]) == 0 {
+		delete(h.subscribers, s.ownerID)
+	}
+}
+
+// Publish は椅子の現在の状態を持ち主の購読者に配信する。
+// force でなければ椅子ごとに MinIntervalMillis に 1 回までに間引き、間引いた分は Flush で送る
+func (h *FleetHub) Publish(chair *Chair, force bool, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[chair.OwnerID]; !ok {
+		return
+	}
+	t, ok := h.chairs[chair.ID]
+	if !ok {
+		t = &fleetChairThrottle{chair: chair}
+		h.chairs[chair.ID] = t
+	}
+	if !force && now.Sub(t.sentAt) < h.interval() {
+		t.dirty = true
+		return
+	}
+	h.send(t, now)
+}
+
+func (h *FleetHub) Flush(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, t := range h.chairs {
+		if t.dirty && now.Sub(t.sentAt) >= h.interval() {
+			h.send(t, now)
+		}
+	}
+}
+
+func (h *FleetHub) interval() time.Duration {
+	return time.Duration(h.config.MinIntervalMillis) * time.Millisecond
+}
+
+func (h *FleetHub) send(t *fleetChairThrottle, now time.Time) {
+	t.sentAt = now
+	t.dirty = false
+	state := buildFleetChair(t.chair)
+	for s := range h.subscribers[t.chair.OwnerID] {
+		s.push(state)
+	}
+}
+
+func buildFleetChair(chair *Chair) ownerFleetChair {
+	state := ownerFleetChair{
+		ChairID: chair.ID,
+		Name:    chair.Name,
+		Active:  chair.IsActive,
+	}
+	if l, ok := getLatestChairLocation(chair.ID); ok {
+		state.Coordinate = &Coordinate{Latitude: l.Latitude, Longitude: l.Longitude}
+		updatedAt := l.CreatedAt.UnixMilli()
+		state.LocationUpdatedAt = &updatedAt
+	}
+	if ride, ok := getLatestRide(chair.ID); ok {
+		status, _ := getLatestRideStatus(ride.ID)
+		state.RideID = ride.ID
+		state.RideStatus = status
+	}
+	return state
+}
+
+func publishFleetLocation(chair *Chair, now time.Time) {
+	fleetHub.Publish(chair, false, now)
+}
+
+func publishFleetRideStatus(ride *Ride) {
+	if !ride.ChairID.Valid {
+		return
+	}
+	chair, ok := getChair(ride.ChairID.String)
+	if !ok {
+		return
+	}
+	fleetHub.Publish(chair, true, time.Now())
+}
+
+func startFleetFlushLoop() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	for now := range ticker.C {
+		fleetHub.Flush(now)
+	}
+}
+
+// SSE
+func ownerGetFleet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	clientGone := ctx.Done()
+	rc := http.NewResponseController(w)
+
+	// スナップショットを作る前に購読し、その間の更新を取りこぼさないようにする
+	subscriber := fleetHub.Subscribe(owner.ID)
+	defer fleetHub.Unsubscribe(subscriber)
+
+	chairs, _ := getChairsOwnerID(owner.ID)
+	snapshot := ownerFleetEvent{Type: "snapshot", Chairs: []ownerFleetChair{}}
+	for _, chair := range chairs {
+		snapshot.Chairs = append(snapshot.Chairs, buildFleetChair(chair))
+	}
+	if err := writeFleetEvent(w, rc, snapshot); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-clientGone:
+			return
+		case <-subscriber.notify:
+			if err := writeFleetEvent(w, rc, ownerFleetEvent{Type: "update", Chairs: subscriber.drain()}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func writeFleetEvent(w http.ResponseWriter, rc *http.ResponseController, event ownerFleetEvent) error {
+	resV, err := sonic.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("data: ")); err != nil {
+		return err
+	}
+	if _, err := w.Write(resV); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("\n\n")); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
@@ -22,20 +22,39 @@ type appPostPaymentMethodsRequest struct {
 }
 
 type getAppRidesResponse struct {
-	Rides []getAppRidesResponseItem `json:"rides"`
+	Rides      []getAppRidesResponseItem `json:"rides"`
+	NextCursor string                    `json:"next_cursor,omitempty"`
 }
 
 type getAppRidesResponseItem struct {
 	ID                    string                       `json:"id"`
 	PickupCoordinate      Coordinate                   `json:"pickup_coordinate"`
 	DestinationCoordinate Coordinate                   `json:"destination_coordinate"`
+	Waypoints             []Coordinate                 `json:"waypoints,omitempty"`
+	Pooled                bool                         `json:"pooled,omitempty"`
+	ChairClass            string                       `json:"chair_class,omitempty"`
 	Chair                 getAppRidesResponseItemChair `json:"chair"`
 	Fare                  int                          `json:"fare"`
 	Evaluation            int                          `json:"evaluation"`
+	Status                string                       `json:"status,omitempty"`
 	RequestedAt           int64                        `json:"requested_at"`
 	CompletedAt           int64                        `json:"completed_at"`
 }
 
+type getAppRideResponse struct {
+	getAppRidesResponseItem
+	Breakdown FareBreakdown                `json:"breakdown"`
+	Timeline  []getAppRideResponseTimeline `json:"timeline"`
+}
+
+type getAppRideResponseTimeline struct {
+	Status string `json:"status"`
+	Stop   int    `json:"stop,omitempty"`
+	// 経由地に着いたときだけ true
+	StopArrived bool  `json:"stop_arrived,omitempty"`
+	CreatedAt   int64 `json:"created_at"`
+}
+
 type getAppRidesResponseItemChair struct {
 	ID    string `json:"id"`
 	Owner string `json:"owner"`
@@ -44,13 +63,22 @@ type getAppRidesResponseItemChair struct {
 }
 
 type appPostRidesRequest struct {
-	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	PickupCoordinate      *Coordinate  `json:"pickup_coordinate"`
+	DestinationCoordinate *Coordinate  `json:"destination_coordinate"`
+	Waypoints             []Coordinate `json:"waypoints"`
+	Pooled                bool         `json:"pooled"`
+	ChairClass            string       `json:"chair_class"`
+	PreferredChairID      string       `json:"preferred_chair_id"`
+	QuoteID               string       `json:"quote_id"`
+	PickupAt              *int64       `json:"pickup_at"`
 }
 
 type appPostRidesResponse struct {
-	RideID string `json:"ride_id"`
-	Fare   int    `json:"fare"`
+	RideID    string        `json:"ride_id"`
+	Fare      int           `json:"fare"`
+	Breakdown FareBreakdown `json:"breakdown"`
+	// 予約ライドのときだけ返す。ride_id は予約の ID になる
+	PickupAt *int64 `json:"pickup_at,omitempty"`
 }
 
 type executableGet interface {
@@ -59,21 +87,83 @@ type executableGet interface {
 }
 
 type appPostRidesEstimatedFareRequest struct {
-	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	PickupCoordinate      *Coordinate  `json:"pickup_coordinate"`
+	DestinationCoordinate *Coordinate  `json:"destination_coordinate"`
+	Waypoints             []Coordinate `json:"waypoints"`
+	ChairClass            string       `json:"chair_class"`
+	PreferredChairID      string       `json:"preferred_chair_id"`
 }
 
 type appPostRidesEstimatedFareResponse struct {
-	Fare     int `json:"fare"`
-	Discount int `json:"discount"`
+	QuoteID         string        `json:"quote_id"`
+	QuoteExpiresAt  int64         `json:"quote_expires_at"`
+	Fare            int           `json:"fare"`
+	Discount        int           `json:"discount"`
+	SurgeMultiplier float64       `json:"surge_multiplier"`
+	Breakdown       FareBreakdown `json:"breakdown"`
+	PickupETA       *int64        `json:"pickup_eta,omitempty"`
+	ArrivalETA      *int64        `json:"arrival_eta,omitempty"`
+}
+
+type adminGetETAAccuracyResponse struct {
+	Pickup  adminGetETAAccuracyItem `json:"pickup"`
+	Arrival adminGetETAAccuracyItem `json:"arrival"`
+}
+
+type adminGetETAAccuracyItem struct {
+	Count              int     `json:"count"`
+	MeanAbsErrorMillis int64   `json:"mean_abs_error_ms"`
+	MeanErrorMillis    int64   `json:"mean_error_ms"`
+	MaxAbsErrorMillis  int64   `json:"max_abs_error_ms"`
+	MeanRelativeError  float64 `json:"mean_relative_error"`
 }
 
 type appPostRideEvaluationRequest struct {
-	Evaluation int `json:"evaluation"`
+	Evaluation int      `json:"evaluation"`
+	Review     string   `json:"review"`
+	Tags       []string `json:"tags"`
 }
 
 type appPostRideEvaluationResponse struct {
 	CompletedAt int64 `json:"completed_at"`
+	// レビューを書いたときだけ返す
+	ReviewID     string `json:"review_id,omitempty"`
+	ReviewStatus string `json:"review_status,omitempty"`
+}
+
+type reviewResponse struct {
+	ID          string   `json:"id"`
+	RideID      string   `json:"ride_id"`
+	ChairID     string   `json:"chair_id"`
+	Evaluation  int      `json:"evaluation"`
+	Review      string   `json:"review"`
+	Tags        []string `json:"tags"`
+	Status      string   `json:"status"`
+	Reason      string   `json:"reason,omitempty"`
+	CreatedAt   int64    `json:"created_at"`
+	ModeratedAt *int64   `json:"moderated_at,omitempty"`
+}
+
+type chairPostCoordinatesResponse struct {
+	// 送られた座標ごとの記録した時刻。送られた順に並ぶ
+	RecordedAt []int64 `json:"recorded_at"`
+}
+
+type adminGetWatchdogEventsResponse struct {
+	Events []WatchdogEvent `json:"events"`
+}
+
+type adminGetReviewsResponse struct {
+	Reviews []reviewResponse `json:"reviews"`
+}
+
+type adminPostReviewModerationRequest struct {
+	Reason string `json:"reason"`
+}
+
+type ownerGetChairReviewsResponse struct {
+	Total   int              `json:"total"`
+	Reviews []reviewResponse `json:"reviews"`
 }
 
 type appGetNotificationResponse struct {
@@ -85,13 +175,52 @@ type appGetNotificationResponseData struct {
 	RideID                string                           `json:"ride_id"`
 	PickupCoordinate      Coordinate                       `json:"pickup_coordinate"`
 	DestinationCoordinate Coordinate                       `json:"destination_coordinate"`
+	Waypoints             []Coordinate                     `json:"waypoints,omitempty"`
+	PoolStops             []PoolStop                       `json:"pool_stops,omitempty"`
 	Fare                  int                              `json:"fare"`
 	Status                string                           `json:"status"`
+	Stop                  int                              `json:"stop,omitempty"`
+	StopArrived           bool                             `json:"stop_arrived,omitempty"`
 	Chair                 *appGetNotificationResponseChair `json:"chair,omitempty"`
+	PickupETA             *int64                           `json:"pickup_eta,omitempty"`
+	ArrivalETA            *int64                           `json:"arrival_eta,omitempty"`
 	CreatedAt             int64                            `json:"created_at"`
 	UpdateAt              int64                            `json:"updated_at"`
 }
 
+type appScheduledRide struct {
+	ID                    string       `json:"id"`
+	RideID                string       `json:"ride_id,omitempty"`
+	PickupCoordinate      Coordinate   `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate   `json:"destination_coordinate"`
+	Waypoints             []Coordinate `json:"waypoints,omitempty"`
+	PickupAt              int64        `json:"pickup_at"`
+	Status                string       `json:"status"`
+	EstimatedFare         int          `json:"estimated_fare"`
+	Event                 string       `json:"event,omitempty"`
+	CreatedAt             int64        `json:"created_at"`
+}
+
+type appGetNotificationScheduledResponse struct {
+	ScheduledRide appScheduledRide `json:"scheduled_ride"`
+}
+
+type appGetScheduledRidesResponse struct {
+	ScheduledRides []appScheduledRide `json:"scheduled_rides"`
+}
+
+type appGetNotificationRefundResponse struct {
+	Refund appGetNotificationResponseRefund `json:"refund"`
+}
+
+type appGetNotificationResponseRefund struct {
+	ID     string `json:"id"`
+	RideID string `json:"ride_id"`
+	Type   string `json:"type"`
+	Amount int    `json:"amount"`
+	Fare   int    `json:"fare"`
+}
+
 type appGetNotificationResponseChair struct {
 	ID    string                               `json:"id"`
 	Name  string                               `json:"name"`
@@ -113,6 +242,7 @@ type appGetNearbyChairsResponseChair struct {
 	ID                string     `json:"id"`
 	Name              string     `json:"name"`
 	Model             string     `json:"model"`
+	Class             string     `json:"class,omitempty"`
 	CurrentCoordinate Coordinate `json:"current_coordinate"`
 }
 
@@ -146,11 +276,25 @@ type chairGetNotificationResponse struct {
 }
 
 type chairGetNotificationResponseData struct {
-	RideID                string     `json:"ride_id"`
-	User                  simpleUser `json:"user"`
-	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate Coordinate `json:"destination_coordinate"`
-	Status                string     `json:"status"`
+	RideID                string       `json:"ride_id"`
+	User                  simpleUser   `json:"user"`
+	PickupCoordinate      Coordinate   `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate   `json:"destination_coordinate"`
+	Waypoints             []Coordinate `json:"waypoints,omitempty"`
+	PoolStops             []PoolStop   `json:"pool_stops,omitempty"`
+	Status                string       `json:"status"`
+	Stop                  int          `json:"stop,omitempty"`
+	StopArrived           bool         `json:"stop_arrived,omitempty"`
+}
+
+type chairPostRideEvaluationRequest struct {
+	Evaluation int `json:"evaluation"`
+}
+
+type appGetRatingResponse struct {
+	Count     int                     `json:"count"`
+	Average   float64                 `json:"average"`
+	Histogram [maxChairEvaluation]int `json:"histogram"`
 }
 
 type postChairRidesRideIDStatusRequest struct {
@@ -183,16 +327,274 @@ type ownerGetSalesResponse struct {
 	Models     []modelSales `json:"models"`
 }
 
+type ownerSalesSeriesBucket struct {
+	Start      int64        `json:"start"`
+	End        int64        `json:"end"`
+	TotalSales int          `json:"total_sales"`
+	Chairs     []chairSales `json:"chairs"`
+	Models     []modelSales `json:"models"`
+}
+
+type ownerGetSalesSeriesResponse struct {
+	Granularity string                   `json:"granularity"`
+	Timezone    string                   `json:"timezone"`
+	Since       int64                    `json:"since"`
+	Until       int64                    `json:"until"`
+	Buckets     []ownerSalesSeriesBucket `json:"buckets"`
+}
+
 type ownerGetChairResponse struct {
 	Chairs []ownerGetChairResponseChair `json:"chairs"`
 }
 
 type ownerGetChairResponseChair struct {
-	ID                     string `json:"id"`
-	Name                   string `json:"name"`
-	Model                  string `json:"model"`
-	Active                 bool   `json:"active"`
-	RegisteredAt           int64  `json:"registered_at"`
-	TotalDistance          int    `json:"total_distance"`
-	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
+	ID                     string  `json:"id"`
+	Name                   string  `json:"name"`
+	Model                  string  `json:"model"`
+	Active                 bool    `json:"active"`
+	RegisteredAt           int64   `json:"registered_at"`
+	TotalDistance          int     `json:"total_distance"`
+	TotalDistanceUpdatedAt *int64  `json:"total_distance_updated_at,omitempty"`
+	Suspended              bool    `json:"suspended,omitempty"`
+	RetiredAt              *int64  `json:"retired_at,omitempty"`
+	ActiveSince            int64   `json:"active_since"`
+	Uptime                 int64   `json:"uptime"`
+	CarryingTime           int64   `json:"carrying_time"`
+	IdleTime               int64   `json:"idle_time"`
+	Utilization            float64 `json:"utilization"`
+	LastSeenAt             *int64  `json:"last_seen_at,omitempty"`
+}
+
+type ownerChairRide struct {
+	ID                    string     `json:"id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Fare                  int        `json:"fare"`
+	Distance              int        `json:"distance"`
+	Duration              int64      `json:"duration"`
+	Evaluation            *int       `json:"evaluation"`
+	RequestedAt           int64      `json:"requested_at"`
+	CompletedAt           int64      `json:"completed_at"`
+}
+
+type ownerChairRating struct {
+	Evaluation int `json:"evaluation"`
+	Count      int `json:"count"`
+}
+
+type ownerChairRollingAverage struct {
+	Window  int     `json:"window"`
+	Average float64 `json:"average"`
+}
+
+type ownerGetChairDetailResponse struct {
+	ID                string                   `json:"id"`
+	Name              string                   `json:"name"`
+	Model             string                   `json:"model"`
+	Active            bool                     `json:"active"`
+	RegisteredAt      int64                    `json:"registered_at"`
+	TotalRides        int                      `json:"total_rides"`
+	AverageEvaluation float64                  `json:"average_evaluation"`
+	RollingAverage    ownerChairRollingAverage `json:"rolling_average"`
+	RatingHistogram   []ownerChairRating       `json:"rating_histogram"`
+	Rides             []ownerChairRide         `json:"rides"`
+	NextOffset        *int                     `json:"next_offset,omitempty"`
+	Offers            ownerChairOffers         `json:"offers"`
+}
+
+type ownerChairOffers struct {
+	OfferStats
+	AcceptanceRate float64 `json:"acceptance_rate"`
+}
+
+type ownerFleetChair struct {
+	ChairID           string      `json:"chair_id"`
+	Name              string      `json:"name"`
+	Active            bool        `json:"active"`
+	Coordinate        *Coordinate `json:"coordinate,omitempty"`
+	LocationUpdatedAt *int64      `json:"location_updated_at,omitempty"`
+	RideID            string      `json:"ride_id,omitempty"`
+	RideStatus        string      `json:"ride_status,omitempty"`
+}
+
+type ownerFleetEvent struct {
+	Type   string            `json:"type"`
+	Chairs []ownerFleetChair `json:"chairs"`
+}
+
+type ownerChairActivityPeriod struct {
+	Active    bool   `json:"active"`
+	StartedAt int64  `json:"started_at"`
+	EndedAt   *int64 `json:"ended_at,omitempty"`
+}
+
+type ownerGetChairActivityResponse struct {
+	ChairID string                     `json:"chair_id"`
+	Periods []ownerChairActivityPeriod `json:"periods"`
+}
+
+type ownerPatchChairRequest struct {
+	Name string `json:"name"`
+}
+
+type ownerPostChairAccessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+type ownerPostChairRegisterTokenResponse struct {
+	ChairRegisterToken string `json:"chair_register_token"`
+}
+
+type ownerPostChairRegisterTicketRequest struct {
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+type ownerPostChairRegisterTicketResponse struct {
+	ChairRegisterToken string `json:"chair_register_token"`
+	ExpiresAt          int64  `json:"expires_at"`
+}
+
+type adminPostRideRefundRequest struct {
+	Type   string `json:"type"`
+	Amount int    `json:"amount"`
+	Fare   int    `json:"fare"`
+	Reason string `json:"reason"`
+}
+
+type adminRideRefund struct {
+	ID        string `json:"id"`
+	RideID    string `json:"ride_id"`
+	Type      string `json:"type"`
+	Amount    int    `json:"amount"`
+	Reason    string `json:"reason"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type adminGetRideRefundsResponse struct {
+	Fare        int               `json:"fare"`
+	ChargedFare int               `json:"charged_fare"`
+	Refunds     []adminRideRefund `json:"refunds"`
+}
+
+type adminGetSurgeResponse struct {
+	Config SurgeConfig       `json:"config"`
+	Zones  []SurgeZoneStatus `json:"zones"`
+}
+
+type adminPutSurgeOverrideRequest struct {
+	Zone       *SurgeZone `json:"zone"`
+	Multiplier float64    `json:"multiplier"`
+	// 0 なら解除するまで上書きを続ける
+	DurationSeconds int `json:"duration_seconds"`
+}
+
+type appPostCouponsRequest struct {
+	Code string `json:"code"`
+}
+
+type appCoupon struct {
+	Code         string `json:"code"`
+	Name         string `json:"name"`
+	DiscountType string `json:"discount_type"`
+	Amount       int    `json:"amount"`
+	Percent      int    `json:"percent"`
+	MinFare      int    `json:"min_fare"`
+	Stackable    bool   `json:"stackable"`
+	ExpiresAt    *int64 `json:"expires_at,omitempty"`
+	Status       string `json:"status"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+type appGetCouponsResponse struct {
+	Coupons []appCoupon `json:"coupons"`
+}
+
+type adminPostCampaignsRequest struct {
+	Code         string `json:"code"`
+	Name         string `json:"name"`
+	DiscountType string `json:"discount_type"`
+	Amount       int    `json:"amount"`
+	Percent      int    `json:"percent"`
+	MinFare      int    `json:"min_fare"`
+	MaxUses      int    `json:"max_uses"`
+	Stackable    bool   `json:"stackable"`
+	ExpiresAt    *int64 `json:"expires_at"`
+}
+
+type adminGetCampaignsResponse struct {
+	Campaigns []CouponCampaign `json:"campaigns"`
+}
+
+type appReferral struct {
+	InviteeName string `json:"invitee_name"`
+	Status      string `json:"status"`
+	Reason      string `json:"reason,omitempty"`
+	CreatedAt   int64  `json:"created_at"`
+	RewardedAt  *int64 `json:"rewarded_at,omitempty"`
+}
+
+type appGetReferralsResponse struct {
+	InvitationCode    string        `json:"invitation_code"`
+	MaxInvitations    int           `json:"max_invitations"`
+	RewardPerReferral int           `json:"reward_per_referral"`
+	Invited           int           `json:"invited"`
+	Pending           int           `json:"pending"`
+	Rewarded          int           `json:"rewarded"`
+	Rejected          int           `json:"rejected"`
+	TotalReward       int           `json:"total_reward"`
+	Referrals         []appReferral `json:"referrals"`
+}
+
+type adminGetLedgerReportResponse struct {
+	Entries          int              `json:"entries"`
+	TotalDebit       int              `json:"total_debit"`
+	TotalCredit      int              `json:"total_credit"`
+	Cash             int              `json:"cash"`
+	OwnerPayable     int              `json:"owner_payable"`
+	PlatformRevenue  int              `json:"platform_revenue"`
+	PromotionExpense int              `json:"promotion_expense"`
+	Balanced         bool             `json:"balanced"`
+	Accounts         []AccountBalance `json:"accounts"`
+	// 請求額と台帳の現金が合わないライド
+	UnreconciledRides []RideReconciliation `json:"unreconciled_rides"`
+}
+
+type ownerStatementSummary struct {
+	ID              string `json:"id"`
+	Period          string `json:"period"`
+	PeriodStart     int64  `json:"period_start"`
+	PeriodEnd       int64  `json:"period_end"`
+	Status          string `json:"status"`
+	TotalSales      int    `json:"total_sales"`
+	TotalCommission int    `json:"total_commission"`
+	TotalOwnerShare int    `json:"total_owner_share"`
+	FinalizedAt     *int64 `json:"finalized_at,omitempty"`
+	PaidAt          *int64 `json:"paid_at,omitempty"`
+}
+
+type ownerGetStatementsResponse struct {
+	Statements []ownerStatementSummary `json:"statements"`
+}
+
+type ownerStatementLine struct {
+	RideID     string `json:"ride_id"`
+	ChairID    string `json:"chair_id"`
+	Kind       string `json:"kind"`
+	Sales      int    `json:"sales"`
+	Commission int    `json:"commission"`
+	OwnerShare int    `json:"owner_share"`
+	PostedAt   int64  `json:"posted_at"`
+	Adjustment bool   `json:"adjustment"`
+}
+
+type ownerGetStatementResponse struct {
+	ownerStatementSummary
+	Chairs []StatementChair     `json:"chairs"`
+	Rides  []ownerStatementLine `json:"rides"`
+}
+
+type adminPutPayoutConfigRequest struct {
+	CommissionBasisPoints int    `json:"commission_basis_points"`
+	Period                string `json:"period"`
+	Timezone              string `json:"timezone"`
 }
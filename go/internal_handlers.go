@@ -13,12 +13,55 @@ import (
 	mcf "github.com/isucon/isucon14/webapp/go/mincostflow"
 )
 
+// mu はマッチングと椅子の割り当てを守る。他のロックと一緒に取るときは mu を先に取る。
+// scheduledRides などのロックを持ったまま mu を取ってはいけない
 var mu sync.Mutex
 
+// assignRide はライドに椅子を割り当て、利用者と椅子に通知する
+func assignRide(ride *Ride, chairID string) {
+	ride.ChairID = sql.NullString{String: chairID, Valid: true}
+	if chair, ok := getChair(chairID); ok {
+		repriceOnAssign(ride, chair)
+	}
+	createLatestRide(chairID, ride)
+	freeChairs.Remove(chairID)
+	waitingRides.Remove(ride.ID)
+	createRide(ride.ID, ride)
+	createUserRideStatus(ride.UserID, false)
+	if ride.Pooled {
+		ridePools.Start(chairID, ride)
+	}
+	rideOffers.Offer(ride.ID, chairID, time.Now())
+	notif := &Notif{
+		Ride:       ride,
+		RideStatus: "MATCHING",
+	}
+	publishChairChan(chairID, notif)
+	publishAppChan(ride.UserID, notif)
+}
+
+// unassignRide はライドを椅子から外して配車待ちに戻す。椅子の扱いは呼び出し側で決める
+func unassignRide(ride *Ride, chairID string, now time.Time) {
+	if ride.Pooled {
+		rest := ridePools.Leave(chairID, ride.ID)
+		if latest, ok := getLatestRide(chairID); ok && latest.ID == ride.ID && len(rest) > 0 {
+			createLatestRide(chairID, rest[0])
+		}
+	}
+	if latest, ok := getLatestRide(chairID); ok && latest.ID == ride.ID {
+		deleteLatestRide(chairID)
+	}
+	ride.ChairID = sql.NullString{}
+	ride.UpdatedAt = now
+	createRide(ride.ID, ride)
+	waitingRides.Add(ride)
+}
+
 func startMatchingLoop() {
 	ticker := time.NewTicker(75 * time.Millisecond)
 	for range ticker.C {
 		mu.Lock()
+		matchPooledRides()
 		if ok := internalGetMatchingOutsource(); ok {
 			mu.Unlock()
 			break
@@ -28,6 +71,7 @@ func startMatchingLoop() {
 	ticker2 := time.NewTicker(30 * time.Millisecond)
 	for range ticker2.C {
 		mu.Lock()
+		matchPooledRides()
 		internalGetMatchingGreedy()
 		mu.Unlock()
 	}
@@ -62,12 +106,20 @@ func internalGetMatchingOutsource() (isNoAgeLimit bool) {
 	rides = rides[:min]
 	matchableChair := []*pb.MatchableChair{}
 	matchableRide := []*pb.MatchableRide{}
+	localChairs := []*MatchableChair{}
 
 	for _, c := range chairs {
 		coord, ok := getLatestChairLocation(c.ID)
 		if !ok {
 			continue
 		}
+		localChairs = append(localChairs, &MatchableChair{
+			Chair:     c,
+			ID:        c.ID,
+			Speed:     c.Speed,
+			Latitude:  coord.Latitude,
+			Longitude: coord.Longitude,
+		})
 		matchableChair = append(matchableChair, &pb.MatchableChair{
 			Id:    c.ID,
 			Model: c.Model,
@@ -78,7 +130,15 @@ func internalGetMatchingOutsource() (isNoAgeLimit bool) {
 			CreatedAt: c.CreatedAt.Unix(),
 		})
 	}
+	// 外部のマッチングは椅子の指定やオーナーの設定を知らないので、
+	// どの椅子を割り当ててもよいライドだけを渡し、残りは手元で割り当てる
+	now := time.Now()
+	constrained := []*Ride{}
 	for _, r := range rides {
+		if !rideAcceptsAnyChair(r, localChairs, now) {
+			constrained = append(constrained, r)
+			continue
+		}
 		matchableRide = append(matchableRide, &pb.MatchableRide{
 			Id: r.ID,
 			Coordinate: &pb.Coordinate{
@@ -88,38 +148,59 @@ func internalGetMatchingOutsource() (isNoAgeLimit bool) {
 		})
 	}
 
-	pair, err := client.MinCostFlow(context.Background(),
-		&pb.MinCostFlowRequest{
-			Chairs: matchableChair,
-			Rides:  matchableRide,
-		},
-	)
-	if err != nil {
-		fmt.Printf("%v\n", err)
-		return
-	}
-	// match
-	for _, p := range pair.GetRideChairs() {
-		chairID := p.ChairID
-		ride, _ := getRide(p.RideID)
+	assigned := map[string]bool{}
+	if len(matchableRide) > 0 {
+		pair, err := client.MinCostFlow(context.Background(),
+			&pb.MinCostFlowRequest{
+				Chairs: matchableChair,
+				Rides:  matchableRide,
+			},
+		)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return
+		}
+		// match
+		for _, p := range pair.GetRideChairs() {
+			chairID := p.ChairID
+			ride, _ := getRide(p.RideID)
+			// 渡した後に申し出を断った椅子は次の回に回す
+			chair, ok := getChair(chairID)
+			if !ok || !matchAllowed(ride, chair, now) {
+				continue
+			}
 
-		ride.ChairID = sql.NullString{String: chairID, Valid: true}
-		createLatestRide(chairID, ride)
-		freeChairs.Remove(chairID)
-		waitingRides.Remove(ride.ID)
-		createRide(ride.ID, ride)
-		createUserRideStatus(ride.UserID, false)
-		notif := &Notif{
-			Ride:       ride,
-			RideStatus: "MATCHING",
+			assignRide(ride, chairID)
+			assigned[chairID] = true
+		}
+	}
+	if len(constrained) > 0 {
+		rest := []*MatchableChair{}
+		for _, c := range localChairs {
+			if !assigned[c.ID] {
+				rest = append(rest, c)
+			}
 		}
-		publishChairChan(chairID, notif)
-		publishAppChan(ride.UserID, notif)
+		matchRidesGreedy(rest, constrained, now)
 	}
 	return
 }
 
+// rideAcceptsAnyChair はライドにどの椅子を割り当てても条件を満たし、距離の上乗せもないかを返す
+func rideAcceptsAnyChair(ride *Ride, chairs []*MatchableChair, now time.Time) bool {
+	for _, c := range chairs {
+		if !rideAcceptsChair(ride, c.Chair, now) {
+			return false
+		}
+		if allowed, penalty := riderPenalty(ride, c.Chair); !allowed || penalty > 0 {
+			return false
+		}
+	}
+	return true
+}
+
 type MatchableChair struct {
+	Chair     *Chair
 	ID        string
 	Speed     int
 	Latitude  int
@@ -199,21 +280,10 @@ func internalGetMatchingSelf() {
 		if e.Flow() == 0 || e.From() == 0 || e.To() == n-1 {
 			continue
 		}
-		chairID := chairs[e.From()-1].ID
+		chairID := matchableChairs[e.From()-1].ID
 		ride := rides[e.To()-chairsCount-1]
 
-		ride.ChairID = sql.NullString{String: chairID, Valid: true}
-		createLatestRide(chairID, ride)
-		freeChairs.Remove(chairID)
-		waitingRides.Remove(ride.ID)
-		createRide(ride.ID, ride)
-		createUserRideStatus(ride.UserID, false)
-		notif := &Notif{
-			Ride:       ride,
-			RideStatus: "MATCHING",
-		}
-		publishChairChan(chairID, notif)
-		publishAppChan(ride.UserID, notif)
+		assignRide(ride, chairID)
 	}
 }
 
@@ -237,12 +307,18 @@ func internalGetMatchingGreedy() {
 			continue
 		}
 		matchableChairs = append(matchableChairs, &MatchableChair{
+			Chair:     c,
 			ID:        c.ID,
 			Speed:     c.Speed,
 			Latitude:  coord.Latitude,
 			Longitude: coord.Longitude,
 		})
 	}
+	matchRidesGreedy(matchableChairs, rides, time.Now())
+}
+
+// matchRidesGreedy は速い椅子から順に、割り当てられる中で一番近いライドを割り当てる
+func matchRidesGreedy(matchableChairs []*MatchableChair, rides []*Ride, now time.Time) {
 	slices.SortFunc(matchableChairs, func(a, b *MatchableChair) int {
 		if a.Speed > b.Speed {
 			return -1
@@ -254,29 +330,25 @@ func internalGetMatchingGreedy() {
 		minDistance := 1000000000
 		matchRideIdx := -1
 		for j, r := range rides {
-			if matched[j] {
+			if matched[j] || !rideAcceptsChair(r, c.Chair, now) {
 				continue
 			}
-			distance := calculateDistance(c.Latitude, c.Longitude, r.PickupLatitude, r.PickupLongitude)
+			allowed, penalty := riderPenalty(r, c.Chair)
+			if !allowed {
+				continue
+			}
+			distance := calculateDistance(c.Latitude, c.Longitude, r.PickupLatitude, r.PickupLongitude) + penalty
 			if distance < minDistance {
 				minDistance = distance
 				matchRideIdx = j
 			}
 		}
+		if matchRideIdx < 0 {
+			continue
+		}
 		matched[matchRideIdx] = true
 		chairID := c.ID
 		ride := rides[matchRideIdx]
-		ride.ChairID = sql.NullString{String: chairID, Valid: true}
-		createLatestRide(chairID, ride)
-		freeChairs.Remove(chairID)
-		waitingRides.Remove(ride.ID)
-		createRide(ride.ID, ride)
-		createUserRideStatus(ride.UserID, false)
-		notif := &Notif{
-			Ride:       ride,
-			RideStatus: "MATCHING",
-		}
-		publishChairChan(chairID, notif)
-		publishAppChan(ride.UserID, notif)
+		assignRide(ride, chairID)
 	}
 }
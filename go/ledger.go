@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const ledgerSettingName = "ledger_config"
+
+var errRideAlreadyCharged = errors.New("ride is already charged")
+
+const (
+	accountCash             = "cash"
+	accountPromotionExpense = "promotion_expense"
+	accountPlatformRevenue  = "platform_revenue"
+	accountOwnerPayable     = "owner_payable"
+)
+
+const (
+	ledgerEntryCharge = "CHARGE"
+	ledgerEntryRefund = "REFUND"
+	ledgerEntryPayout = "PAYOUT"
+)
+
+type LedgerConfig struct {
+	// 運賃(割引前)のうちプラットフォームが受け取る割合。1 = 0.01%
+	CommissionBasisPoints int `json:"commission_basis_points"`
+}
+
+func defaultLedgerConfig() LedgerConfig {
+	return LedgerConfig{
+		CommissionBasisPoints: 2000,
+	}
+}
+
+// 記帳中に読むので、入れ替えは Store で行う
+var ledgerConfig atomic.Pointer[LedgerConfig]
+
+func init() {
+	config := defaultLedgerConfig()
+	ledgerConfig.Store(&config)
+}
+
+func loadLedgerConfig(ctx context.Context) (LedgerConfig, error) {
+	config := defaultLedgerConfig()
+	if _, err := getJSONSetting(ctx, ledgerSettingName, &config); err != nil {
+		return config, err
+	}
+	if config.CommissionBasisPoints < 0 || config.CommissionBasisPoints > 10000 {
+		return config, fmt.Errorf("commission_basis_points must be between 0 and 10000")
+	}
+	return config, nil
+}
+
+func ownerPayableAccount(ownerID string) string {
+	return accountOwnerPayable + ":" + ownerID
+}
+
+type LedgerLine struct {
+	Account string `json:"account"`
+	Debit   int    `json:"debit"`
+	Credit  int    `json:"credit"`
+}
+
+type LedgerEntry struct {
+	ID      string       `json:"id"`
+	Kind    string       `json:"kind"`
+	RideID  string       `json:"ride_id,omitempty"`
+	OwnerID string       `json:"owner_id,omitempty"`
+	ChairID string       `json:"chair_id,omitempty"`
+	Lines   []LedgerLine `json:"lines"`
+	// 椅子の売上(割引前の運賃)への影響額。返金ではマイナスになる
+	Sales int `json:"sales"`
+	// 売上のうちオーナーの取り分
+	OwnerShare int       `json:"owner_share"`
+	Commission int       `json:"commission"`
+	PostedAt   time.Time `json:"posted_at"`
+}
+
+type AccountBalance struct {
+	Account string `json:"account"`
+	Debit   int    `json:"debit"`
+	Credit  int    `json:"credit"`
+	Balance int    `json:"balance"`
+}
+
+type Ledger struct {
+	entries  []*LedgerEntry
+	byChair  map[string][]*LedgerEntry
+	byOwner  map[string][]*LedgerEntry
+	byRide   map[string][]*LedgerEntry
+	balances map[string]*AccountBalance
+	// 椅子ごとの売上の時系列。記帳のたびに更新する
+	sales map[string]*ChairSalesSeries
+	mu    sync.RWMutex
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{
+		entries:  []*LedgerEntry{},
+		byChair:  map[string][]*LedgerEntry{},
+		byOwner:  map[string][]*LedgerEntry{},
+		byRide:   map[string][]*LedgerEntry{},
+		balances: map[string]*AccountBalance{},
+		sales:    map[string]*ChairSalesSeries{},
+		mu:       sync.RWMutex{},
+	}
+}
+
+func (l *Ledger) Post(entry *LedgerEntry) error {
+	debit, credit := 0, 0
+	for _, line := range entry.Lines {
+		debit += line.Debit
+		credit += line.Credit
+	}
+	if debit != credit {
+		return fmt.Errorf("unbalanced ledger entry: debit %d, credit %d", debit, credit)
+	}
+	if entry.ID == "" {
+		entry.ID = ulid.Make().String()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// 同じライドを二重に請求しない
+	if entry.Kind == ledgerEntryCharge {
+		for _, e := range l.byRide[entry.RideID] {
+			if e.Kind == ledgerEntryCharge {
+				return errRideAlreadyCharged
+			}
+		}
+	}
+	l.entries = append(l.entries, entry)
+	if entry.RideID != "" {
+		l.byRide[entry.RideID] = append(l.byRide[entry.RideID], entry)
+	}
+	if entry.ChairID != "" {
+		l.byChair[entry.ChairID] = append(l.byChair[entry.ChairID], entry)
+		if entry.Sales != 0 {
+			series, ok := l.sales[entry.ChairID]
+			if !ok {
+				series = NewChairSalesSeries()
+				l.sales[entry.ChairID] = series
+			}
+			series.Add(entry.PostedAt, entry.Sales)
+		}
+	}
+	if entry.OwnerID != "" {
+		l.byOwner[entry.OwnerID] = append(l.byOwner[entry.OwnerID], entry)
+	}
+	for _, line := range entry.Lines {
+		b, ok := l.balances[line.Account]
+		if !ok {
+			b = &AccountBalance{Account: line.Account}
+			l.balances[line.Account] = b
+		}
+		b.Debit += line.Debit
+		b.Credit += line.Credit
+		b.Balance = b.Debit - b.Credit
+	}
+	return nil
+}
+
+func (l *Ledger) ChairSales(chairID string, since, until time.Time) int {
+	series := l.ChairSalesSeries(chairID)
+	if series == nil {
+		return 0
+	}
+	return series.Sum(since, until)
+}
+
+func (l *Ledger) ChairSalesSeries(chairID string) *ChairSalesSeries {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.sales[chairID]
+}
+
+func (l *Ledger) OwnerEntries(ownerID string) []*LedgerEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return slices.Clone(l.byOwner[ownerID])
+}
+
+func (l *Ledger) Balances() []AccountBalance {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	balances := []AccountBalance{}
+	for _, b := range l.balances {
+		balances = append(balances, *b)
+	}
+	slices.SortFunc(balances, func(a, b AccountBalance) int {
+		if a.Account < b.Account {
+			return -1
+		}
+		if a.Account > b.Account {
+			return 1
+		}
+		return 0
+	})
+	return balances
+}
+
+// RideCash はライドごとの現金の増減 (請求 - 返金) を返す
+func (l *Ledger) RideCash() map[string]int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	cash := map[string]int{}
+	for rideID, entries := range l.byRide {
+		for _, e := range entries {
+			for _, line := range e.Lines {
+				if line.Account == accountCash {
+					cash[rideID] += line.Debit - line.Credit
+				}
+			}
+		}
+	}
+	return cash
+}
+
+func (l *Ledger) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.entries)
+}
+
+func splitCommission(amount int) (ownerShare, commission int) {
+	commission = amount * ledgerConfig.Load().CommissionBasisPoints / 10000
+	return amount - commission, commission
+}
+
+func chairOwnerID(chairID string) string {
+	chair, ok := chairCache.Load(chairID)
+	if !ok {
+		return ""
+	}
+	return chair.(*Chair).OwnerID
+}
+
+// postRideCharge は利用者への請求を記帳する。クーポン割引はプラットフォームが負担し、
+// オーナーには割引前の運賃から手数料を引いた額を支払う
+func postRideCharge(ride *Ride) error {
+	fare := ride.FareBreakdown
+	if fare == (FareBreakdown{}) {
+		priced := *ride
+		priceRide(&priced, 0, 1)
+		fare = priced.FareBreakdown
+	}
+	gross := fare.Gross()
+	discount := gross - ride.Fare
+	ownerID := chairOwnerID(ride.ChairID.String)
+	ownerShare, commission := splitCommission(gross)
+	lines := []LedgerLine{
+		{Account: accountCash, Debit: ride.Fare},
+		{Account: ownerPayableAccount(ownerID), Credit: ownerShare},
+		{Account: accountPlatformRevenue, Credit: commission},
+	}
+	if discount != 0 {
+		lines = append(lines, LedgerLine{Account: accountPromotionExpense, Debit: discount})
+	}
+	return ledger.Post(&LedgerEntry{
+		Kind:       ledgerEntryCharge,
+		RideID:     ride.ID,
+		OwnerID:    ownerID,
+		ChairID:    ride.ChairID.String,
+		Lines:      lines,
+		Sales:      gross,
+		OwnerShare: ownerShare,
+		Commission: commission,
+		PostedAt:   ride.UpdatedAt,
+	})
+}
+
+// postRideRefund は返金額をオーナーとプラットフォームで手数料率に応じて負担する。
+// amount が負なら追加請求として逆向きに記帳する
+func postRideRefund(ride *Ride, amount int, now time.Time) error {
+	ownerID := chairOwnerID(ride.ChairID.String)
+	ownerShare, commission := splitCommission(amount)
+	return ledger.Post(&LedgerEntry{
+		Kind:    ledgerEntryRefund,
+		RideID:  ride.ID,
+		OwnerID: ownerID,
+		ChairID: ride.ChairID.String,
+		Lines: []LedgerLine{
+			{Account: ownerPayableAccount(ownerID), Debit: ownerShare},
+			{Account: accountPlatformRevenue, Debit: commission},
+			{Account: accountCash, Credit: amount},
+		},
+		Sales:      -amount,
+		OwnerShare: -ownerShare,
+		Commission: -commission,
+		PostedAt:   now,
+	})
+}
+
+func postOwnerPayout(ownerID string, amount int, now time.Time) (*LedgerEntry, error) {
+	entry := &LedgerEntry{
+		Kind:    ledgerEntryPayout,
+		OwnerID: ownerID,
+		Lines: []LedgerLine{
+			{Account: ownerPayableAccount(ownerID), Debit: amount},
+			{Account: accountCash, Credit: amount},
+		},
+		PostedAt: now,
+	}
+	return entry, ledger.Post(entry)
+}
+
+type RideReconciliation struct {
+	RideID string `json:"ride_id"`
+	// 運賃から返金を差し引いた、利用者に請求したことになっている額
+	Charged int `json:"charged"`
+	// 台帳に記帳された現金の増減
+	Posted int `json:"posted"`
+}
+
+// reconcileRides は完了したライドの請求額と台帳の現金が合わないライドを返す
+func reconcileRides() []RideReconciliation {
+	cash := ledger.RideCash()
+	mismatches := []RideReconciliation{}
+	rideCache.Range(func(_, v any) bool {
+		ride := v.(*Ride)
+		charged := 0
+		if status, _ := getLatestRideStatus(ride.ID); status == "COMPLETED" && ride.ChairID.Valid {
+			charged = getRideChargedFare(ride)
+		}
+		if posted := cash[ride.ID]; posted != charged {
+			mismatches = append(mismatches, RideReconciliation{RideID: ride.ID, Charged: charged, Posted: posted})
+		}
+		delete(cash, ride.ID)
+		return true
+	})
+	// ライドが見つからない記帳
+	for rideID, posted := range cash {
+		if posted != 0 {
+			mismatches = append(mismatches, RideReconciliation{RideID: rideID, Posted: posted})
+		}
+	}
+	slices.SortFunc(mismatches, func(a, b RideReconciliation) int {
+		if a.RideID < b.RideID {
+			return -1
+		}
+		if a.RideID > b.RideID {
+			return 1
+		}
+		return 0
+	})
+	return mismatches
+}
@@ -28,12 +28,21 @@ var db *sqlx.DB
 var paymentGatewayURL string
 var client pb.SubServiceClient
 var benchStartedAt time.Time
+var adminAccessToken string
 
 func main() {
 	// go func() {
 	// 	standalone.Integrate(":19001")
 	// }()
 	mux := setup()
+	go startSurgeLoop()
+	go startStatementLoop()
+	go startChairActivityFlushLoop()
+	go startFleetFlushLoop()
+	go startScheduleLoop()
+	go startWatchdogLoop()
+	go startOfferLoop()
+	go startQuoteSweepLoop()
 	muxNotification := setupNotification()
 	go http.ListenAndServe(":8081", muxNotification)
 	listenAddr := net.JoinHostPort("", strconv.Itoa(8080))
@@ -46,6 +55,7 @@ func setupNotification() http.Handler {
 	mux := chi.NewRouter()
 	mux.With(appAuthMiddleware).HandleFunc("GET /api/app/notification", appGetNotification)
 	mux.With(chairAuthMiddleware).HandleFunc("GET /api/chair/notification", chairGetNotification)
+	mux.With(ownerAuthMiddleware).HandleFunc("GET /api/owner/fleet", ownerGetFleet)
 	return mux
 }
 
@@ -75,6 +85,8 @@ func setup() *fiber.App {
 		dbname = "isuride"
 	}
 
+	adminAccessToken = os.Getenv("ISUCON_ADMIN_TOKEN")
+
 	dbConfig := mysql.NewConfig()
 	dbConfig.User = user
 	dbConfig.Passwd = password
@@ -120,9 +132,16 @@ func setup() *fiber.App {
 		authedMuxApp.Get("/rides", appGetRides)
 		authedMuxApp.Post("/rides", appPostRides)
 		authedMuxApp.Post("/rides/estimated-fare", appPostRidesEstimatedFare)
+		authedMuxApp.Get("/rides/:ride_id", appGetRide)
 		authedMuxApp.Post("/rides/:ride_id/evaluation", appPostRideEvaluatation)
+		authedMuxApp.Get("/scheduled-rides", appGetScheduledRides)
+		authedMuxApp.Delete("/scheduled-rides/:ride_id", appDeleteScheduledRide)
 		// authedMuxApp.Get("/notification", appGetNotification)
 		authedMuxApp.Get("/nearby-chairs", appGetNearbyChairs)
+		authedMuxApp.Get("/coupons", appGetCoupons)
+		authedMuxApp.Post("/coupons", appPostCoupons)
+		authedMuxApp.Get("/referrals", appGetReferrals)
+		authedMuxApp.Get("/rating", appGetRating)
 	}
 
 	// owner handlers
@@ -130,7 +149,63 @@ func setup() *fiber.App {
 		authedMuxOwner := mux.Group("/api/owner")
 		authedMuxOwner.Use(ownerAuthMiddlewareFiber)
 		authedMuxOwner.Get("/sales", ownerGetSales)
+		authedMuxOwner.Get("/sales/series", ownerGetSalesSeries)
 		authedMuxOwner.Get("/chairs", ownerGetChairs)
+		authedMuxOwner.Get("/chairs/:chair_id", ownerGetChair)
+		authedMuxOwner.Patch("/chairs/:chair_id", ownerPatchChair)
+		authedMuxOwner.Delete("/chairs/:chair_id", ownerDeleteChair)
+		authedMuxOwner.Get("/chairs/:chair_id/activity", ownerGetChairActivity)
+		authedMuxOwner.Get("/chairs/:chair_id/reviews", ownerGetChairReviews)
+		authedMuxOwner.Post("/chairs/:chair_id/deactivate", ownerPostChairDeactivate)
+		authedMuxOwner.Post("/chairs/:chair_id/reactivate", ownerPostChairReactivate)
+		authedMuxOwner.Post("/chairs/:chair_id/retire", ownerPostChairRetire)
+		authedMuxOwner.Post("/chairs/:chair_id/access_token", ownerPostChairAccessToken)
+		authedMuxOwner.Post("/chair_register_token", ownerPostChairRegisterToken)
+		authedMuxOwner.Post("/chair_register_tokens", ownerPostChairRegisterTicket)
+		authedMuxOwner.Get("/statements", ownerGetStatements)
+		authedMuxOwner.Get("/statements/:statement_id", ownerGetStatement)
+		authedMuxOwner.Get("/rider-policy", ownerGetRiderPolicy)
+		authedMuxOwner.Put("/rider-policy", ownerPutRiderPolicy)
+	}
+
+	// admin handlers
+	{
+		authedMuxAdmin := mux.Group("/api/admin")
+		authedMuxAdmin.Use(adminAuthMiddlewareFiber)
+		authedMuxAdmin.Get("/rides/:ride_id/refunds", adminGetRideRefunds)
+		authedMuxAdmin.Post("/rides/:ride_id/refunds", adminPostRideRefund)
+		authedMuxAdmin.Get("/pricing", adminGetPricing)
+		authedMuxAdmin.Put("/pricing", adminPutPricing)
+		authedMuxAdmin.Get("/ledger/report", adminGetLedgerReport)
+		authedMuxAdmin.Put("/payout/config", adminPutPayoutConfig)
+		authedMuxAdmin.Post("/statements/:statement_id/finalize", adminPostStatementFinalize)
+		authedMuxAdmin.Post("/statements/:statement_id/pay", adminPostStatementPay)
+		authedMuxAdmin.Get("/campaigns", adminGetCampaigns)
+		authedMuxAdmin.Post("/campaigns", adminPostCampaigns)
+		authedMuxAdmin.Get("/surge", adminGetSurge)
+		authedMuxAdmin.Put("/surge/config", adminPutSurgeConfig)
+		authedMuxAdmin.Put("/surge/override", adminPutSurgeOverride)
+		authedMuxAdmin.Get("/fleet/config", adminGetFleetConfig)
+		authedMuxAdmin.Put("/fleet/config", adminPutFleetConfig)
+		authedMuxAdmin.Get("/schedule/config", adminGetScheduleConfig)
+		authedMuxAdmin.Put("/schedule/config", adminPutScheduleConfig)
+		authedMuxAdmin.Get("/pool/config", adminGetPoolConfig)
+		authedMuxAdmin.Put("/pool/config", adminPutPoolConfig)
+		authedMuxAdmin.Get("/eta/config", adminGetETAConfig)
+		authedMuxAdmin.Put("/eta/config", adminPutETAConfig)
+		authedMuxAdmin.Get("/eta/accuracy", adminGetETAAccuracy)
+		authedMuxAdmin.Get("/matching/config", adminGetMatchingConfig)
+		authedMuxAdmin.Put("/matching/config", adminPutMatchingConfig)
+		authedMuxAdmin.Get("/offers/config", adminGetOfferConfig)
+		authedMuxAdmin.Put("/offers/config", adminPutOfferConfig)
+		authedMuxAdmin.Get("/watchdog/config", adminGetWatchdogConfig)
+		authedMuxAdmin.Put("/watchdog/config", adminPutWatchdogConfig)
+		authedMuxAdmin.Get("/watchdog/events", adminGetWatchdogEvents)
+		authedMuxAdmin.Get("/reviews/pending", adminGetPendingReviews)
+		authedMuxAdmin.Post("/reviews/:review_id/approve", adminPostReviewApprove)
+		authedMuxAdmin.Post("/reviews/:review_id/reject", adminPostReviewReject)
+		authedMuxAdmin.Get("/reviews/moderation-config", adminGetReviewModerationConfig)
+		authedMuxAdmin.Put("/reviews/moderation-config", adminPutReviewModerationConfig)
 	}
 
 	// chair handlers
@@ -139,8 +214,10 @@ func setup() *fiber.App {
 		authedMuxChair.Use(chairAuthMiddlewareFiber)
 		authedMuxChair.Post("/activity", chairPostActivity)
 		authedMuxChair.Post("/coordinate", chairPostCoordinate)
+		authedMuxChair.Post("/coordinates", chairPostCoordinates)
 		// authedMuxChair.Get("/notification", chairGetNotification)
 		authedMuxChair.Post("/rides/:ride_id/status", chairPostRideStatus)
+		authedMuxChair.Post("/rides/:ride_id/evaluation", chairPostRideEvaluation)
 	}
 
 	return mux
@@ -175,6 +252,72 @@ func postInitialize(c *fiber.Ctx) error {
 	// }()
 	initCache()
 
+	pricingConfig, err := loadPricingConfig(ctx)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	pricing.Store(NewPricingEngine(pricingConfig))
+	surgeConfig, err := loadSurgeConfig(ctx)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	surgePricer.Reset(surgeConfig)
+	rc, err := loadReferralConfig(ctx)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	referralConfig.Store(&rc)
+	lc, err := loadLedgerConfig(ctx)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	ledgerConfig.Store(&lc)
+	pc, err := loadPayoutConfig(ctx)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	payoutConfig.Store(&pc)
+	fleetConfig, err := loadFleetConfig(ctx)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	fleetHub.Reset(fleetConfig)
+	scheduleConfig, err := loadScheduleConfig(ctx)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	scheduledRides.Reset(scheduleConfig)
+	poolConfig, err := loadPoolConfig(ctx)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	ridePools.Reset(poolConfig)
+	etaConfig, err := loadETAConfig(ctx)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	etaService.Reset(etaConfig)
+	matchConfig, err := loadMatchingConfig(ctx)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	matchingConfig.Store(&matchConfig)
+	reviewConfig, err := loadReviewModerationConfig(ctx)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	reviewStore.Reset(reviewConfig)
+	watchdogConfig, err := loadWatchdogConfig(ctx)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	rideWatchdog.Reset(watchdogConfig)
+	offerConfig, err := loadOfferConfig(ctx)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	rideOffers.Reset(offerConfig)
+
 	chairLocations := []ChairLocation{}
 	if err := db.SelectContext(ctx, &chairLocations, "SELECT * FROM chair_locations ORDER BY created_at"); err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
@@ -195,18 +338,14 @@ func postInitialize(c *fiber.Ctx) error {
 		}
 	}
 
+	// 履歴を古い順に積み、最後のものを最新の状態にする
 	rideStatuses := []RideStatus{}
-	if err := db.SelectContext(ctx, &rideStatuses, `
-		SELECT rs1.* FROM ride_statuses rs1
-		INNER JOIN (
-			SELECT ride_id, MAX(created_at) AS max_created_at
-			FROM ride_statuses
-			GROUP BY ride_id
-		) rs2 ON rs1.ride_id = rs2.ride_id AND rs1.created_at = rs2.max_created_at`); err != nil {
+	if err := db.SelectContext(ctx, &rideStatuses, "SELECT * FROM ride_statuses ORDER BY created_at, id"); err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 	for _, rs := range rideStatuses {
 		createLatestRideStatus(rs.RideID, rs.Status)
+		addRideStatusHistory(rs.RideID, rs.Status, 0, rs.CreatedAt)
 	}
 	rides := []Ride{}
 	if err := db.SelectContext(ctx, &rides, `
@@ -221,13 +360,6 @@ func postInitialize(c *fiber.Ctx) error {
 	for _, r := range rides {
 		createLatestRide(r.ChairID.String, &r)
 	}
-	rides = []Ride{}
-	if err := db.SelectContext(ctx, &rides, "SELECT * FROM rides ORDER BY updated_at"); err != nil {
-		return c.SendStatus(fiber.StatusInternalServerError)
-	}
-	for _, r := range rides {
-		createChairSale(&r)
-	}
 	users := []User{}
 	if err := db.SelectContext(ctx, &users, "SELECT * FROM users"); err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
@@ -242,9 +374,13 @@ func postInitialize(c *fiber.Ctx) error {
 	for _, c := range chairs {
 		c.Speed = getChairSpeedbyName(c.Model)
 		createChair(c.ID, &c)
+		createChairActivity(c.ID, NewChairActivity(c.IsActive, c.UpdatedAt))
 		createChairAccessToken(c.AccessToken, &c)
 		createChairsOwnerID(c.OwnerID, &c)
 	}
+	if err := loadChairActivityEvents(ctx); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
 	owners := []Owner{}
 	if err := db.SelectContext(ctx, &owners, "SELECT * FROM owners"); err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
@@ -263,29 +399,14 @@ func postInitialize(c *fiber.Ctx) error {
 		incInvCouponCount(code)
 	}
 	coupons := []Coupon{}
-	if err := db.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE used_by IS NULL ORDER BY created_at"); err != nil {
-		return c.SendStatus(fiber.StatusInternalServerError)
-	}
-	for _, c := range coupons {
-		if strings.HasPrefix(c.Code, "CP_") {
-			addUnusedCoupon(c.UserID, 3000)
-		} else if strings.HasPrefix(c.Code, "INV_") {
-			addUnusedCoupon(c.UserID, 1500)
-		} else {
-			addUnusedCoupon(c.UserID, 1000)
-		}
-	}
-	coupons = []Coupon{}
-	if err := db.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE used_by IS NOT NULL ORDER BY created_at"); err != nil {
+	if err := db.SelectContext(ctx, &coupons, "SELECT * FROM coupons ORDER BY created_at"); err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 	for _, c := range coupons {
-		if strings.HasPrefix(c.Code, "CP_") {
-			createRideDiscount(*c.UsedBy, 3000)
-		} else if strings.HasPrefix(c.Code, "INV_") {
-			createRideDiscount(*c.UsedBy, 1500)
-		} else {
-			createRideDiscount(*c.UsedBy, 1000)
+		coupon := grantCoupon(c.UserID, couponCampaignIDFromCode(c.Code), c.Code, c.CreatedAt)
+		if c.UsedBy != nil {
+			coupon.UsedBy = *c.UsedBy
+			createRideDiscount(*c.UsedBy, c.Discount)
 		}
 	}
 	users = []User{}
@@ -296,8 +417,27 @@ func postInitialize(c *fiber.Ctx) error {
 		createUser(u.ID, &u)
 		createUserInv(u.InvitationCode, &u)
 	}
+	// 既存データの招待は登録時に特典を付与済み
+	for _, c := range coupons {
+		code, ok := strings.CutPrefix(c.Code, "INV_")
+		if !ok {
+			continue
+		}
+		inviter, ok := getUserInv(code)
+		if !ok {
+			continue
+		}
+		createReferral(&Referral{
+			Code:       code,
+			InviterID:  inviter.ID,
+			InviteeID:  c.UserID,
+			Status:     referralStatusRewarded,
+			CreatedAt:  c.CreatedAt,
+			RewardedAt: &c.CreatedAt,
+		})
+	}
 	rides = []Ride{}
-	if err := db.SelectContext(ctx, &rides, "SELECT * FROM rides"); err != nil {
+	if err := db.SelectContext(ctx, &rides, "SELECT * FROM rides ORDER BY updated_at"); err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 	for _, r := range rides {
@@ -305,10 +445,14 @@ func postInitialize(c *fiber.Ctx) error {
 		if amount, ok := getRideDiscount(r.ID); ok {
 			discount = amount
 		}
-		meteredFare := farePerDistance * calculateDistance(r.PickupLatitude, r.PickupLongitude, r.DestinationLatitude, r.DestinationLongitude)
-		discountedMeteredFare := max(meteredFare-discount, 0)
-		r.Fare = initialFare + discountedMeteredFare
+		priceRide(&r, discount, 1)
 		createRide(r.ID, &r)
+		if status, _ := getLatestRideStatus(r.ID); status == "COMPLETED" && r.ChairID.Valid {
+			if err := postRideCharge(&r); err != nil {
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			recordChairRide(&r, r.UpdatedAt)
+		}
 	}
 	if err := db.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
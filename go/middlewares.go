@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -51,6 +53,7 @@ func chairAuthMiddlewareFiber(c *fiber.Ctx) error {
 	if !ok {
 		return fiber.NewError(http.StatusUnauthorized, "invalid access token")
 	}
+	getChairActivity(chair).Seen(time.Now())
 
 	// ctx = context.WithValue(ctx, "chair", chair)
 	ctx.SetUserValue("chair", chair)
@@ -58,6 +61,18 @@ func chairAuthMiddlewareFiber(c *fiber.Ctx) error {
 	return c.Next()
 }
 
+func adminAuthMiddlewareFiber(c *fiber.Ctx) error {
+	accessToken := c.Cookies("admin_session")
+	if accessToken == "" {
+		return fiber.NewError(http.StatusUnauthorized, "admin_session cookie is required")
+	}
+	// 比較にかかる時間からトークンを推測されないようにする
+	if adminAccessToken == "" || subtle.ConstantTimeCompare([]byte(accessToken), []byte(adminAccessToken)) != 1 {
+		return fiber.NewError(http.StatusUnauthorized, "invalid access token")
+	}
+	return c.Next()
+}
+
 func appAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -15,6 +15,16 @@ type Chair struct {
 	CreatedAt   time.Time `db:"created_at"`
 	UpdatedAt   time.Time `db:"updated_at"`
 	Speed       int       `db:"_"`
+	// オーナーが止めている間は椅子から稼働を再開できない
+	Suspended bool       `db:"-"`
+	RetiredAt *time.Time `db:"-"`
+}
+
+type ChairActivityEvent struct {
+	ID        string    `db:"id"`
+	ChairID   string    `db:"chair_id"`
+	IsActive  bool      `db:"is_active"`
+	CreatedAt time.Time `db:"created_at"`
 }
 
 type ChairModel struct {
@@ -60,6 +70,17 @@ type Ride struct {
 	CreatedAt            time.Time      `db:"created_at"`
 	UpdatedAt            time.Time      `db:"updated_at"`
 	Fare                 int            `db:"_"`
+	FareBreakdown        FareBreakdown  `db:"-"`
+	// 乗車地と目的地の間に立ち寄る経由地。WaypointsReached は到着済みの数
+	Waypoints        []Coordinate `db:"-"`
+	WaypointsReached int          `db:"-"`
+	// 相乗りを受け入れるライド
+	Pooled bool `db:"-"`
+	// 利用者が指定した椅子のクラスと指名した椅子。配車の条件になる
+	ChairClass       string `db:"-"`
+	PreferredChairID string `db:"-"`
+	// 椅子が利用者につけた評価
+	RiderEvaluation *int `db:"-"`
 }
 
 type RideStatus struct {
@@ -87,3 +108,13 @@ type Coupon struct {
 	CreatedAt time.Time `db:"created_at"`
 	UsedBy    *string   `db:"used_by"`
 }
+
+type RideRefund struct {
+	ID             string
+	RideID         string
+	Type           string
+	Amount         int
+	Reason         string
+	IdempotencyKey string
+	CreatedAt      time.Time
+}
@@ -24,10 +24,25 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 		case <-clientGone:
 			return
 		case notif := <-appChan:
+			if notif.Scheduled != nil {
+				if err := writeScheduledRideNotification(w, rc, notif); err != nil {
+					return
+				}
+				continue
+			}
+			// 返金はライドの状態とは別の通知として送る
+			if notif.Refund != nil {
+				if err := writeRefundNotification(w, rc, notif); err != nil {
+					return
+				}
+				continue
+			}
 			response, err := getAppNotification(user, notif.Ride, notif.RideStatus)
 			if err != nil {
 				return
 			}
+			response.Data.Stop = notif.Stop
+			response.Data.StopArrived = notif.Stop > 0
 			resV, err := sonic.Marshal(response.Data)
 			if err != nil {
 				return
@@ -44,13 +59,57 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 			if err := rc.Flush(); err != nil {
 				return
 			}
-			if notif.RideStatus == "COMPLETED" {
-				deleteLatestRide(notif.Ride.ChairID.String)
+			if notif.RideStatus == "COMPLETED" && !ridePools.Busy(notif.Ride.ChairID.String) {
+				releaseLatestRide(notif.Ride.ChairID.String, notif.Ride)
 			}
 		}
 	}
 }
 
+func writeScheduledRideNotification(w http.ResponseWriter, rc *http.ResponseController, notif *Notif) error {
+	resV, err := sonic.Marshal(appGetNotificationScheduledResponse{
+		ScheduledRide: toAppScheduledRide(notif.Scheduled, notif.ScheduleEvent),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("data: ")); err != nil {
+		return err
+	}
+	if _, err := w.Write(resV); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("\n\n")); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+func writeRefundNotification(w http.ResponseWriter, rc *http.ResponseController, notif *Notif) error {
+	resV, err := sonic.Marshal(appGetNotificationRefundResponse{
+		Refund: appGetNotificationResponseRefund{
+			ID:     notif.Refund.ID,
+			RideID: notif.Refund.RideID,
+			Type:   notif.Refund.Type,
+			Amount: notif.Refund.Amount,
+			Fare:   getRideChargedFare(notif.Ride),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("data: ")); err != nil {
+		return err
+	}
+	if _, err := w.Write(resV); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("\n\n")); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
 // SSE
 func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -64,16 +123,28 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	clientGone := ctx.Done()
 	rc := http.NewResponseController(w)
 
+	// chair.AccessToken は再発行で書き換わるので、トークンの確認は chairAccessToken を見る
+	accessToken := ""
+	if c, err := r.Cookie("chair_session"); err == nil {
+		accessToken = c.Value
+	}
 	chairChan := getChairChan(chair.ID)
 	for {
 		select {
 		case <-clientGone:
 			return
 		case notif := <-chairChan:
+			// アクセストークンが再発行されたら古い端末への配信をやめ、通知は新しい端末に回す
+			if current, ok := getChairAccessToken(accessToken); !ok || current.ID != chair.ID {
+				go publishChairChan(chair.ID, notif)
+				return
+			}
 			response, err := getChairNotification(notif.Ride, notif.RideStatus)
 			if err != nil {
 				return
 			}
+			response.Data.Stop = notif.Stop
+			response.Data.StopArrived = notif.Stop > 0
 			resV, err := sonic.Marshal(response.Data)
 			if err != nil {
 				return
@@ -94,8 +165,15 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 				go func() {
 					// evaluationの完了待ち
 					time.Sleep(30 * time.Millisecond)
-					freeChairs.Add(chair)
-					deleteLatestRide(chair.ID)
+					// 相乗りのライドがまだ残っていれば椅子は空けない
+					if ridePools.Busy(chair.ID) {
+						return
+					}
+					// 自動完了で先に空けた椅子に次のライドが割り当てられていたら触らない
+					releaseLatestRide(chair.ID, notif.Ride)
+					if chairDispatchable(chair) && !chairOnRide(chair.ID) {
+						freeChairs.Add(chair)
+					}
 				}()
 			}
 		}
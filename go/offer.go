@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const offerSettingName = "offer_config"
+
+type OfferConfig struct {
+	// 椅子がこの秒数のうちに受けるか断るかしなければ、申し出を取り下げる。0 なら取り下げない
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+func defaultOfferConfig() OfferConfig {
+	return OfferConfig{
+		TimeoutSeconds: 30,
+	}
+}
+
+func validateOfferConfig(config OfferConfig) error {
+	if config.TimeoutSeconds < 0 {
+		return errors.New("timeout_seconds must not be negative")
+	}
+	return nil
+}
+
+func loadOfferConfig(ctx context.Context) (OfferConfig, error) {
+	config := defaultOfferConfig()
+	found, err := getJSONSetting(ctx, offerSettingName, &config)
+	if err != nil || !found {
+		return config, err
+	}
+	return config, validateOfferConfig(config)
+}
+
+type rideOffer struct {
+	rideID    string
+	chairID   string
+	offeredAt time.Time
+}
+
+type OfferStats struct {
+	Offered  int `json:"offered"`
+	Accepted int `json:"accepted"`
+	Declined int `json:"declined"`
+	TimedOut int `json:"timed_out"`
+}
+
+// AcceptanceRate は結果の出た申し出のうち受けたものの割合
+func (s OfferStats) AcceptanceRate() float64 {
+	answered := s.Accepted + s.Declined + s.TimedOut
+	if answered == 0 {
+		return 0
+	}
+	return float64(s.Accepted) / float64(answered)
+}
+
+// RideOffers は椅子に申し出たライドの返事を待ち、断られた椅子をライドごとに覚えておく
+type RideOffers struct {
+	config   OfferConfig
+	pending  map[string]*rideOffer
+	excluded map[string]map[string]struct{}
+	stats    map[string]*OfferStats
+	mu       sync.Mutex
+}
+
+func NewRideOffers(config OfferConfig) *RideOffers {
+	return &RideOffers{
+		config:   config,
+		pending:  map[string]*rideOffer{},
+		excluded: map[string]map[string]struct{}{},
+		stats:    map[string]*OfferStats{},
+		mu:       sync.Mutex{},
+	}
+}
+
+var rideOffers = NewRideOffers(defaultOfferConfig())
+
+// Reset は申し出と集計をすべて捨てて設定を入れ替える
+func (o *RideOffers) Reset(config OfferConfig) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.config = config
+	o.pending = map[string]*rideOffer{}
+	o.excluded = map[string]map[string]struct{}{}
+	o.stats = map[string]*OfferStats{}
+}
+
+func (o *RideOffers) Config() OfferConfig {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.config
+}
+
+func (o *RideOffers) SetConfig(config OfferConfig) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.config = config
+}
+
+func (o *RideOffers) statsOf(chairID string) *OfferStats {
+	s, ok := o.stats[chairID]
+	if !ok {
+		s = &OfferStats{}
+		o.stats[chairID] = s
+	}
+	return s
+}
+
+func (o *RideOffers) Offer(rideID, chairID string, now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending[rideID] = &rideOffer{rideID: rideID, chairID: chairID, offeredAt: now}
+	o.statsOf(chairID).Offered++
+}
+
+// take は返事を待っている申し出を取り出す。受ける・断る・時間切れのうち先に来たものだけが取り出せる
+func (o *RideOffers) take(rideID, chairID string) bool {
+	offer, ok := o.pending[rideID]
+	if !ok || offer.chairID != chairID {
+		return false
+	}
+	delete(o.pending, rideID)
+	return true
+}
+
+func (o *RideOffers) exclude(rideID, chairID string) {
+	chairs, ok := o.excluded[rideID]
+	if !ok {
+		chairs = map[string]struct{}{}
+		o.excluded[rideID] = chairs
+	}
+	chairs[chairID] = struct{}{}
+}
+
+func (o *RideOffers) Accept(rideID, chairID string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.take(rideID, chairID) {
+		return false
+	}
+	o.statsOf(chairID).Accepted++
+	return true
+}
+
+func (o *RideOffers) Decline(rideID, chairID string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.take(rideID, chairID) {
+		return false
+	}
+	o.statsOf(chairID).Declined++
+	o.exclude(rideID, chairID)
+	return true
+}
+
+// Expire は時間切れになった申し出を取り出す
+func (o *RideOffers) Expire(now time.Time) []rideOffer {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	expired := []rideOffer{}
+	if o.config.TimeoutSeconds == 0 {
+		return expired
+	}
+	timeout := time.Duration(o.config.TimeoutSeconds) * time.Second
+	for rideID, offer := range o.pending {
+		if now.Before(offer.offeredAt.Add(timeout)) {
+			continue
+		}
+		delete(o.pending, rideID)
+		o.statsOf(offer.chairID).TimedOut++
+		o.exclude(rideID, offer.chairID)
+		expired = append(expired, *offer)
+	}
+	return expired
+}
+
+// Excluded は椅子がライドの申し出を断ったか、返事をしなかったかを返す
+func (o *RideOffers) Excluded(rideID, chairID string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, ok := o.excluded[rideID][chairID]
+	return ok
+}
+
+// Forget は終わったライドの申し出の記録を消す
+func (o *RideOffers) Forget(rideID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.pending, rideID)
+	delete(o.excluded, rideID)
+}
+
+func (o *RideOffers) Stats(chairID string) OfferStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if s, ok := o.stats[chairID]; ok {
+		return *s
+	}
+	return OfferStats{}
+}
+
+// withdrawOffer は断られた・時間切れになった申し出のライドを椅子から外して配車待ちに戻す。
+// 断った椅子は空き椅子に戻し、返事をしなかった椅子は稼働を再開するまで配車しない
+func withdrawOffer(ride *Ride, chairID string, respond bool, now time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	if ride.ChairID.String != chairID {
+		return
+	}
+	if status, _ := getLatestRideStatus(ride.ID); status != "MATCHING" {
+		return
+	}
+	unassignRide(ride, chairID, now)
+	if chair, ok := getChair(chairID); ok {
+		if !respond {
+			setChairActive(chair, false, now)
+			freeChairs.Remove(chairID)
+		} else if chair.IsActive && chairDispatchable(chair) && !chairOnRide(chairID) && !scheduledRides.IsReserved(chairID) {
+			freeChairs.Add(chair)
+		}
+	}
+	processRideStatus(ride, "MATCHING")
+}
+
+func declineOffer(ride *Ride, chairID string, now time.Time) bool {
+	if !rideOffers.Decline(ride.ID, chairID) {
+		return false
+	}
+	withdrawOffer(ride, chairID, true, now)
+	return true
+}
+
+func startOfferLoop() {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	for now := range ticker.C {
+		for _, offer := range rideOffers.Expire(now) {
+			ride, ok := getRide(offer.rideID)
+			if !ok {
+				continue
+			}
+			go withdrawOffer(ride, offer.chairID, false, now)
+		}
+	}
+}
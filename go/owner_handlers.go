@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -76,22 +79,7 @@ func ownerGetSales(c *fiber.Ctx) error {
 		if _, ok := modelSalesByModel[chair.Model]; !ok {
 			modelSalesByModel[chair.Model] = 0
 		}
-		sales, ok := getChairSale(chair.ID)
-		if !ok {
-			res.Chairs = append(res.Chairs, chairSales{
-				ID:    chair.ID,
-				Name:  chair.Name,
-				Sales: 0,
-			})
-			continue
-		}
-		sumSales := 0
-		for _, sale := range sales {
-			if sale.UpdatedAt.Before(since) || sale.UpdatedAt.After(until.Add(999*time.Microsecond)) {
-				continue
-			}
-			sumSales += sale.Sale
-		}
+		sumSales := ledger.ChairSales(chair.ID, since, until.Add(999*time.Microsecond))
 		res.Chairs = append(res.Chairs, chairSales{
 			ID:    chair.ID,
 			Name:  chair.Name,
@@ -101,14 +89,101 @@ func ownerGetSales(c *fiber.Ctx) error {
 		modelSalesByModel[chair.Model] += sumSales
 	}
 
+	res.Models = toModelSales(modelSalesByModel)
+	return c.Status(http.StatusOK).JSON(res)
+}
+
+func toModelSales(salesByModel map[string]int) []modelSales {
 	models := []modelSales{}
-	for model, sales := range modelSalesByModel {
+	for model, sales := range salesByModel {
 		models = append(models, modelSales{
 			Model: model,
 			Sales: sales,
 		})
 	}
-	res.Models = models
+	slices.SortFunc(models, func(a, b modelSales) int {
+		return strings.Compare(a.Model, b.Model)
+	})
+	return models
+}
+
+func ownerGetSalesSeries(c *fiber.Ctx) error {
+	granularity := c.Query("granularity", salesGranularityDay)
+	timezone := c.Query("tz", "UTC")
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, "invalid tz")
+	}
+
+	until := time.Now()
+	if c.Query("until") != "" {
+		parsed, err := strconv.ParseInt(c.Query("until"), 10, 64)
+		if err != nil {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+		until = time.UnixMilli(parsed)
+	}
+	var since time.Time
+	switch granularity {
+	case salesGranularityHour:
+		since = until.Add(-24 * time.Hour)
+	case salesGranularityDay:
+		since = until.AddDate(0, 0, -30)
+	case salesGranularityWeek:
+		since = until.AddDate(0, 0, -7*12)
+	}
+	if c.Query("since") != "" {
+		parsed, err := strconv.ParseInt(c.Query("since"), 10, 64)
+		if err != nil {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+		since = time.UnixMilli(parsed)
+	}
+	if until.Before(since) {
+		return fiber.NewError(http.StatusBadRequest, "until must not be before since")
+	}
+
+	owner := c.Context().UserValue("owner").(*Owner)
+	chairs, _ := getChairsOwnerID(owner.ID)
+	buckets, err := buildSalesSeries(chairs, granularity, location, since, until)
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	if c.Query("format") == "csv" {
+		b, err := salesSeriesCSV(chairs, buckets)
+		if err != nil {
+			return fiber.NewError(http.StatusInternalServerError, err.Error())
+		}
+		c.Set("Content-Disposition", `attachment; filename="sales.csv"`)
+		c.Response().Header.SetContentType("text/csv;charset=utf-8")
+		return c.Status(http.StatusOK).Send(b)
+	}
+
+	res := ownerGetSalesSeriesResponse{
+		Granularity: granularity,
+		Timezone:    location.String(),
+		Since:       since.UnixMilli(),
+		Until:       until.UnixMilli(),
+		Buckets:     []ownerSalesSeriesBucket{},
+	}
+	for _, b := range buckets {
+		bucket := ownerSalesSeriesBucket{
+			Start:      b.Start.UnixMilli(),
+			End:        b.End.UnixMilli(),
+			TotalSales: b.Total,
+			Chairs:     []chairSales{},
+			Models:     toModelSales(b.Models),
+		}
+		for _, chair := range chairs {
+			bucket.Chairs = append(bucket.Chairs, chairSales{
+				ID:    chair.ID,
+				Name:  chair.Name,
+				Sales: b.Chairs[chair.ID],
+			})
+		}
+		res.Buckets = append(res.Buckets, bucket)
+	}
 	return c.Status(http.StatusOK).JSON(res)
 }
 
@@ -117,15 +192,31 @@ func ownerGetChairs(c *fiber.Ctx) error {
 	owner := ctx.UserValue("owner").(*Owner)
 
 	chairs, _ := getChairsOwnerID(owner.ID)
+	now := time.Now()
 	res := ownerGetChairResponse{}
 	for _, chair := range chairs {
 		current, ok := getChairTotalDistance(chair.ID)
+		activity := getChairActivity(chair).Status(now)
 		c := ownerGetChairResponseChair{
 			ID:           chair.ID,
 			Name:         chair.Name,
 			Model:        chair.Model,
-			Active:       chair.IsActive, // 初回以降更新してないのになぜか通る
+			Active:       activity.Active,
 			RegisteredAt: chair.CreatedAt.UnixMilli(),
+			Suspended:    chair.Suspended,
+			ActiveSince:  activity.ActiveSince.UnixMilli(),
+			Uptime:       activity.Uptime.Milliseconds(),
+			CarryingTime: activity.CarryingTime.Milliseconds(),
+			IdleTime:     activity.IdleTime.Milliseconds(),
+			Utilization:  activity.Utilization,
+		}
+		if activity.LastSeenAt != nil {
+			lastSeenAt := activity.LastSeenAt.UnixMilli()
+			c.LastSeenAt = &lastSeenAt
+		}
+		if chair.RetiredAt != nil {
+			retiredAt := chair.RetiredAt.UnixMilli()
+			c.RetiredAt = &retiredAt
 		}
 		if ok {
 			temp := current.UpdatedAt.UnixMilli()
@@ -136,3 +227,341 @@ func ownerGetChairs(c *fiber.Ctx) error {
 	}
 	return c.Status(http.StatusOK).JSON(res)
 }
+
+func ownerGetChair(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+	chair, err := getOwnedChair(owner, c.Params("chair_id"))
+	if err != nil {
+		return chairManagementError(err)
+	}
+	limit, err := queryInt(c, "limit", defaultChairHistoryLimit)
+	if err != nil || limit <= 0 || limit > maxChairHistoryLimit {
+		return fiber.NewError(http.StatusBadRequest, "limit is invalid")
+	}
+	offset, err := queryInt(c, "offset", 0)
+	if err != nil || offset < 0 {
+		return fiber.NewError(http.StatusBadRequest, "offset is invalid")
+	}
+	window, err := queryInt(c, "window", defaultChairRatingWindow)
+	if err != nil || window <= 0 {
+		return fiber.NewError(http.StatusBadRequest, "window is invalid")
+	}
+
+	history := getChairRideHistory(chair.ID)
+	total := history.Count()
+	res := ownerGetChairDetailResponse{
+		ID:                chair.ID,
+		Name:              chair.Name,
+		Model:             chair.Model,
+		Active:            getChairActivity(chair).Status(time.Now()).Active,
+		RegisteredAt:      chair.CreatedAt.UnixMilli(),
+		TotalRides:        total,
+		AverageEvaluation: history.Average(0),
+		RollingAverage: ownerChairRollingAverage{
+			Window:  min(window, history.Rated()),
+			Average: history.Average(window),
+		},
+		RatingHistogram: []ownerChairRating{},
+		Rides:           []ownerChairRide{},
+	}
+	offers := rideOffers.Stats(chair.ID)
+	res.Offers = ownerChairOffers{OfferStats: offers, AcceptanceRate: offers.AcceptanceRate()}
+	for i, count := range history.Histogram() {
+		res.RatingHistogram = append(res.RatingHistogram, ownerChairRating{
+			Evaluation: i + 1,
+			Count:      count,
+		})
+	}
+	for _, r := range history.Page(offset, limit) {
+		res.Rides = append(res.Rides, ownerChairRide{
+			ID:                    r.RideID,
+			PickupCoordinate:      r.Pickup,
+			DestinationCoordinate: r.Destination,
+			Fare:                  r.Fare,
+			Distance:              r.Distance,
+			Duration:              r.Duration.Milliseconds(),
+			Evaluation:            r.Evaluation,
+			RequestedAt:           r.RequestedAt.UnixMilli(),
+			CompletedAt:           r.CompletedAt.UnixMilli(),
+		})
+	}
+	if next := offset + len(res.Rides); next < total {
+		res.NextOffset = &next
+	}
+	return c.Status(http.StatusOK).JSON(res)
+}
+
+// ownerGetChairReviews は椅子に寄せられたレビューのうち公開済みのものを新しい順に返す
+func ownerGetChairReviews(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+	chair, err := getOwnedChair(owner, c.Params("chair_id"))
+	if err != nil {
+		return chairManagementError(err)
+	}
+	limit, err := queryInt(c, "limit", defaultChairHistoryLimit)
+	if err != nil || limit <= 0 || limit > maxChairHistoryLimit {
+		return fiber.NewError(http.StatusBadRequest, "limit is invalid")
+	}
+	offset, err := queryInt(c, "offset", 0)
+	if err != nil || offset < 0 {
+		return fiber.NewError(http.StatusBadRequest, "offset is invalid")
+	}
+
+	reviews, total := reviewStore.ChairReviews(chair.ID, offset, limit)
+	res := ownerGetChairReviewsResponse{Total: total, Reviews: []reviewResponse{}}
+	for _, r := range reviews {
+		item := toReviewResponse(r)
+		// 却下・保留の理由はオーナーには見せない
+		item.Reason = ""
+		res.Reviews = append(res.Reviews, item)
+	}
+	return c.Status(http.StatusOK).JSON(res)
+}
+
+func queryInt(c *fiber.Ctx, key string, defaultValue int) (int, error) {
+	if c.Query(key) == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(c.Query(key))
+}
+
+func ownerGetChairActivity(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+	chair, err := getOwnedChair(owner, c.Params("chair_id"))
+	if err != nil {
+		return chairManagementError(err)
+	}
+	res := ownerGetChairActivityResponse{
+		ChairID: chair.ID,
+		Periods: []ownerChairActivityPeriod{},
+	}
+	for _, p := range getChairActivity(chair).Periods() {
+		period := ownerChairActivityPeriod{
+			Active:    p.Active,
+			StartedAt: p.StartedAt.UnixMilli(),
+		}
+		if p.EndedAt != nil {
+			endedAt := p.EndedAt.UnixMilli()
+			period.EndedAt = &endedAt
+		}
+		res.Periods = append(res.Periods, period)
+	}
+	return c.Status(http.StatusOK).JSON(res)
+}
+
+func chairManagementError(err error) error {
+	switch {
+	case errors.Is(err, errChairNotFound):
+		return fiber.NewError(http.StatusNotFound, err.Error())
+	case errors.Is(err, errChairOnRide), errors.Is(err, errChairHasHistory), errors.Is(err, errChairRetired):
+		return fiber.NewError(http.StatusConflict, err.Error())
+	}
+	return fiber.NewError(http.StatusInternalServerError, err.Error())
+}
+
+func ownerPatchChair(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+	chair, err := getOwnedChair(owner, c.Params("chair_id"))
+	if err != nil {
+		return chairManagementError(err)
+	}
+	req := &ownerPatchChairRequest{}
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if req.Name == "" {
+		return fiber.NewError(http.StatusBadRequest, "some of required fields(name) are empty")
+	}
+	renameChair(chair, req.Name, time.Now())
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func ownerDeleteChair(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+	chair, err := getOwnedChair(owner, c.Params("chair_id"))
+	if err != nil {
+		return chairManagementError(err)
+	}
+	if err := removeChair(chair); err != nil {
+		return chairManagementError(err)
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func ownerPostChairDeactivate(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+	chair, err := getOwnedChair(owner, c.Params("chair_id"))
+	if err != nil {
+		return chairManagementError(err)
+	}
+	suspendChair(chair, time.Now())
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func ownerPostChairReactivate(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+	chair, err := getOwnedChair(owner, c.Params("chair_id"))
+	if err != nil {
+		return chairManagementError(err)
+	}
+	if err := resumeChair(chair, time.Now()); err != nil {
+		return chairManagementError(err)
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func ownerPostChairRetire(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+	chair, err := getOwnedChair(owner, c.Params("chair_id"))
+	if err != nil {
+		return chairManagementError(err)
+	}
+	if err := retireChair(chair, time.Now()); err != nil {
+		return chairManagementError(err)
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func ownerPostChairAccessToken(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+	chair, err := getOwnedChair(owner, c.Params("chair_id"))
+	if err != nil {
+		return chairManagementError(err)
+	}
+	token, err := reissueChairAccessToken(chair, time.Now())
+	if err != nil {
+		return chairManagementError(err)
+	}
+	return c.Status(http.StatusOK).JSON(&ownerPostChairAccessTokenResponse{
+		AccessToken: token,
+	})
+}
+
+func ownerPostChairRegisterToken(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+	token := rotateChairRegisterToken(owner, time.Now())
+	return c.Status(http.StatusOK).JSON(&ownerPostChairRegisterTokenResponse{
+		ChairRegisterToken: token,
+	})
+}
+
+func ownerPostChairRegisterTicket(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+	req := &ownerPostChairRegisterTicketRequest{}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(req); err != nil {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+	}
+	ttl := defaultChairRegisterTicketTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > maxChairRegisterTicketTTL {
+		return fiber.NewError(http.StatusBadRequest, "ttl_seconds is out of range")
+	}
+	ticket := issueChairRegisterTicket(owner, ttl, time.Now())
+	return c.Status(http.StatusCreated).JSON(&ownerPostChairRegisterTicketResponse{
+		ChairRegisterToken: ticket.Token,
+		ExpiresAt:          ticket.ExpiresAt.UnixMilli(),
+	})
+}
+
+func ownerGetStatements(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+
+	statements := listStatements(owner.ID)
+	if c.Query("format") == "csv" {
+		b, err := statementsCSV(statements)
+		if err != nil {
+			return fiber.NewError(http.StatusInternalServerError, err.Error())
+		}
+		c.Set("Content-Disposition", `attachment; filename="statements.csv"`)
+		c.Response().Header.SetContentType("text/csv;charset=utf-8")
+		return c.Status(http.StatusOK).Send(b)
+	}
+
+	res := ownerGetStatementsResponse{Statements: []ownerStatementSummary{}}
+	for _, s := range statements {
+		res.Statements = append(res.Statements, toOwnerStatementSummary(&s))
+	}
+	return c.Status(http.StatusOK).JSON(res)
+}
+
+func ownerGetStatement(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+
+	statement, ok := getOwnerStatement(owner.ID, c.Params("statement_id"))
+	if !ok {
+		return fiber.NewError(http.StatusNotFound, "statement not found")
+	}
+	if c.Query("format") == "csv" {
+		b, err := statementCSV(statement)
+		if err != nil {
+			return fiber.NewError(http.StatusInternalServerError, err.Error())
+		}
+		c.Set("Content-Disposition", `attachment; filename="statement-`+statement.ID+`.csv"`)
+		c.Response().Header.SetContentType("text/csv;charset=utf-8")
+		return c.Status(http.StatusOK).Send(b)
+	}
+
+	res := ownerGetStatementResponse{
+		ownerStatementSummary: toOwnerStatementSummary(&statement),
+		Chairs:                statement.Chairs,
+		Rides:                 []ownerStatementLine{},
+	}
+	for _, l := range statement.Lines {
+		res.Rides = append(res.Rides, ownerStatementLine{
+			RideID:     l.RideID,
+			ChairID:    l.ChairID,
+			Kind:       l.Kind,
+			Sales:      l.Sales,
+			Commission: l.Commission,
+			OwnerShare: l.OwnerShare,
+			PostedAt:   l.PostedAt.UnixMilli(),
+			Adjustment: l.Adjustment,
+		})
+	}
+	return c.Status(http.StatusOK).JSON(res)
+}
+
+func toOwnerStatementSummary(s *Statement) ownerStatementSummary {
+	res := ownerStatementSummary{
+		ID:              s.ID,
+		Period:          s.Period,
+		PeriodStart:     s.PeriodStart.UnixMilli(),
+		PeriodEnd:       s.PeriodEnd.UnixMilli(),
+		Status:          s.Status,
+		TotalSales:      s.TotalSales,
+		TotalCommission: s.TotalCommission,
+		TotalOwnerShare: s.TotalOwnerShare,
+	}
+	if s.FinalizedAt != nil {
+		finalizedAt := s.FinalizedAt.UnixMilli()
+		res.FinalizedAt = &finalizedAt
+	}
+	if s.PaidAt != nil {
+		paidAt := s.PaidAt.UnixMilli()
+		res.PaidAt = &paidAt
+	}
+	return res
+}
+
+func ownerGetRiderPolicy(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+	return c.Status(http.StatusOK).JSON(getOwnerRiderPolicy(owner.ID))
+}
+
+// ownerPutRiderPolicy は評価の低い利用者を自分の椅子に割り当てないか、後回しにするかを設定する
+func ownerPutRiderPolicy(c *fiber.Ctx) error {
+	owner := c.Context().UserValue("owner").(*Owner)
+	policy := RiderPolicy{}
+	if err := c.BodyParser(&policy); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateRiderPolicy(policy); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	setOwnerRiderPolicy(owner.ID, policy)
+	return c.Status(http.StatusOK).JSON(policy)
+}
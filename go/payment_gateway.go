@@ -16,6 +16,10 @@ type paymentGatewayPostPaymentRequest struct {
 	Amount int `json:"amount"`
 }
 
+type paymentGatewayPostRefundRequest struct {
+	Amount int `json:"amount"`
+}
+
 type paymentGatewayGetPaymentsResponseOne struct {
 	Amount int    `json:"amount"`
 	Status string `json:"status"`
@@ -26,17 +30,29 @@ func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL str
 	if err != nil {
 		return err
 	}
+	return requestPaymentGatewayPost(ctx, paymentGatewayURL+"/payments", rideId, token, b)
+}
+
+// 返金は決済と同じく Idempotency-Key で重複実行を防ぐ
+func requestPaymentGatewayPostRefund(ctx context.Context, paymentGatewayURL string, idempotencyKey, token string, param *paymentGatewayPostRefundRequest) error {
+	b, err := sonic.Marshal(param)
+	if err != nil {
+		return err
+	}
+	return requestPaymentGatewayPost(ctx, paymentGatewayURL+"/refunds", idempotencyKey, token, b)
+}
 
+func requestPaymentGatewayPost(ctx context.Context, url string, idempotencyKey, token string, b []byte) error {
 	retry := 0
 	for {
 		err := func() error {
-			req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+"/payments", bytes.NewBuffer(b))
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(b))
 			if err != nil {
 				return err
 			}
 			req.Header.Set("Content-Type", "application/json")
 			req.Header.Set("Authorization", "Bearer "+token)
-			req.Header.Set("Idempotency-Key", rideId)
+			req.Header.Set("Idempotency-Key", idempotencyKey)
 
 			res, err := http.DefaultClient.Do(req)
 			if err != nil {
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const payoutSettingName = "payout_config"
+
+const (
+	statementPeriodDaily  = "DAILY"
+	statementPeriodWeekly = "WEEKLY"
+)
+
+const (
+	statementStatusDraft     = "DRAFT"
+	statementStatusFinalized = "FINALIZED"
+	statementStatusPaid      = "PAID"
+)
+
+var (
+	errStatementNotFinalized = errors.New("statement is not finalized")
+	errStatementNotDraft     = errors.New("statement is not a draft")
+	errStatementPeriodOpen   = errors.New("statement period has not ended yet")
+)
+
+type PayoutConfig struct {
+	Period   string `json:"period"`
+	Timezone string `json:"timezone"`
+}
+
+func defaultPayoutConfig() PayoutConfig {
+	return PayoutConfig{
+		Period:   statementPeriodDaily,
+		Timezone: "UTC",
+	}
+}
+
+func validatePayoutConfig(config PayoutConfig) error {
+	if config.Period != statementPeriodDaily && config.Period != statementPeriodWeekly {
+		return errors.New("period must be DAILY or WEEKLY")
+	}
+	if _, err := time.LoadLocation(config.Timezone); err != nil {
+		return err
+	}
+	return nil
+}
+
+var payoutConfig atomic.Pointer[PayoutConfig]
+
+func init() {
+	config := defaultPayoutConfig()
+	payoutConfig.Store(&config)
+}
+
+func loadPayoutConfig(ctx context.Context) (PayoutConfig, error) {
+	config := defaultPayoutConfig()
+	found, err := getJSONSetting(ctx, payoutSettingName, &config)
+	if err != nil || !found {
+		return config, err
+	}
+	return config, validatePayoutConfig(config)
+}
+
+// statementPeriod は t を含む精算期間を返す。週次は月曜始まり
+func statementPeriod(config PayoutConfig, t time.Time) (time.Time, time.Time) {
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	local := t.In(location)
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+	if config.Period == statementPeriodWeekly {
+		offset := (int(start.Weekday()) + 6) % 7
+		start = start.AddDate(0, 0, -offset)
+		return start, start.AddDate(0, 0, 7)
+	}
+	return start, start.AddDate(0, 0, 1)
+}
+
+type StatementLine struct {
+	EntryID    string    `json:"entry_id"`
+	Kind       string    `json:"kind"`
+	RideID     string    `json:"ride_id"`
+	ChairID    string    `json:"chair_id"`
+	Sales      int       `json:"sales"`
+	Commission int       `json:"commission"`
+	OwnerShare int       `json:"owner_share"`
+	PostedAt   time.Time `json:"posted_at"`
+	// 締めた期間に後から記帳された分を、次の明細で精算する行
+	Adjustment bool `json:"adjustment"`
+}
+
+type StatementChair struct {
+	ChairID    string `json:"chair_id"`
+	ChairName  string `json:"chair_name"`
+	Rides      int    `json:"rides"`
+	Sales      int    `json:"sales"`
+	Commission int    `json:"commission"`
+	OwnerShare int    `json:"owner_share"`
+}
+
+type Statement struct {
+	ID              string
+	OwnerID         string
+	Period          string
+	PeriodStart     time.Time
+	PeriodEnd       time.Time
+	Status          string
+	Lines           []StatementLine
+	Chairs          []StatementChair
+	TotalSales      int
+	TotalCommission int
+	TotalOwnerShare int
+	CreatedAt       time.Time
+	FinalizedAt     *time.Time
+	PaidAt          *time.Time
+	PayoutEntryID   string
+	// 期間外だが、この明細で精算する台帳の記帳
+	adjustments map[string]bool
+}
+
+type OwnerStatements struct {
+	byPeriod map[int64]*Statement
+	mu       sync.Mutex
+}
+
+func NewOwnerStatements() *OwnerStatements {
+	return &OwnerStatements{
+		byPeriod: map[int64]*Statement{},
+		mu:       sync.Mutex{},
+	}
+}
+
+// statementAt は t を期間に含む明細を返す
+func (o *OwnerStatements) statementAt(t time.Time) (*Statement, bool) {
+	for _, s := range o.byPeriod {
+		if !t.Before(s.PeriodStart) && t.Before(s.PeriodEnd) {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// open は t を含む期間の明細を作る
+func (o *OwnerStatements) open(ownerID string, t time.Time, now time.Time) *Statement {
+	config := payoutConfig.Load()
+	start, end := statementPeriod(*config, t)
+	statement := &Statement{
+		ID:          ulid.Make().String(),
+		OwnerID:     ownerID,
+		Period:      config.Period,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Status:      statementStatusDraft,
+		CreatedAt:   now,
+		adjustments: map[string]bool{},
+	}
+	o.byPeriod[start.UnixMilli()] = statement
+	createStatement(statement)
+	return statement
+}
+
+// settled は明細に載った、または載せることが決まった記帳を返す
+func (o *OwnerStatements) settled() map[string]bool {
+	settled := map[string]bool{}
+	for _, s := range o.byPeriod {
+		for _, l := range s.Lines {
+			settled[l.EntryID] = true
+		}
+		for id := range s.adjustments {
+			settled[id] = true
+		}
+	}
+	return settled
+}
+
+func (s *Statement) rebuild(entries []*LedgerEntry) {
+	s.Lines = []StatementLine{}
+	s.TotalSales, s.TotalCommission, s.TotalOwnerShare = 0, 0, 0
+	chairs := map[string]*StatementChair{}
+	for _, e := range entries {
+		if e.Kind == ledgerEntryPayout {
+			continue
+		}
+		adjustment := s.adjustments[e.ID]
+		if !adjustment && (e.PostedAt.Before(s.PeriodStart) || !e.PostedAt.Before(s.PeriodEnd)) {
+			continue
+		}
+		s.Lines = append(s.Lines, StatementLine{
+			EntryID:    e.ID,
+			Kind:       e.Kind,
+			RideID:     e.RideID,
+			ChairID:    e.ChairID,
+			Sales:      e.Sales,
+			Commission: e.Commission,
+			OwnerShare: e.OwnerShare,
+			PostedAt:   e.PostedAt,
+			Adjustment: adjustment,
+		})
+		c, ok := chairs[e.ChairID]
+		if !ok {
+			c = &StatementChair{ChairID: e.ChairID}
+			if chair, ok := chairCache.Load(e.ChairID); ok {
+				c.ChairName = chair.(*Chair).Name
+			}
+			chairs[e.ChairID] = c
+		}
+		if e.Kind == ledgerEntryCharge {
+			c.Rides++
+		}
+		c.Sales += e.Sales
+		c.Commission += e.Commission
+		c.OwnerShare += e.OwnerShare
+		s.TotalSales += e.Sales
+		s.TotalCommission += e.Commission
+		s.TotalOwnerShare += e.OwnerShare
+	}
+	slices.SortFunc(s.Lines, func(a, b StatementLine) int {
+		return a.PostedAt.Compare(b.PostedAt)
+	})
+	s.Chairs = []StatementChair{}
+	for _, c := range chairs {
+		s.Chairs = append(s.Chairs, *c)
+	}
+	slices.SortFunc(s.Chairs, func(a, b StatementChair) int {
+		if a.ChairID < b.ChairID {
+			return -1
+		}
+		if a.ChairID > b.ChairID {
+			return 1
+		}
+		return 0
+	})
+}
+
+// generateStatements はオーナーの記帳済みの期間ごとに明細を作り直す。
+// 確定済みの明細は変更せず、期間が終わった下書きは確定する。
+// 確定済みの期間に後から記帳された分は、今の期間の明細に調整として載せる
+func generateStatements(ownerID string, now time.Time) {
+	owned := getOwnerStatements(ownerID)
+	entries := ledger.OwnerEntries(ownerID)
+
+	owned.mu.Lock()
+	defer owned.mu.Unlock()
+	settled := owned.settled()
+	for _, e := range entries {
+		if e.Kind == ledgerEntryPayout || settled[e.ID] {
+			continue
+		}
+		// 精算周期を変更しても既存の明細と期間が重ならないようにする
+		statement, ok := owned.statementAt(e.PostedAt)
+		if !ok {
+			owned.open(ownerID, e.PostedAt, now)
+			continue
+		}
+		if statement.Status == statementStatusDraft {
+			continue
+		}
+		// 確定済みの明細は変えられないので、今を含む期間の明細で精算する
+		current, ok := owned.statementAt(now)
+		if !ok {
+			current = owned.open(ownerID, now, now)
+		}
+		current.adjustments[e.ID] = true
+	}
+
+	for _, s := range owned.byPeriod {
+		if s.Status == statementStatusDraft {
+			s.rebuild(entries)
+			if !now.Before(s.PeriodEnd) {
+				s.Status = statementStatusFinalized
+				s.FinalizedAt = &now
+			}
+		}
+	}
+}
+
+// snapshot は明細の写しを返す。下書きは写しの方を今の台帳で集計し直す。owned.mu を取って呼ぶ
+func (s *Statement) snapshot(entries []*LedgerEntry) Statement {
+	statement := *s
+	if statement.Status == statementStatusDraft {
+		statement.rebuild(entries)
+		return statement
+	}
+	statement.Lines = slices.Clone(s.Lines)
+	statement.Chairs = slices.Clone(s.Chairs)
+	return statement
+}
+
+// listStatements はオーナーの明細の写しを新しい期間から順に返す。明細を作ったり確定したりはしない
+func listStatements(ownerID string) []Statement {
+	owned := getOwnerStatements(ownerID)
+	entries := ledger.OwnerEntries(ownerID)
+
+	owned.mu.Lock()
+	defer owned.mu.Unlock()
+	statements := []Statement{}
+	for _, s := range owned.byPeriod {
+		statements = append(statements, s.snapshot(entries))
+	}
+	slices.SortFunc(statements, func(a, b Statement) int {
+		return b.PeriodStart.Compare(a.PeriodStart)
+	})
+	return statements
+}
+
+// getOwnerStatement はオーナーの明細の写しを返す
+func getOwnerStatement(ownerID string, statementID string) (Statement, bool) {
+	statement, ok := getStatement(statementID)
+	if !ok || statement.OwnerID != ownerID {
+		return Statement{}, false
+	}
+	owned := getOwnerStatements(ownerID)
+	entries := ledger.OwnerEntries(ownerID)
+
+	owned.mu.Lock()
+	defer owned.mu.Unlock()
+	return statement.snapshot(entries), true
+}
+
+func finalizeStatement(statement *Statement, now time.Time) error {
+	owned := getOwnerStatements(statement.OwnerID)
+	owned.mu.Lock()
+	defer owned.mu.Unlock()
+	if statement.Status != statementStatusDraft {
+		return errStatementNotDraft
+	}
+	if now.Before(statement.PeriodEnd) {
+		return errStatementPeriodOpen
+	}
+	statement.rebuild(ledger.OwnerEntries(statement.OwnerID))
+	statement.Status = statementStatusFinalized
+	statement.FinalizedAt = &now
+	return nil
+}
+
+// payStatement は確定済みの明細のオーナー取り分を支払い、台帳に記帳する
+func payStatement(statement *Statement, now time.Time) error {
+	owned := getOwnerStatements(statement.OwnerID)
+	owned.mu.Lock()
+	defer owned.mu.Unlock()
+	if statement.Status != statementStatusFinalized {
+		return errStatementNotFinalized
+	}
+	entry, err := postOwnerPayout(statement.OwnerID, statement.TotalOwnerShare, now)
+	if err != nil {
+		return err
+	}
+	statement.Status = statementStatusPaid
+	statement.PaidAt = &now
+	statement.PayoutEntryID = entry.ID
+	return nil
+}
+
+func startStatementLoop() {
+	ticker := time.NewTicker(1 * time.Minute)
+	for range ticker.C {
+		now := time.Now()
+		ownerCache.Range(func(k, _ any) bool {
+			generateStatements(k.(string), now)
+			return true
+		})
+	}
+}
+
+func statementCSV(statement Statement) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	records := [][]string{{"posted_at", "kind", "ride_id", "chair_id", "sales", "commission", "owner_share", "adjustment"}}
+	for _, l := range statement.Lines {
+		records = append(records, []string{
+			l.PostedAt.UTC().Format(time.RFC3339Nano),
+			l.Kind,
+			l.RideID,
+			l.ChairID,
+			strconv.Itoa(l.Sales),
+			strconv.Itoa(l.Commission),
+			strconv.Itoa(l.OwnerShare),
+			strconv.FormatBool(l.Adjustment),
+		})
+	}
+	if err := w.WriteAll(records); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func statementsCSV(statements []Statement) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	records := [][]string{{"id", "period", "period_start", "period_end", "status", "total_sales", "total_commission", "total_owner_share"}}
+	for _, s := range statements {
+		records = append(records, []string{
+			s.ID,
+			s.Period,
+			s.PeriodStart.Format(time.RFC3339),
+			s.PeriodEnd.Format(time.RFC3339),
+			s.Status,
+			strconv.Itoa(s.TotalSales),
+			strconv.Itoa(s.TotalCommission),
+			strconv.Itoa(s.TotalOwnerShare),
+		})
+	}
+	if err := w.WriteAll(records); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+const poolSettingName = "pool_config"
+
+type PoolConfig struct {
+	// 1 台の椅子に同時に乗せる相乗りライドの数の上限
+	MaxRiders int `json:"max_riders"`
+	// 相乗りを入れたことで、乗車中の利用者の降車までの距離が何 % まで伸びてよいか
+	MaxDetourPercent int `json:"max_detour_percent"`
+	// 相乗りを入れたことで伸びる椅子の走行距離の上限
+	MaxDetourDistance int `json:"max_detour_distance"`
+	// 相乗りが成立したときに距離料金から割り引く割合
+	DiscountPercent int `json:"discount_percent"`
+}
+
+func defaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		MaxRiders:         2,
+		MaxDetourPercent:  50,
+		MaxDetourDistance: 100,
+		DiscountPercent:   20,
+	}
+}
+
+func validatePoolConfig(config PoolConfig) error {
+	if config.MaxRiders < 1 {
+		return errors.New("max_riders must be positive")
+	}
+	if config.MaxDetourPercent < 0 || config.MaxDetourDistance < 0 {
+		return errors.New("max_detour_percent and max_detour_distance must not be negative")
+	}
+	if config.DiscountPercent < 0 || config.DiscountPercent > 100 {
+		return errors.New("discount_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+func loadPoolConfig(ctx context.Context) (PoolConfig, error) {
+	config := defaultPoolConfig()
+	found, err := getJSONSetting(ctx, poolSettingName, &config)
+	if err != nil || !found {
+		return config, err
+	}
+	return config, validatePoolConfig(config)
+}
+
+const (
+	poolStopPickup  = "PICKUP"
+	poolStopDropoff = "DROPOFF"
+)
+
+type PoolStop struct {
+	RideID     string     `json:"ride_id"`
+	Type       string     `json:"type"`
+	Coordinate Coordinate `json:"coordinate"`
+}
+
+// RidePool は 1 台の椅子に乗っている相乗りライドと、これから回る停車地の順番を持つ
+type RidePool struct {
+	rides []*Ride
+	stops []PoolStop
+}
+
+type RidePools struct {
+	config PoolConfig
+	pools  map[string]*RidePool
+	mu     sync.Mutex
+}
+
+func NewRidePools(config PoolConfig) *RidePools {
+	return &RidePools{
+		config: config,
+		pools:  map[string]*RidePool{},
+		mu:     sync.Mutex{},
+	}
+}
+
+var ridePools = NewRidePools(defaultPoolConfig())
+
+// Reset は相乗りの予定をすべて捨てて設定を入れ替える
+func (p *RidePools) Reset(config PoolConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.config = config
+	p.pools = map[string]*RidePool{}
+}
+
+func (p *RidePools) Config() PoolConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.config
+}
+
+func (p *RidePools) SetConfig(config PoolConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.config = config
+}
+
+// Start は相乗り可のライドが空き椅子に割り当てられたときに呼び、椅子を相乗りの受け入れ先にする
+func (p *RidePools) Start(chairID string, ride *Ride) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pools[chairID] = &RidePool{
+		rides: []*Ride{ride},
+		stops: []PoolStop{
+			{RideID: ride.ID, Type: poolStopPickup, Coordinate: Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}},
+			{RideID: ride.ID, Type: poolStopDropoff, Coordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}},
+		},
+	}
+}
+
+// Visit は乗車・降車した停車地を予定から外す
+func (p *RidePools) Visit(chairID, rideID, stopType string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pool, ok := p.pools[chairID]
+	if !ok {
+		return
+	}
+	pool.stops = slices.DeleteFunc(pool.stops, func(s PoolStop) bool {
+		return s.RideID == rideID && s.Type == stopType
+	})
+}
+
+// Leave はライドを相乗りから外し、まだ乗っているライドを返す
+func (p *RidePools) Leave(chairID, rideID string) []*Ride {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pool, ok := p.pools[chairID]
+	if !ok {
+		return nil
+	}
+	pool.rides = slices.DeleteFunc(pool.rides, func(r *Ride) bool { return r.ID == rideID })
+	pool.stops = slices.DeleteFunc(pool.stops, func(s PoolStop) bool { return s.RideID == rideID })
+	if len(pool.rides) == 0 {
+		delete(p.pools, chairID)
+		return nil
+	}
+	return slices.Clone(pool.rides)
+}
+
+// Rides は椅子に割り当てられている相乗りライドを返す。相乗りでなければ nil
+func (p *RidePools) Rides(chairID string) []*Ride {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pool, ok := p.pools[chairID]
+	if !ok {
+		return nil
+	}
+	return slices.Clone(pool.rides)
+}
+
+func (p *RidePools) Stops(chairID string) []PoolStop {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pool, ok := p.pools[chairID]
+	if !ok {
+		return nil
+	}
+	return slices.Clone(pool.stops)
+}
+
+// Join は停車地の予定を差し替えてライドを相乗りに加え、先に乗っていたライドを返す
+func (p *RidePools) Join(chairID string, ride *Ride, stops []PoolStop) []*Ride {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pool := p.pools[chairID]
+	coRiders := slices.Clone(pool.rides)
+	pool.rides = append(pool.rides, ride)
+	pool.stops = stops
+	return coRiders
+}
+
+// Candidates はまだ相乗りを受け入れられる椅子と、その停車地の予定を返す
+func (p *RidePools) Candidates() map[string][]PoolStop {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	candidates := map[string][]PoolStop{}
+	for chairID, pool := range p.pools {
+		if len(pool.rides) < p.config.MaxRiders {
+			candidates[chairID] = slices.Clone(pool.stops)
+		}
+	}
+	return candidates
+}
+
+// Busy は椅子にまだ完了していない相乗りライドが残っているかを返す
+func (p *RidePools) Busy(chairID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.pools[chairID]
+	return ok
+}
+
+// matchPooledRides は相乗り可の配車待ちライドを、相乗り中の椅子の予定に差し込めるか調べて割り当てる。
+// 差し込めなかったライドはそのまま通常のマッチングに回る
+func matchPooledRides() {
+	rides := []*Ride{}
+	for _, r := range waitingRides.List() {
+		if r.Pooled {
+			rides = append(rides, r)
+		}
+	}
+	if len(rides) == 0 {
+		return
+	}
+	candidates := ridePools.Candidates()
+	if len(candidates) == 0 {
+		return
+	}
+	config := ridePools.Config()
+	slices.SortFunc(rides, func(a, b *Ride) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	now := time.Now()
+	for _, ride := range rides {
+		var best *poolInsertion
+		for chairID, stops := range candidates {
+			chair, ok := getChair(chairID)
+			if !ok || !chairDispatchable(chair) || !matchAllowed(ride, chair, now) {
+				continue
+			}
+			l, ok := getLatestChairLocation(chairID)
+			if !ok {
+				continue
+			}
+			planned, added, ok := planInsertion(config, Coordinate{Latitude: l.Latitude, Longitude: l.Longitude}, stops, ride)
+			if ok && (best == nil || added < best.added) {
+				best = &poolInsertion{chairID: chairID, stops: planned, added: added}
+			}
+		}
+		if best == nil {
+			continue
+		}
+		joinPool(ride, best, config)
+		// 予定が変わったので、同じ椅子には次の回で改めて差し込む
+		delete(candidates, best.chairID)
+	}
+}
+
+func joinPool(ride *Ride, in *poolInsertion, config PoolConfig) {
+	coRiders := ridePools.Join(in.chairID, ride, in.stops)
+	ride.ChairID = sql.NullString{String: in.chairID, Valid: true}
+	if chair, ok := getChair(in.chairID); ok {
+		repriceOnAssign(ride, chair)
+	}
+	waitingRides.Remove(ride.ID)
+	createUserRideStatus(ride.UserID, false)
+	rideOffers.Offer(ride.ID, in.chairID, time.Now())
+	applyPoolDiscount(ride, config.DiscountPercent)
+	for _, r := range coRiders {
+		applyPoolDiscount(r, config.DiscountPercent)
+	}
+	notif := &Notif{
+		Ride:       ride,
+		RideStatus: "MATCHING",
+	}
+	publishChairChan(in.chairID, notif)
+	publishAppChan(ride.UserID, notif)
+	// 先に乗っている利用者にも停車地が増えたことを知らせる
+	for _, r := range coRiders {
+		status, _ := getLatestRideStatus(r.ID)
+		go publishAppChan(r.UserID, &Notif{Ride: r, RideStatus: status})
+	}
+}
+
+// applyPoolDiscount は相乗りが成立したライドの距離料金を割り引く。割引は一度だけ
+func applyPoolDiscount(ride *Ride, percent int) {
+	fare := &ride.FareBreakdown
+	if fare.PoolDiscount > 0 {
+		return
+	}
+	fare.PoolDiscount = min(fare.Metered*percent/100, fare.Metered+fare.Surcharge-fare.Discount)
+	fare.Total -= fare.PoolDiscount
+	ride.Fare = fare.Total
+}
+
+// trackPooledRide は相乗りライドの状態に合わせて停車地の予定を進める。
+// 完了したライドが椅子の最新のライドなら、残っている相乗りライドに引き継ぐ
+func trackPooledRide(ride *Ride, status string) {
+	if !ride.Pooled || !ride.ChairID.Valid {
+		return
+	}
+	chairID := ride.ChairID.String
+	switch status {
+	case "PICKUP":
+		ridePools.Visit(chairID, ride.ID, poolStopPickup)
+	case "ARRIVED":
+		ridePools.Visit(chairID, ride.ID, poolStopDropoff)
+	case "COMPLETED", "CANCELED":
+		rest := ridePools.Leave(chairID, ride.ID)
+		if latest, ok := getLatestRide(chairID); ok && latest.ID == ride.ID && len(rest) > 0 {
+			createLatestRide(chairID, rest[0])
+		}
+	}
+}
+
+// chairRides は椅子が今受け持っているライドを返す
+func chairRides(chairID string) []*Ride {
+	if rides := ridePools.Rides(chairID); rides != nil {
+		return rides
+	}
+	if ride, ok := getLatestRide(chairID); ok {
+		return []*Ride{ride}
+	}
+	return nil
+}
+
+func poolStopsOf(ride *Ride) []PoolStop {
+	if !ride.Pooled || !ride.ChairID.Valid {
+		return nil
+	}
+	return ridePools.Stops(ride.ChairID.String)
+}
+
+// poolInsertion は停車地の予定に新しいライドの乗車・降車を差し込んだ結果
+type poolInsertion struct {
+	chairID string
+	stops   []PoolStop
+	added   int
+}
+
+// planInsertion は乗車・降車を差し込む位置を総当たりし、遠回りの予算に収まる中で
+// 走行距離の増加が最も小さい停車地の順番を返す
+func planInsertion(config PoolConfig, from Coordinate, stops []PoolStop, ride *Ride) ([]PoolStop, int, bool) {
+	pickup := PoolStop{RideID: ride.ID, Type: poolStopPickup, Coordinate: Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}}
+	dropoff := PoolStop{RideID: ride.ID, Type: poolStopDropoff, Coordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}}
+	base := stopsDistance(from, stops)
+	before := dropoffDistances(from, stops)
+	direct := calculateDistance(pickup.Coordinate.Latitude, pickup.Coordinate.Longitude, dropoff.Coordinate.Latitude, dropoff.Coordinate.Longitude)
+
+	var best []PoolStop
+	bestAdded := -1
+	for i := 0; i <= len(stops); i++ {
+		for j := i; j <= len(stops); j++ {
+			candidate := make([]PoolStop, 0, len(stops)+2)
+			candidate = append(candidate, stops[:i]...)
+			candidate = append(candidate, pickup)
+			candidate = append(candidate, stops[i:j]...)
+			candidate = append(candidate, dropoff)
+			candidate = append(candidate, stops[j:]...)
+
+			added := stopsDistance(from, candidate) - base
+			if added > config.MaxDetourDistance || (bestAdded >= 0 && added >= bestAdded) {
+				continue
+			}
+			// 新しい利用者も、乗車してから間に挟まる停車地の分しか遠回りしない
+			if !withinDetour(config, stopsDistance(pickup.Coordinate, candidate[i+1:j+2]), direct) {
+				continue
+			}
+			after := dropoffDistances(from, candidate)
+			ok := true
+			for rideID, d := range before {
+				if !withinDetour(config, after[rideID], d) {
+					ok = false
+					break
+				}
+			}
+			if ok {
+				best, bestAdded = candidate, added
+			}
+		}
+	}
+	return best, bestAdded, best != nil
+}
+
+// withinDetour は本来 base で済む距離が distance に伸びるのが許容範囲かを返す
+func withinDetour(config PoolConfig, distance, base int) bool {
+	return (distance-base)*100 <= base*config.MaxDetourPercent
+}
+
+func stopsDistance(from Coordinate, stops []PoolStop) int {
+	distance := 0
+	for _, s := range stops {
+		distance += calculateDistance(from.Latitude, from.Longitude, s.Coordinate.Latitude, s.Coordinate.Longitude)
+		from = s.Coordinate
+	}
+	return distance
+}
+
+// dropoffDistances は椅子の現在地から各ライドの降車地点までの走行距離を返す
+func dropoffDistances(from Coordinate, stops []PoolStop) map[string]int {
+	distances := map[string]int{}
+	distance := 0
+	for _, s := range stops {
+		distance += calculateDistance(from.Latitude, from.Longitude, s.Coordinate.Latitude, s.Coordinate.Longitude)
+		from = s.Coordinate
+		if s.Type == poolStopDropoff {
+			distances[s.RideID] = distance
+		}
+	}
+	return distances
+}
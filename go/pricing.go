@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// 料金設定は settings テーブルの pricing_tariffs、なければ ISUCON_PRICING_CONFIG のファイルから読む
+const pricingSettingName = "pricing_tariffs"
+
+type PricingConfig struct {
+	Timezone string    `json:"timezone"`
+	Tariffs  []*Tariff `json:"tariffs"`
+}
+
+// Speeds も Models も空の料金表はどの椅子クラスにも当てはまらないときに使われる。
+// 料金表の名前は利用者が椅子のクラスとして指定する。Models があれば Speeds より優先して椅子のクラスを決める
+type Tariff struct {
+	Name            string            `json:"name"`
+	Speeds          []int             `json:"speeds"`
+	Models          []string          `json:"models,omitempty"`
+	BaseFare        int               `json:"base_fare"`
+	FarePerDistance int               `json:"fare_per_distance"`
+	MinimumFare     int               `json:"minimum_fare"`
+	Surcharges      []TariffSurcharge `json:"surcharges"`
+}
+
+// isDefault は椅子の条件を持たない、標準の料金表かを返す
+func (t *Tariff) isDefault() bool {
+	return len(t.Speeds) == 0 && len(t.Models) == 0
+}
+
+// StartHour <= hour < EndHour の時間帯は距離料金を Percent % 割増す。日付を跨ぐ場合は StartHour > EndHour
+type TariffSurcharge struct {
+	StartHour int `json:"start_hour"`
+	EndHour   int `json:"end_hour"`
+	Percent   int `json:"percent"`
+}
+
+type FareBreakdown struct {
+	Base            int     `json:"base"`
+	Metered         int     `json:"metered"`
+	Surcharge       int     `json:"surcharge"`
+	Discount        int     `json:"discount"`
+	PoolDiscount    int     `json:"pool_discount,omitempty"`
+	Total           int     `json:"total"`
+	SurgeMultiplier float64 `json:"surge_multiplier"`
+}
+
+// 割引前の金額。オーナーの売上はこちらで計上する。相乗り割引はオーナーの負担なので戻さない
+func (f FareBreakdown) Gross() int {
+	return f.Total + f.Discount
+}
+
+type FareInput struct {
+	PickupLatitude       int
+	PickupLongitude      int
+	DestinationLatitude  int
+	DestinationLongitude int
+	Waypoints            []Coordinate
+	Speed                int
+	// 利用者が指定した椅子のクラス。指定があれば Speed より優先する
+	Class    string
+	At       time.Time
+	Discount int
+	// 1 以下なら需要による割増なし
+	Surge float64
+}
+
+type PricingEngine struct {
+	config   *PricingConfig
+	location *time.Location
+}
+
+// 管理 API から差し替えるので、読むときは Load で取り出す
+var pricing atomic.Pointer[PricingEngine]
+
+func init() {
+	pricing.Store(NewPricingEngine(defaultPricingConfig()))
+}
+
+func defaultPricingConfig() *PricingConfig {
+	return &PricingConfig{
+		Timezone: "UTC",
+		Tariffs: []*Tariff{
+			{
+				Name:            "standard",
+				BaseFare:        initialFare,
+				FarePerDistance: farePerDistance,
+			},
+		},
+	}
+}
+
+func NewPricingEngine(config *PricingConfig) *PricingEngine {
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	return &PricingEngine{
+		config:   config,
+		location: location,
+	}
+}
+
+func (p *PricingEngine) Config() *PricingConfig {
+	return p.config
+}
+
+func (p *PricingEngine) tariff(speed int) *Tariff {
+	var fallback *Tariff
+	for _, t := range p.config.Tariffs {
+		if t.isDefault() {
+			if fallback == nil {
+				fallback = t
+			}
+			continue
+		}
+		for _, s := range t.Speeds {
+			if s == speed {
+				return t
+			}
+		}
+	}
+	return fallback
+}
+
+func (p *PricingEngine) Tariff(name string) (*Tariff, bool) {
+	for _, t := range p.config.Tariffs {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// ClassOf は椅子が当てはまる料金表の名前を返す
+func (p *PricingEngine) ClassOf(chair *Chair) string {
+	for _, t := range p.config.Tariffs {
+		if slices.Contains(t.Models, chair.Model) {
+			return t.Name
+		}
+	}
+	if t := p.tariff(chair.Speed); t != nil {
+		return t.Name
+	}
+	return ""
+}
+
+// InClass は椅子が指定されたクラスに当てはまるかを返す。標準の料金表のクラスにはどの椅子も当てはまる
+func (p *PricingEngine) InClass(chair *Chair, class string) bool {
+	t, ok := p.Tariff(class)
+	if !ok {
+		return false
+	}
+	if t.isDefault() {
+		return true
+	}
+	return p.ClassOf(chair) == class
+}
+
+func (p *PricingEngine) surchargePercent(t *Tariff, at time.Time) int {
+	hour := at.In(p.location).Hour()
+	for _, s := range t.Surcharges {
+		if s.StartHour <= s.EndHour {
+			if s.StartHour <= hour && hour < s.EndHour {
+				return s.Percent
+			}
+			continue
+		}
+		if hour >= s.StartHour || hour < s.EndHour {
+			return s.Percent
+		}
+	}
+	return 0
+}
+
+// クーポン割引は距離料金と割増料金にのみ適用し、初乗り料金は割り引かない
+func (p *PricingEngine) Quote(in FareInput) FareBreakdown {
+	t := p.tariff(in.Speed)
+	if in.Class != "" {
+		if class, ok := p.Tariff(in.Class); ok {
+			t = class
+		}
+	}
+	distance := routeDistance(
+		Coordinate{Latitude: in.PickupLatitude, Longitude: in.PickupLongitude},
+		in.Waypoints,
+		Coordinate{Latitude: in.DestinationLatitude, Longitude: in.DestinationLongitude},
+	)
+	fare := FareBreakdown{
+		Base:    t.BaseFare,
+		Metered: t.FarePerDistance * distance,
+	}
+	fare.Surcharge = fare.Metered * p.surchargePercent(t, in.At) / 100
+	fare.SurgeMultiplier = 1
+	if in.Surge > 1 {
+		fare.SurgeMultiplier = in.Surge
+		fare.Surcharge += int(math.Round(float64(fare.Metered) * (in.Surge - 1)))
+	}
+	fare.Discount = min(max(in.Discount, 0), fare.Metered+fare.Surcharge)
+	fare.Total = fare.Base + fare.Metered + fare.Surcharge - fare.Discount
+	if short := t.MinimumFare - fare.Total; short > 0 {
+		// 最低運賃に届かない分はまず割引を減らし、残りを割増として計上する
+		reduced := min(short, fare.Discount)
+		fare.Discount -= reduced
+		fare.Surcharge += short - reduced
+		fare.Total = t.MinimumFare
+	}
+	return fare
+}
+
+func validatePricingConfig(config *PricingConfig) error {
+	if len(config.Tariffs) == 0 {
+		return errors.New("at least one tariff is required")
+	}
+	hasDefault := false
+	for _, t := range config.Tariffs {
+		if t.isDefault() {
+			hasDefault = true
+		}
+		if t.BaseFare < 0 || t.FarePerDistance < 0 || t.MinimumFare < 0 {
+			return fmt.Errorf("tariff %s has a negative fare", t.Name)
+		}
+		for _, s := range t.Surcharges {
+			if s.StartHour < 0 || s.StartHour > 23 || s.EndHour < 0 || s.EndHour > 24 {
+				return fmt.Errorf("tariff %s has an invalid surcharge hour", t.Name)
+			}
+		}
+	}
+	if !hasDefault {
+		return errors.New("a tariff without speeds and models is required as the default")
+	}
+	if _, err := time.LoadLocation(config.Timezone); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parsePricingConfig(b []byte) (*PricingConfig, error) {
+	config := &PricingConfig{}
+	if err := sonic.Unmarshal(b, config); err != nil {
+		return nil, err
+	}
+	if err := validatePricingConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func loadPricingConfig(ctx context.Context) (*PricingConfig, error) {
+	config := &PricingConfig{}
+	found, err := getJSONSetting(ctx, pricingSettingName, config)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return config, validatePricingConfig(config)
+	}
+	if path := os.Getenv("ISUCON_PRICING_CONFIG"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return parsePricingConfig(b)
+	}
+	return defaultPricingConfig(), nil
+}
+
+// calculateRideFare は受付時の運賃を計算する。椅子はまだ決まっていないので、利用者の指定したクラスか標準の料金表を使う
+func calculateRideFare(ride *Ride, discount int, surge float64) FareBreakdown {
+	return pricing.Load().Quote(rideFareInput(ride, discount, surge))
+}
+
+// calculateChairFare は割り当てた椅子の料金表で運賃を計算する
+func calculateChairFare(ride *Ride, chair *Chair, discount int, surge float64) FareBreakdown {
+	engine := pricing.Load()
+	in := rideFareInput(ride, discount, surge)
+	in.Speed = chair.Speed
+	in.Class = engine.ClassOf(chair)
+	return engine.Quote(in)
+}
+
+// priceRide は受付と椅子の割り当てと同じ手順でライドの運賃を決める。
+// 運賃を持っていないライドを読み込み直したときに使い、利用者への請求とオーナーの売上を揃える
+func priceRide(ride *Ride, discount int, surge float64) {
+	ride.FareBreakdown = calculateRideFare(ride, discount, surge)
+	ride.Fare = ride.FareBreakdown.Total
+	if !ride.ChairID.Valid {
+		return
+	}
+	if chair, ok := getChair(ride.ChairID.String); ok {
+		repriceOnAssign(ride, chair)
+	}
+}
+
+func rideFareInput(ride *Ride, discount int, surge float64) FareInput {
+	return FareInput{
+		PickupLatitude:       ride.PickupLatitude,
+		PickupLongitude:      ride.PickupLongitude,
+		DestinationLatitude:  ride.DestinationLatitude,
+		DestinationLongitude: ride.DestinationLongitude,
+		Waypoints:            ride.Waypoints,
+		Class:                ride.ChairClass,
+		At:                   ride.CreatedAt,
+		Discount:             discount,
+		Surge:                surge,
+	}
+}
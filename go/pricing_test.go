@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnclassedRideFareAgrees(t *testing.T) {
+	previous := pricing.Load()
+	t.Cleanup(func() { pricing.Store(previous) })
+	pricing.Store(NewPricingEngine(&PricingConfig{
+		Timezone: "UTC",
+		Tariffs: []*Tariff{
+			{Name: "standard", BaseFare: 500, FarePerDistance: 100},
+			{Name: "premium", Speeds: []int{7}, BaseFare: 800, FarePerDistance: 150},
+			{Name: "economy", Speeds: []int{2}, BaseFare: 300, FarePerDistance: 60},
+		},
+	}))
+
+	tests := []struct {
+		name  string
+		speed int
+		// 割り当てた椅子の料金表の方が安ければ、その運賃で請求する
+		wantTotal int
+	}{
+		{name: "default tier", speed: 5, wantTotal: 500 + 100*20},
+		{name: "pricier tier keeps the quote", speed: 7, wantTotal: 500 + 100*20},
+		{name: "cheaper tier lowers the fare", speed: 2, wantTotal: 300 + 60*20},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 12, 8, 10, 0, 0, 0, time.UTC)
+			ownerID := "owner-" + tt.name
+			chair := &Chair{ID: "chair-" + tt.name, OwnerID: ownerID, Model: "test", Speed: tt.speed, IsActive: true}
+			createChair(chair.ID, chair)
+			ride := &Ride{
+				ID:                   "ride-" + tt.name,
+				UserID:               "user-" + tt.name,
+				PickupLatitude:       i,
+				PickupLongitude:      0,
+				DestinationLatitude:  i + 10,
+				DestinationLongitude: 10,
+				CreatedAt:            now,
+				UpdatedAt:            now,
+			}
+
+			// 見積もりは椅子が決まる前なので速さを持たない
+			quote := pricing.Load().Quote(FareInput{
+				PickupLatitude:       ride.PickupLatitude,
+				PickupLongitude:      ride.PickupLongitude,
+				DestinationLatitude:  ride.DestinationLatitude,
+				DestinationLongitude: ride.DestinationLongitude,
+				At:                   now,
+				Surge:                1,
+			})
+			if err := prepareRide(ride, nil, now); err != nil {
+				t.Fatal(err)
+			}
+			if ride.FareBreakdown != quote {
+				t.Fatalf("booked fare = %+v, quote = %+v", ride.FareBreakdown, quote)
+			}
+
+			assignRide(ride, chair.ID)
+			if ride.Fare != tt.wantTotal || ride.FareBreakdown.Total != tt.wantTotal {
+				t.Fatalf("assigned fare = %d (%+v), want %d", ride.Fare, ride.FareBreakdown, tt.wantTotal)
+			}
+			if ride.Fare > quote.Total {
+				t.Fatalf("assigned fare %d is above the quote %d", ride.Fare, quote.Total)
+			}
+
+			if err := postRideCharge(ride); err != nil {
+				t.Fatal(err)
+			}
+			entries := ledger.OwnerEntries(ownerID)
+			if len(entries) != 1 {
+				t.Fatalf("owner has %d entries, want 1", len(entries))
+			}
+			charged := 0
+			for _, l := range entries[0].Lines {
+				if l.Account == accountCash {
+					charged += l.Debit - l.Credit
+				}
+			}
+			if charged != ride.Fare {
+				t.Fatalf("charged %d, want %d", charged, ride.Fare)
+			}
+			if entries[0].Sales != ride.FareBreakdown.Gross() {
+				t.Fatalf("owner sales = %d, want %d", entries[0].Sales, ride.FareBreakdown.Gross())
+			}
+
+			// 読み込み直しても同じ運賃になる
+			reloaded := *ride
+			reloaded.FareBreakdown = FareBreakdown{}
+			reloaded.Fare = 0
+			priceRide(&reloaded, 0, 1)
+			if reloaded.FareBreakdown != ride.FareBreakdown || reloaded.Fare != ride.Fare {
+				t.Fatalf("reloaded fare = %+v, want %+v", reloaded.FareBreakdown, ride.FareBreakdown)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+const fareQuoteTTL = 5 * time.Minute
+
+var (
+	errInvalidQuote  = errors.New("invalid quote")
+	errQuoteExpired  = errors.New("quote expired")
+	errQuoteMismatch = errors.New("quote does not match the ride request")
+	errQuoteUsed     = errors.New("quote already used")
+	// 見積もりに含めたクーポンが使われたり期限が切れたりして、同じ割引を予約できない
+	errQuoteDiscountUnavailable = errors.New("coupons in the quote are no longer available; request a new quote")
+)
+
+// 見積もりはサーバーに状態を持たず、署名付きの ID にすべての内容を詰める
+type FareQuote struct {
+	UserID                string        `json:"user_id"`
+	PickupCoordinate      Coordinate    `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate    `json:"destination_coordinate"`
+	Waypoints             []Coordinate  `json:"waypoints,omitempty"`
+	ChairClass            string        `json:"chair_class,omitempty"`
+	Fare                  FareBreakdown `json:"fare"`
+	ExpiresAt             int64         `json:"expires_at"`
+	Nonce                 string        `json:"nonce"`
+}
+
+var quoteSecret = loadQuoteSecret()
+
+func loadQuoteSecret() []byte {
+	if secret := os.Getenv("ISUCON_QUOTE_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return []byte(secureRandomStr(32))
+}
+
+func signQuote(payload []byte) []byte {
+	mac := hmac.New(sha256.New, quoteSecret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func issueFareQuote(quote *FareQuote) (string, error) {
+	payload, err := sonic.Marshal(quote)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signQuote(payload)), nil
+}
+
+func parseFareQuote(quoteID string) (*FareQuote, error) {
+	encodedPayload, encodedSig, ok := strings.Cut(quoteID, ".")
+	if !ok {
+		return nil, errInvalidQuote
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, errInvalidQuote
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return nil, errInvalidQuote
+	}
+	if !hmac.Equal(sig, signQuote(payload)) {
+		return nil, errInvalidQuote
+	}
+	quote := &FareQuote{}
+	if err := sonic.Unmarshal(payload, quote); err != nil {
+		return nil, errInvalidQuote
+	}
+	return quote, nil
+}
+
+// redeemFareQuote は見積もりを検証して使用済みにする。同じ見積もりで二度は予約できない
+func redeemFareQuote(quoteID string, userID string, pickup, destination Coordinate, waypoints []Coordinate, chairClass string, now time.Time) (*FareQuote, error) {
+	quote, err := parseFareQuote(quoteID)
+	if err != nil {
+		return nil, err
+	}
+	if now.UnixMilli() > quote.ExpiresAt {
+		return nil, errQuoteExpired
+	}
+	if quote.UserID != userID || quote.PickupCoordinate != pickup || quote.DestinationCoordinate != destination || !slices.Equal(quote.Waypoints, waypoints) || quote.ChairClass != chairClass {
+		return nil, errQuoteMismatch
+	}
+	// 期限が切れるまでは使用済みとして覚えておく
+	if _, loaded := usedQuotes.LoadOrStore(quote.Nonce, quote.ExpiresAt); loaded {
+		return nil, errQuoteUsed
+	}
+	return quote, nil
+}
+
+// sweepUsedQuotes は期限が切れた見積もりを使用済みの一覧から消す。期限切れの見積もりは検証で弾かれる
+func sweepUsedQuotes(now time.Time) {
+	usedQuotes.Range(func(k, v any) bool {
+		if now.UnixMilli() > v.(int64) {
+			usedQuotes.Delete(k)
+		}
+		return true
+	})
+}
+
+func startQuoteSweepLoop() {
+	ticker := time.NewTicker(fareQuoteTTL)
+	for now := range ticker.C {
+		sweepUsedQuotes(now)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const referralSettingName = "referral_config"
+
+const (
+	referralStatusPending  = "PENDING"
+	referralStatusRewarded = "REWARDED"
+	referralStatusRejected = "REJECTED"
+)
+
+var (
+	errInvitationCodeNotFound  = errors.New("invitation code not found")
+	errInvitationCodeExhausted = errors.New("invitation code has reached its maximum invitations")
+	errInvitationRateLimited   = errors.New("too many signups with this invitation code")
+)
+
+type ReferralConfig struct {
+	MaxInvitations int `json:"max_invitations"`
+	// 同じ招待コードでの登録を SignupWindowSeconds 秒あたり MaxSignupsPerWindow 件までに制限する
+	MaxSignupsPerWindow int    `json:"max_signups_per_window"`
+	SignupWindowSeconds int    `json:"signup_window_seconds"`
+	InviteeCampaignID   string `json:"invitee_campaign_id"`
+	InviterCampaignID   string `json:"inviter_campaign_id"`
+}
+
+func defaultReferralConfig() ReferralConfig {
+	return ReferralConfig{
+		MaxInvitations:      3,
+		MaxSignupsPerWindow: 3,
+		SignupWindowSeconds: 60,
+		InviteeCampaignID:   invitationCampaignID,
+		InviterCampaignID:   invitationRewardCampaignID,
+	}
+}
+
+// 登録中に読むので、入れ替えは Store で行う
+var referralConfig atomic.Pointer[ReferralConfig]
+
+func init() {
+	config := defaultReferralConfig()
+	referralConfig.Store(&config)
+}
+
+func loadReferralConfig(ctx context.Context) (ReferralConfig, error) {
+	config := defaultReferralConfig()
+	if _, err := getJSONSetting(ctx, referralSettingName, &config); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+type Referral struct {
+	Code       string
+	InviterID  string
+	InviteeID  string
+	Status     string
+	Reason     string
+	CreatedAt  time.Time
+	RewardedAt *time.Time
+}
+
+var referralMu sync.Mutex
+
+// checkInvitationCode は招待コードで登録してよいかを確認する。referralMu を取って呼ぶ
+func checkInvitationCode(code string, now time.Time) (*User, error) {
+	inviter, ok := getUserInv(code)
+	if !ok {
+		return nil, errInvitationCodeNotFound
+	}
+	config := referralConfig.Load()
+	count, _ := getInvCouponCount(code)
+	if config.MaxInvitations > 0 && count >= config.MaxInvitations {
+		return nil, errInvitationCodeExhausted
+	}
+	if config.MaxSignupsPerWindow > 0 {
+		since := now.Add(-time.Duration(config.SignupWindowSeconds) * time.Second)
+		recent := 0
+		for _, r := range listReferralsByInviter(inviter.ID) {
+			if r.Code == code && r.CreatedAt.After(since) {
+				recent++
+			}
+		}
+		if recent >= config.MaxSignupsPerWindow {
+			return nil, errInvitationRateLimited
+		}
+	}
+	return inviter, nil
+}
+
+// registerReferral は招待コードの枠を確保して招待を記録する。失敗しないように、ユーザーを作る前に呼ぶ。
+// 招待された側の特典は grantInviteeCoupon で、招待した側の特典は初回ライド完了後に付与する
+func registerReferral(code string, inviteeID string, now time.Time) error {
+	referralMu.Lock()
+	defer referralMu.Unlock()
+	inviter, err := checkInvitationCode(code, now)
+	if err != nil {
+		return err
+	}
+	incInvCouponCount(code)
+	createReferral(&Referral{
+		Code:      code,
+		InviterID: inviter.ID,
+		InviteeID: inviteeID,
+		Status:    referralStatusPending,
+		CreatedAt: now,
+	})
+	return nil
+}
+
+func grantInviteeCoupon(code string, inviteeID string, now time.Time) {
+	grantCoupon(inviteeID, referralConfig.Load().InviteeCampaignID, "INV_"+code, now)
+}
+
+// 招待した人と同じ決済トークン、または同じコードで招待された他の人と同じ決済トークンなら自作自演とみなす
+func referralAbuseReason(referral *Referral) string {
+	token, ok := getPaymentToken(referral.InviteeID)
+	if !ok {
+		return ""
+	}
+	if inviterToken, ok := getPaymentToken(referral.InviterID); ok && inviterToken == token {
+		return "payment token is shared with the inviter"
+	}
+	for _, userID := range listPaymentTokenUsers(token) {
+		if userID == referral.InviteeID {
+			continue
+		}
+		if other, ok := getReferralByInvitee(userID); ok && other.Code == referral.Code {
+			return "payment token is shared with another invitee"
+		}
+	}
+	return ""
+}
+
+func completeReferral(inviteeID string, now time.Time) {
+	referral, ok := getReferralByInvitee(inviteeID)
+	if !ok {
+		return
+	}
+	referralMu.Lock()
+	defer referralMu.Unlock()
+	if referral.Status != referralStatusPending {
+		return
+	}
+	if reason := referralAbuseReason(referral); reason != "" {
+		referral.Status = referralStatusRejected
+		referral.Reason = reason
+		return
+	}
+	referral.Status = referralStatusRewarded
+	referral.RewardedAt = &now
+	grantCoupon(referral.InviterID, referralConfig.Load().InviterCampaignID, "RWD_"+referral.Code+"_"+strconv.FormatInt(now.UnixMilli(), 10), now)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	reviewSettingName = "review_moderation"
+	maxReviewLength   = 1000
+)
+
+const (
+	reviewStatusPending  = "PENDING"
+	reviewStatusApproved = "APPROVED"
+	reviewStatusRejected = "REJECTED"
+)
+
+var reviewTags = []string{"cleanliness", "punctuality", "comfort", "safety", "friendliness"}
+
+var (
+	errReviewNotFound  = errors.New("review not found")
+	errReviewModerated = errors.New("review has already been moderated")
+)
+
+type Review struct {
+	ID         string
+	RideID     string
+	ChairID    string
+	UserID     string
+	Evaluation int
+	Text       string
+	Tags       []string
+	Status     string
+	// 自動で保留・却下したときの理由。管理者が判断したときはその理由
+	Reason      string
+	CreatedAt   time.Time
+	ModeratedAt *time.Time
+}
+
+func validateReview(text string, tags []string) error {
+	if utf8.RuneCountInString(text) > maxReviewLength {
+		return fmt.Errorf("review must be at most %d characters", maxReviewLength)
+	}
+	for _, tag := range tags {
+		if !slices.Contains(reviewTags, tag) {
+			return fmt.Errorf("unknown tag: %s", tag)
+		}
+	}
+	return nil
+}
+
+const (
+	moderationApprove = iota
+	moderationHold
+	moderationReject
+)
+
+// ReviewFilter はレビューの本文を調べて、公開・保留・却下のどれにするかを返す
+type ReviewFilter interface {
+	Name() string
+	Check(review *Review) (verdict int, reason string)
+}
+
+type ReviewModerationConfig struct {
+	// 含まれていたら却下する語
+	BlockedWords []string `json:"blocked_words"`
+	// 含まれていたら管理者の確認待ちにする語
+	HeldWords []string `json:"held_words"`
+	// URL を含むレビューを確認待ちにする
+	HoldLinks bool `json:"hold_links"`
+}
+
+func defaultReviewModerationConfig() ReviewModerationConfig {
+	return ReviewModerationConfig{
+		BlockedWords: []string{},
+		HeldWords:    []string{},
+		HoldLinks:    true,
+	}
+}
+
+func loadReviewModerationConfig(ctx context.Context) (ReviewModerationConfig, error) {
+	config := defaultReviewModerationConfig()
+	_, err := getJSONSetting(ctx, reviewSettingName, &config)
+	return config, err
+}
+
+type wordFilter struct {
+	name    string
+	words   []string
+	verdict int
+}
+
+func (f wordFilter) Name() string {
+	return f.name
+}
+
+func (f wordFilter) Check(review *Review) (int, string) {
+	text := strings.ToLower(review.Text)
+	for _, w := range f.words {
+		if w != "" && strings.Contains(text, strings.ToLower(w)) {
+			return f.verdict, fmt.Sprintf("contains %q", w)
+		}
+	}
+	return moderationApprove, ""
+}
+
+var linkPattern = regexp.MustCompile(`(?i)https?://|www\.`)
+
+type linkFilter struct{}
+
+func (linkFilter) Name() string {
+	return "links"
+}
+
+func (linkFilter) Check(review *Review) (int, string) {
+	if linkPattern.MatchString(review.Text) {
+		return moderationHold, "contains a link"
+	}
+	return moderationApprove, ""
+}
+
+func buildReviewFilters(config ReviewModerationConfig) []ReviewFilter {
+	filters := []ReviewFilter{
+		wordFilter{name: "blocked_words", words: config.BlockedWords, verdict: moderationReject},
+		wordFilter{name: "held_words", words: config.HeldWords, verdict: moderationHold},
+	}
+	if config.HoldLinks {
+		filters = append(filters, linkFilter{})
+	}
+	return filters
+}
+
+// ReviewStore はレビューを椅子ごとに投稿順で持ち、確認待ちのものを管理者に返す
+type ReviewStore struct {
+	config  ReviewModerationConfig
+	filters []ReviewFilter
+	// 設定とは別に差し込まれたフィルタ。設定を変えても残る
+	extra   []ReviewFilter
+	reviews map[string]*Review
+	byChair map[string][]*Review
+	pending []*Review
+	mu      sync.Mutex
+}
+
+func NewReviewStore(config ReviewModerationConfig) *ReviewStore {
+	return &ReviewStore{
+		config:  config,
+		filters: buildReviewFilters(config),
+		extra:   []ReviewFilter{},
+		reviews: map[string]*Review{},
+		byChair: map[string][]*Review{},
+		pending: []*Review{},
+		mu:      sync.Mutex{},
+	}
+}
+
+var reviewStore = NewReviewStore(defaultReviewModerationConfig())
+
+// Reset はレビューをすべて捨てて設定を入れ替える。差し込まれたフィルタは残す
+func (s *ReviewStore) Reset(config ReviewModerationConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	s.filters = buildReviewFilters(config)
+	s.reviews = map[string]*Review{}
+	s.byChair = map[string][]*Review{}
+	s.pending = []*Review{}
+}
+
+func (s *ReviewStore) Config() ReviewModerationConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+// SetConfig は以降に投稿されるレビューに新しい設定を使う。確認待ちのレビューはそのまま
+func (s *ReviewStore) SetConfig(config ReviewModerationConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	s.filters = buildReviewFilters(config)
+}
+
+// RegisterFilter は外部の判定などのフィルタを後ろに追加する
+func (s *ReviewStore) RegisterFilter(filter ReviewFilter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.extra = append(s.extra, filter)
+}
+
+// moderate はフィルタを順に通し、どれかが却下すれば却下、保留すれば確認待ちにする
+func (s *ReviewStore) moderate(review *Review) {
+	review.Status = reviewStatusApproved
+	if review.Text == "" {
+		return
+	}
+	for _, f := range slices.Concat(s.filters, s.extra) {
+		verdict, reason := f.Check(review)
+		switch verdict {
+		case moderationReject:
+			review.Status = reviewStatusRejected
+			review.Reason = f.Name() + ": " + reason
+			return
+		case moderationHold:
+			if review.Status != reviewStatusPending {
+				review.Status = reviewStatusPending
+				review.Reason = f.Name() + ": " + reason
+			}
+		}
+	}
+}
+
+func (s *ReviewStore) Add(review *Review) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.moderate(review)
+	if review.Status != reviewStatusPending {
+		moderatedAt := review.CreatedAt
+		review.ModeratedAt = &moderatedAt
+	}
+	s.reviews[review.ID] = review
+	s.byChair[review.ChairID] = append(s.byChair[review.ChairID], review)
+	if review.Status == reviewStatusPending {
+		s.pending = append(s.pending, review)
+	}
+}
+
+func (s *ReviewStore) Pending() []Review {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reviews := make([]Review, 0, len(s.pending))
+	for _, r := range s.pending {
+		reviews = append(reviews, *r)
+	}
+	return reviews
+}
+
+// Moderate は確認待ちのレビューを管理者の判断で公開または却下する
+func (s *ReviewStore) Moderate(id string, approve bool, reason string, now time.Time) (Review, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	review, ok := s.reviews[id]
+	if !ok {
+		return Review{}, errReviewNotFound
+	}
+	if review.Status != reviewStatusPending {
+		return Review{}, errReviewModerated
+	}
+	review.Status = reviewStatusRejected
+	if approve {
+		review.Status = reviewStatusApproved
+	}
+	review.Reason = reason
+	review.ModeratedAt = &now
+	s.pending = slices.DeleteFunc(s.pending, func(r *Review) bool { return r.ID == id })
+	return *review, nil
+}
+
+// ChairReviews は公開済みのレビューを新しい順に offset 件目から limit 件返す
+func (s *ReviewStore) ChairReviews(chairID string, offset, limit int) ([]Review, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	approved := []*Review{}
+	for _, r := range s.byChair[chairID] {
+		if r.Status == reviewStatusApproved {
+			approved = append(approved, r)
+		}
+	}
+	reviews := []Review{}
+	for i := len(approved) - 1 - offset; i >= 0 && len(reviews) < limit; i-- {
+		reviews = append(reviews, *approved[i])
+	}
+	return reviews, len(approved)
+}
+
+func toReviewResponse(r Review) reviewResponse {
+	res := reviewResponse{
+		ID:         r.ID,
+		RideID:     r.RideID,
+		ChairID:    r.ChairID,
+		Evaluation: r.Evaluation,
+		Review:     r.Text,
+		Tags:       r.Tags,
+		Status:     r.Status,
+		Reason:     r.Reason,
+		CreatedAt:  r.CreatedAt.UnixMilli(),
+	}
+	if res.Tags == nil {
+		res.Tags = []string{}
+	}
+	if r.ModeratedAt != nil {
+		moderatedAt := r.ModeratedAt.UnixMilli()
+		res.ModeratedAt = &moderatedAt
+	}
+	return res
+}
+
+func postReview(ride *Ride, text string, tags []string, now time.Time) *Review {
+	if text == "" && len(tags) == 0 {
+		return nil
+	}
+	review := &Review{
+		ID:         ulid.Make().String(),
+		RideID:     ride.ID,
+		ChairID:    ride.ChairID.String,
+		UserID:     ride.UserID,
+		Evaluation: *ride.Evaluation,
+		Text:       strings.TrimSpace(text),
+		Tags:       slices.Compact(slices.Sorted(slices.Values(tags))),
+		CreatedAt:  now,
+	}
+	reviewStore.Add(review)
+	return review
+}
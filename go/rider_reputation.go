@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	riderPolicyOff          = "off"
+	riderPolicyDeprioritize = "deprioritize"
+	riderPolicyExclude      = "exclude"
+)
+
+// RiderPolicy はオーナーが評価の低い利用者を自分の椅子にどう割り当てるかの設定
+type RiderPolicy struct {
+	Mode string `json:"mode"`
+	// 評価の平均がこれより低い利用者を対象にする
+	MinRating float64 `json:"min_rating"`
+	// 評価の件数がこれより少ない利用者は対象にしない
+	MinCount int `json:"min_count"`
+	// deprioritize のとき、マッチングで椅子から乗車地点までの距離に加える値
+	PenaltyDistance int `json:"penalty_distance"`
+}
+
+func validateRiderPolicy(policy RiderPolicy) error {
+	switch policy.Mode {
+	case riderPolicyOff, riderPolicyDeprioritize, riderPolicyExclude:
+	default:
+		return errors.New("mode must be one of off, deprioritize, exclude")
+	}
+	if policy.MinRating < 0 || policy.MinRating > maxChairEvaluation {
+		return errors.New("min_rating must be between 0 and 5")
+	}
+	if policy.MinCount < 0 || policy.PenaltyDistance < 0 {
+		return errors.New("min_count and penalty_distance must not be negative")
+	}
+	return nil
+}
+
+// RiderReputation は椅子が利用者につけた評価の集計
+type RiderReputation struct {
+	count     int
+	sum       int
+	histogram [maxChairEvaluation]int
+	mu        sync.RWMutex
+}
+
+func (r *RiderReputation) Add(evaluation int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.count++
+	r.sum += evaluation
+	r.histogram[evaluation-1]++
+}
+
+func (r *RiderReputation) Summary() (int, float64, [maxChairEvaluation]int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.count == 0 {
+		return 0, 0, r.histogram
+	}
+	return r.count, float64(r.sum) / float64(r.count), r.histogram
+}
+
+var riderEvaluationMu sync.Mutex
+
+// evaluateRider は椅子の評価をライドに記録して利用者の集計に加える。評価済みなら false
+func evaluateRider(ride *Ride, evaluation int) bool {
+	riderEvaluationMu.Lock()
+	defer riderEvaluationMu.Unlock()
+	if ride.RiderEvaluation != nil {
+		return false
+	}
+	ride.RiderEvaluation = &evaluation
+	getRiderReputation(ride.UserID).Add(evaluation)
+	return true
+}
+
+// lowRated は利用者がオーナーの設定で評価が低いとされるかを返す
+func (p RiderPolicy) lowRated(userID string) bool {
+	if p.Mode == riderPolicyOff || p.Mode == "" {
+		return false
+	}
+	count, average, _ := getRiderReputation(userID).Summary()
+	return count > 0 && count >= p.MinCount && average < p.MinRating
+}
+
+// riderPenalty はオーナーの設定に従い、椅子に利用者を割り当ててよいかとマッチングでの不利の大きさを返す
+func riderPenalty(ride *Ride, chair *Chair) (bool, int) {
+	policy := getOwnerRiderPolicy(chair.OwnerID)
+	if !policy.lowRated(ride.UserID) {
+		return true, 0
+	}
+	if policy.Mode == riderPolicyExclude {
+		return false, 0
+	}
+	return true, policy.PenaltyDistance
+}
+
+// matchAllowed は利用者の指定とオーナーの設定の両方から、ライドに椅子を割り当ててよいかを返す
+func matchAllowed(ride *Ride, chair *Chair, now time.Time) bool {
+	if !rideAcceptsChair(ride, chair, now) {
+		return false
+	}
+	allowed, _ := riderPenalty(ride, chair)
+	return allowed
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 売上は 15 分単位のバケットに集計する。UTC からのずれが 15 分単位でないタイムゾーンはないため、
+// どのタイムゾーンの時・日・週の境界もバケットの境界に一致する
+const salesBucketSize = int64(15 * time.Minute / time.Millisecond)
+
+const maxSalesSeriesBuckets = 5000
+
+const (
+	salesGranularityHour = "hour"
+	salesGranularityDay  = "day"
+	salesGranularityWeek = "week"
+)
+
+var errTooManySalesBuckets = errors.New("too many buckets; narrow the range or use a coarser granularity")
+
+type salesPoint struct {
+	at     int64
+	amount int
+}
+
+type salesBucket struct {
+	start  int64
+	total  int
+	points []salesPoint
+}
+
+// ChairSalesSeries は 1 脚分の売上を時刻順のバケットで保持する
+type ChairSalesSeries struct {
+	buckets []*salesBucket
+	mu      sync.RWMutex
+}
+
+func NewChairSalesSeries() *ChairSalesSeries {
+	return &ChairSalesSeries{
+		buckets: []*salesBucket{},
+		mu:      sync.RWMutex{},
+	}
+}
+
+func floorSalesBucket(at int64) int64 {
+	b := at / salesBucketSize * salesBucketSize
+	if at < 0 && at%salesBucketSize != 0 {
+		b -= salesBucketSize
+	}
+	return b
+}
+
+func (s *ChairSalesSeries) search(start int64) (int, bool) {
+	return slices.BinarySearchFunc(s.buckets, start, func(b *salesBucket, t int64) int {
+		switch {
+		case b.start < t:
+			return -1
+		case b.start > t:
+			return 1
+		}
+		return 0
+	})
+}
+
+func (s *ChairSalesSeries) Add(at time.Time, amount int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms := at.UnixMilli()
+	start := floorSalesBucket(ms)
+	i, ok := s.search(start)
+	if !ok {
+		s.buckets = slices.Insert(s.buckets, i, &salesBucket{start: start})
+	}
+	b := s.buckets[i]
+	b.total += amount
+	b.points = append(b.points, salesPoint{at: ms, amount: amount})
+}
+
+// Each は [since, until] に入る売上を、バケット単位でまとめて fn に渡す。
+// 範囲の両端にかかるバケットだけは個々の売上を見て絞り込む
+func (s *ChairSalesSeries) Each(since, until int64, fn func(bucketStart int64, amount int)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, _ := s.search(floorSalesBucket(since))
+	for ; i < len(s.buckets); i++ {
+		b := s.buckets[i]
+		if b.start > until {
+			return
+		}
+		if b.start >= since && b.start+salesBucketSize-1 <= until {
+			fn(b.start, b.total)
+			continue
+		}
+		sum := 0
+		for _, p := range b.points {
+			if p.at >= since && p.at <= until {
+				sum += p.amount
+			}
+		}
+		fn(b.start, sum)
+	}
+}
+
+func (s *ChairSalesSeries) Sum(since, until time.Time) int {
+	sum := 0
+	s.Each(since.UnixMilli(), until.UnixMilli(), func(_ int64, amount int) {
+		sum += amount
+	})
+	return sum
+}
+
+// salesSeriesBoundaries は location での時・日・週の区切りを [since, until] の範囲で返す
+func salesSeriesBoundaries(granularity string, location *time.Location, since, until time.Time) ([]time.Time, error) {
+	local := since.In(location)
+	var start time.Time
+	var next func(time.Time) time.Time
+	switch granularity {
+	case salesGranularityHour:
+		start = time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), 0, 0, 0, location)
+		next = func(t time.Time) time.Time { return t.Add(time.Hour) }
+	case salesGranularityDay:
+		start = time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	case salesGranularityWeek:
+		start = time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }
+	default:
+		return nil, errors.New("granularity must be one of hour, day, week")
+	}
+	boundaries := []time.Time{start}
+	for t := start; !t.After(until); {
+		t = next(t)
+		boundaries = append(boundaries, t)
+		if len(boundaries) > maxSalesSeriesBuckets+1 {
+			return nil, errTooManySalesBuckets
+		}
+	}
+	return boundaries, nil
+}
+
+type SalesSeriesBucket struct {
+	Start  time.Time
+	End    time.Time
+	Total  int
+	Chairs map[string]int
+	Models map[string]int
+}
+
+func buildSalesSeries(chairs []*Chair, granularity string, location *time.Location, since, until time.Time) ([]*SalesSeriesBucket, error) {
+	boundaries, err := salesSeriesBoundaries(granularity, location, since, until)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]*SalesSeriesBucket, len(boundaries)-1)
+	for i := range buckets {
+		buckets[i] = &SalesSeriesBucket{
+			Start:  boundaries[i],
+			End:    boundaries[i+1],
+			Chairs: map[string]int{},
+			Models: map[string]int{},
+		}
+	}
+	for _, chair := range chairs {
+		series := ledger.ChairSalesSeries(chair.ID)
+		if series == nil {
+			continue
+		}
+		series.Each(since.UnixMilli(), until.UnixMilli(), func(bucketStart int64, amount int) {
+			i, found := slices.BinarySearchFunc(boundaries, bucketStart, func(t time.Time, target int64) int {
+				switch ms := t.UnixMilli(); {
+				case ms < target:
+					return -1
+				case ms > target:
+					return 1
+				}
+				return 0
+			})
+			if !found {
+				i--
+			}
+			if i < 0 || i >= len(buckets) {
+				return
+			}
+			buckets[i].Total += amount
+			buckets[i].Chairs[chair.ID] += amount
+			buckets[i].Models[chair.Model] += amount
+		})
+	}
+	return buckets, nil
+}
+
+func salesSeriesCSV(chairs []*Chair, buckets []*SalesSeriesBucket) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	records := [][]string{{"bucket_start", "bucket_end", "chair_id", "chair_name", "model", "sales"}}
+	for _, b := range buckets {
+		for _, chair := range chairs {
+			records = append(records, []string{
+				b.Start.Format(time.RFC3339),
+				b.End.Format(time.RFC3339),
+				chair.ID,
+				chair.Name,
+				chair.Model,
+				strconv.Itoa(b.Chairs[chair.ID]),
+			})
+		}
+	}
+	if err := w.WriteAll(records); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
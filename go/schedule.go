@@ -0,0 +1,449 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const scheduleSettingName = "schedule_config"
+
+const (
+	scheduledRideStatusScheduled = "SCHEDULED"
+	scheduledRideStatusReleased  = "RELEASED"
+	scheduledRideStatusCanceled  = "CANCELED"
+	scheduledRideStatusExpired   = "EXPIRED"
+)
+
+const (
+	scheduleEventReminder = "REMINDER"
+	scheduleEventReleased = "RELEASED"
+	scheduleEventExpired  = "EXPIRED"
+)
+
+var (
+	errScheduledRideNotFound = errors.New("scheduled ride not found")
+	errScheduledRideClosed   = errors.New("scheduled ride has already been released or canceled")
+)
+
+type ScheduleConfig struct {
+	// 乗車時刻のこの秒数前に配車待ちに入れる
+	LeadTimeSeconds int `json:"lead_time_seconds"`
+	// 配車待ちに入れるさらにこの秒数前に、乗車地点の近くの空き椅子を確保する。0 なら確保しない
+	PrepositionSeconds int `json:"preposition_seconds"`
+	// 乗車時刻の何秒前に利用者に通知するか
+	ReminderSeconds []int `json:"reminder_seconds"`
+	MaxAdvanceHours int   `json:"max_advance_hours"`
+}
+
+func defaultScheduleConfig() ScheduleConfig {
+	return ScheduleConfig{
+		LeadTimeSeconds:    300,
+		PrepositionSeconds: 120,
+		ReminderSeconds:    []int{3600, 900},
+		MaxAdvanceHours:    7 * 24,
+	}
+}
+
+func validateScheduleConfig(config ScheduleConfig) error {
+	if config.LeadTimeSeconds < 0 || config.PrepositionSeconds < 0 {
+		return errors.New("lead_time_seconds and preposition_seconds must not be negative")
+	}
+	for _, s := range config.ReminderSeconds {
+		if s <= 0 {
+			return errors.New("reminder_seconds must be positive")
+		}
+	}
+	if config.MaxAdvanceHours <= 0 {
+		return errors.New("max_advance_hours must be positive")
+	}
+	return nil
+}
+
+func loadScheduleConfig(ctx context.Context) (ScheduleConfig, error) {
+	config := defaultScheduleConfig()
+	found, err := getJSONSetting(ctx, scheduleSettingName, &config)
+	if err != nil || !found {
+		return config, err
+	}
+	return config, validateScheduleConfig(config)
+}
+
+type ScheduledRide struct {
+	ID              string
+	UserID          string
+	RideID          string
+	Pickup          Coordinate
+	Destination     Coordinate
+	Waypoints       []Coordinate
+	ChairClass      string
+	PickupAt        time.Time
+	Status          string
+	EstimatedFare   FareBreakdown
+	ReservedChairID string
+	CreatedAt       time.Time
+	ReleasedAt      *time.Time
+
+	remindersSent []int
+	prepositioned bool
+	nextEventAt   time.Time
+	index         int
+}
+
+func (r *ScheduledRide) releaseAt(config ScheduleConfig) time.Time {
+	return r.PickupAt.Add(-time.Duration(config.LeadTimeSeconds) * time.Second)
+}
+
+func (r *ScheduledRide) prepositionAt(config ScheduleConfig) time.Time {
+	return r.releaseAt(config).Add(-time.Duration(config.PrepositionSeconds) * time.Second)
+}
+
+// nextEvent は通知・椅子の確保・配車待ちへの投入のうち、次に行うものの時刻を返す
+func (r *ScheduledRide) nextEvent(config ScheduleConfig) time.Time {
+	next := r.releaseAt(config)
+	if !r.prepositioned && config.PrepositionSeconds > 0 {
+		next = minTime(next, r.prepositionAt(config))
+	}
+	for _, s := range config.ReminderSeconds {
+		if !slices.Contains(r.remindersSent, s) {
+			next = minTime(next, r.PickupAt.Add(-time.Duration(s)*time.Second))
+		}
+	}
+	return next
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+type scheduleQueue []*ScheduledRide
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].nextEventAt.Before(q[j].nextEventAt) }
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *scheduleQueue) Push(x any) {
+	r := x.(*ScheduledRide)
+	r.index = len(*q)
+	*q = append(*q, r)
+}
+func (q *scheduleQueue) Pop() any {
+	old := *q
+	r := old[len(old)-1]
+	old[len(old)-1] = nil
+	r.index = -1
+	*q = old[:len(old)-1]
+	return r
+}
+
+// ScheduledRides は予約ライドを次のイベントの時刻順に並べて持つ
+type ScheduledRides struct {
+	config   ScheduleConfig
+	queue    scheduleQueue
+	byID     map[string]*ScheduledRide
+	byUser   map[string][]*ScheduledRide
+	reserved map[string]string
+	mu       sync.Mutex
+}
+
+func NewScheduledRides(config ScheduleConfig) *ScheduledRides {
+	return &ScheduledRides{
+		config:   config,
+		queue:    scheduleQueue{},
+		byID:     map[string]*ScheduledRide{},
+		byUser:   map[string][]*ScheduledRide{},
+		reserved: map[string]string{},
+		mu:       sync.Mutex{},
+	}
+}
+
+var scheduledRides = NewScheduledRides(defaultScheduleConfig())
+
+// Reset は予約ライドをすべて捨てて設定を入れ替える
+func (s *ScheduledRides) Reset(config ScheduleConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	s.queue = scheduleQueue{}
+	s.byID = map[string]*ScheduledRide{}
+	s.byUser = map[string][]*ScheduledRide{}
+	s.reserved = map[string]string{}
+}
+
+func (s *ScheduledRides) Config() ScheduleConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+func (s *ScheduledRides) SetConfig(config ScheduleConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	for _, r := range s.queue {
+		r.nextEventAt = r.nextEvent(config)
+	}
+	heap.Init(&s.queue)
+}
+
+func (s *ScheduledRides) Add(r *ScheduledRide) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 予約した時点で過ぎている通知は送らない
+	for _, sec := range s.config.ReminderSeconds {
+		if !r.PickupAt.Add(-time.Duration(sec) * time.Second).After(r.CreatedAt) {
+			r.remindersSent = append(r.remindersSent, sec)
+		}
+	}
+	r.nextEventAt = r.nextEvent(s.config)
+	heap.Push(&s.queue, r)
+	s.byID[r.ID] = r
+	s.byUser[r.UserID] = append(s.byUser[r.UserID], r)
+}
+
+func (s *ScheduledRides) Get(id string) (*ScheduledRide, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.byID[id]
+	return r, ok
+}
+
+func (s *ScheduledRides) ListByUser(userID string) []ScheduledRide {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rides := []ScheduledRide{}
+	for _, r := range s.byUser[userID] {
+		rides = append(rides, *r)
+	}
+	slices.SortFunc(rides, func(a, b ScheduledRide) int {
+		return a.PickupAt.Compare(b.PickupAt)
+	})
+	return rides
+}
+
+// IsReserved は椅子が予約ライドのために確保されているかを返す
+func (s *ScheduledRides) IsReserved(chairID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.reserved[chairID]
+	return ok
+}
+
+func (s *ScheduledRides) Cancel(userID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.byID[id]
+	if !ok || r.UserID != userID {
+		return errScheduledRideNotFound
+	}
+	if r.Status != scheduledRideStatusScheduled {
+		return errScheduledRideClosed
+	}
+	r.Status = scheduledRideStatusCanceled
+	heap.Remove(&s.queue, r.index)
+	s.releaseChair(r)
+	return nil
+}
+
+// releaseChair は確保していた椅子を空き椅子に戻す
+func (s *ScheduledRides) releaseChair(r *ScheduledRide) {
+	if r.ReservedChairID == "" {
+		return
+	}
+	delete(s.reserved, r.ReservedChairID)
+	if chair, ok := getChair(r.ReservedChairID); ok && chair.IsActive && chairDispatchable(chair) {
+		freeChairs.Add(chair)
+	}
+	r.ReservedChairID = ""
+}
+
+type scheduleAction struct {
+	ride     ScheduledRide
+	event    string
+	chairID  string
+	reminder int
+}
+
+// Tick は時刻が来たイベントを処理し、通知や配車待ちへの投入を呼び出し側に返す。
+// 椅子の確保は mu を取るので、s.mu を放してから行う
+func (s *ScheduledRides) Tick(now time.Time) []scheduleAction {
+	actions, prepositions := s.due(now)
+	for _, id := range prepositions {
+		s.preposition(id)
+	}
+	return actions
+}
+
+// due は時刻が来たイベントを取り出す。椅子を確保する予約ライドは ID だけを返す
+func (s *ScheduledRides) due(now time.Time) ([]scheduleAction, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	actions := []scheduleAction{}
+	prepositions := []string{}
+	for len(s.queue) > 0 && !s.queue[0].nextEventAt.After(now) {
+		r := s.queue[0]
+		switch {
+		case !r.releaseAt(s.config).After(now):
+			heap.Pop(&s.queue)
+			r.Status = scheduledRideStatusReleased
+			r.ReleasedAt = &now
+			r.RideID = ulid.Make().String()
+			chairID := r.ReservedChairID
+			delete(s.reserved, chairID)
+			r.ReservedChairID = ""
+			actions = append(actions, scheduleAction{ride: *r, event: scheduleEventReleased, chairID: chairID})
+			continue
+		case !r.prepositioned && s.config.PrepositionSeconds > 0 && !r.prepositionAt(s.config).After(now):
+			r.prepositioned = true
+			prepositions = append(prepositions, r.ID)
+		default:
+			for _, sec := range s.config.ReminderSeconds {
+				if !slices.Contains(r.remindersSent, sec) && !r.PickupAt.Add(-time.Duration(sec)*time.Second).After(now) {
+					r.remindersSent = append(r.remindersSent, sec)
+					actions = append(actions, scheduleAction{ride: *r, event: scheduleEventReminder, reminder: sec})
+				}
+			}
+		}
+		r.nextEventAt = r.nextEvent(s.config)
+		heap.Fix(&s.queue, r.index)
+	}
+	return actions, prepositions
+}
+
+// preposition は予約ライドの乗車地点の近くの空き椅子を確保する。
+// マッチングと同じロックを取り、同じ椅子を二重に割り当てないようにする
+func (s *ScheduledRides) preposition(id string) {
+	mu.Lock()
+	defer mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.byID[id]
+	// ロックを放している間に投入・取り消しされたものは確保しない
+	if !ok || r.Status != scheduledRideStatusScheduled || r.ReservedChairID != "" {
+		return
+	}
+	if chairID, ok := reserveNearestChair(r.Pickup, s.reserved); ok {
+		r.ReservedChairID = chairID
+		s.reserved[chairID] = r.ID
+	}
+}
+
+// Expire は利用者が別のライド中で投入できなかった予約ライドを失効させる
+func (s *ScheduledRides) Expire(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.byID[id]; ok {
+		r.Status = scheduledRideStatusExpired
+	}
+}
+
+// reserveNearestChair は乗車地点に最も近い空き椅子を空き椅子から外して返す。mu を取って呼ぶ
+func reserveNearestChair(pickup Coordinate, reserved map[string]string) (string, bool) {
+	freeChairs.Lock()
+	chairs := freeChairs.List()
+	freeChairs.Unlock()
+	best, bestDistance := "", -1
+	for _, c := range chairs {
+		if _, ok := reserved[c.ID]; ok {
+			continue
+		}
+		l, ok := getLatestChairLocation(c.ID)
+		if !ok {
+			continue
+		}
+		d := calculateDistance(l.Latitude, l.Longitude, pickup.Latitude, pickup.Longitude)
+		if bestDistance < 0 || d < bestDistance {
+			best, bestDistance = c.ID, d
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	freeChairs.Remove(best)
+	return best, true
+}
+
+// releaseScheduledRide は予約ライドを通常のライドとして登録する。
+// 確保した椅子がまだ使えればそのまま割り当て、使えなければ配車待ちに入れる
+func releaseScheduledRide(r ScheduledRide, chairID string, now time.Time) {
+	if isFree, _ := getUserRideStatus(r.UserID); !isFree {
+		scheduledRides.Expire(r.ID)
+		if chair, ok := getChair(chairID); ok && chair.IsActive && chairDispatchable(chair) {
+			freeChairs.Add(chair)
+		}
+		publishAppChan(r.UserID, &Notif{Scheduled: &r, ScheduleEvent: scheduleEventExpired})
+		return
+	}
+	ride := &Ride{
+		ID:                   r.RideID,
+		UserID:               r.UserID,
+		PickupLatitude:       r.Pickup.Latitude,
+		PickupLongitude:      r.Pickup.Longitude,
+		DestinationLatitude:  r.Destination.Latitude,
+		DestinationLongitude: r.Destination.Longitude,
+		Waypoints:            r.Waypoints,
+		ChairClass:           r.ChairClass,
+		CreatedAt:            now,
+		UpdatedAt:            now,
+	}
+	// 見積もりを使わないので失敗しない
+	_ = prepareRide(ride, nil, now)
+	chair, ok := getChair(chairID)
+	if !ok || !chair.IsActive || !chairDispatchable(chair) || chairOnRide(chairID) {
+		waitingRides.Add(ride)
+		processRideStatus(ride, "MATCHING")
+		return
+	}
+	processRideStatus(ride, "MATCHING")
+	mu.Lock()
+	defer mu.Unlock()
+	assignRide(ride, chairID)
+}
+
+func toAppScheduledRide(r *ScheduledRide, event string) appScheduledRide {
+	return appScheduledRide{
+		ID:                    r.ID,
+		RideID:                r.RideID,
+		PickupCoordinate:      r.Pickup,
+		DestinationCoordinate: r.Destination,
+		Waypoints:             r.Waypoints,
+		PickupAt:              r.PickupAt.UnixMilli(),
+		Status:                r.Status,
+		EstimatedFare:         r.EstimatedFare.Total,
+		Event:                 event,
+		CreatedAt:             r.CreatedAt.UnixMilli(),
+	}
+}
+
+func startScheduleLoop() {
+	ticker := time.NewTicker(1 * time.Second)
+	for now := range ticker.C {
+		for _, a := range scheduledRides.Tick(now) {
+			switch a.event {
+			case scheduleEventReleased:
+				go releaseScheduledRide(a.ride, a.chairID, now)
+			case scheduleEventReminder:
+				go publishAppChan(a.ride.UserID, &Notif{Scheduled: &a.ride, ScheduleEvent: scheduleEventReminder})
+			default:
+				slog.Error("unknown schedule event",
+					"event", a.event,
+					"scheduled_ride_id", a.ride.ID,
+					"user_id", a.ride.UserID,
+					"chair_id", a.chairID,
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/bytedance/sonic"
+)
+
+// getJSONSetting は settings テーブルの JSON の値を v に読み込む。行がなければ false を返す
+func getJSONSetting(ctx context.Context, name string, v any) (bool, error) {
+	value := ""
+	err := db.GetContext(ctx, &value, "SELECT value FROM settings WHERE name = ?", name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := sonic.Unmarshal([]byte(value), v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func putJSONSetting(ctx context.Context, name string, v any) error {
+	value, err := sonic.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO settings (name, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)", name, string(value))
+	return err
+}
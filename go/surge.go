@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+const surgeSettingName = "surge_config"
+
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type SurgeConfig struct {
+	Enabled bool `json:"enabled"`
+	// 需給を集計するグリッドの一辺の長さ
+	ZoneSize int `json:"zone_size"`
+	// 待ちライド数/空き椅子数 が 1 を超えた分に掛ける係数
+	Sensitivity   float64 `json:"sensitivity"`
+	MinMultiplier float64 `json:"min_multiplier"`
+	MaxMultiplier float64 `json:"max_multiplier"`
+	// 目標倍率との差が半分になるまでの秒数
+	HalfLifeSeconds float64 `json:"half_life_seconds"`
+}
+
+func defaultSurgeConfig() SurgeConfig {
+	return SurgeConfig{
+		Enabled:         false,
+		ZoneSize:        50,
+		Sensitivity:     0.5,
+		MinMultiplier:   1.0,
+		MaxMultiplier:   2.0,
+		HalfLifeSeconds: 30,
+	}
+}
+
+func validateSurgeConfig(config SurgeConfig) error {
+	if config.ZoneSize <= 0 {
+		return errors.New("zone_size must be positive")
+	}
+	if config.Sensitivity < 0 {
+		return errors.New("sensitivity must not be negative")
+	}
+	if config.MinMultiplier < 1 || config.MaxMultiplier < config.MinMultiplier {
+		return errors.New("multipliers must satisfy 1 <= min_multiplier <= max_multiplier")
+	}
+	if config.HalfLifeSeconds < 0 {
+		return errors.New("half_life_seconds must not be negative")
+	}
+	return nil
+}
+
+type SurgeZone struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type surgeZoneState struct {
+	multiplier float64
+	demand     int
+	supply     int
+	updatedAt  time.Time
+}
+
+type SurgeZoneStatus struct {
+	Zone       SurgeZone `json:"zone"`
+	Multiplier float64   `json:"multiplier"`
+	Demand     int       `json:"demand"`
+	Supply     int       `json:"supply"`
+	Overridden bool      `json:"overridden"`
+}
+
+// surgeOverride は管理者が決めた倍率。expiresAt がゼロなら解除するまで続く
+type surgeOverride struct {
+	multiplier float64
+	expiresAt  time.Time
+}
+
+func (o surgeOverride) activeAt(now time.Time) bool {
+	return o.multiplier > 0 && (o.expiresAt.IsZero() || now.Before(o.expiresAt))
+}
+
+type SurgePricer struct {
+	clock          Clock
+	config         SurgeConfig
+	zones          map[SurgeZone]*surgeZoneState
+	overrides      map[SurgeZone]surgeOverride
+	globalOverride surgeOverride
+	mu             sync.RWMutex
+}
+
+var surgePricer = NewSurgePricer(systemClock{}, defaultSurgeConfig())
+
+func NewSurgePricer(clock Clock, config SurgeConfig) *SurgePricer {
+	return &SurgePricer{
+		clock:     clock,
+		config:    config,
+		zones:     map[SurgeZone]*surgeZoneState{},
+		overrides: map[SurgeZone]surgeOverride{},
+	}
+}
+
+func (s *SurgePricer) Config() SurgeConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// Reset は観測と上書きを捨てて設定を入れ替える
+func (s *SurgePricer) Reset(config SurgeConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	s.zones = map[SurgeZone]*surgeZoneState{}
+	s.overrides = map[SurgeZone]surgeOverride{}
+	s.globalOverride = surgeOverride{}
+}
+
+func (s *SurgePricer) SetConfig(config SurgeConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if config.ZoneSize != s.config.ZoneSize {
+		s.zones = map[SurgeZone]*surgeZoneState{}
+		s.overrides = map[SurgeZone]surgeOverride{}
+	}
+	s.config = config
+}
+
+func (s *SurgePricer) ZoneOf(latitude, longitude int) SurgeZone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.zoneOf(latitude, longitude)
+}
+
+func (s *SurgePricer) zoneOf(latitude, longitude int) SurgeZone {
+	size := s.config.ZoneSize
+	return SurgeZone{
+		X: int(math.Floor(float64(latitude) / float64(size))),
+		Y: int(math.Floor(float64(longitude) / float64(size))),
+	}
+}
+
+func (s *SurgePricer) target(demand, supply int) float64 {
+	ratio := float64(demand) / float64(max(supply, 1))
+	target := 1 + s.config.Sensitivity*max(ratio-1, 0)
+	return min(max(target, s.config.MinMultiplier), s.config.MaxMultiplier)
+}
+
+// Observe は現在の待ちライドと空き椅子の位置から各ゾーンの倍率を指数平滑で更新する
+func (s *SurgePricer) Observe(demand, supply []Location) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+
+	demandByZone := map[SurgeZone]int{}
+	for _, l := range demand {
+		demandByZone[s.zoneOf(l.Latitude, l.Longitude)]++
+	}
+	supplyByZone := map[SurgeZone]int{}
+	for _, l := range supply {
+		supplyByZone[s.zoneOf(l.Latitude, l.Longitude)]++
+	}
+	for zone := range demandByZone {
+		if _, ok := s.zones[zone]; !ok {
+			s.zones[zone] = &surgeZoneState{multiplier: s.config.MinMultiplier, updatedAt: now}
+		}
+	}
+
+	for zone, state := range s.zones {
+		state.demand = demandByZone[zone]
+		state.supply = supplyByZone[zone]
+		target := s.target(state.demand, state.supply)
+		alpha := 1.0
+		if s.config.HalfLifeSeconds > 0 {
+			elapsed := now.Sub(state.updatedAt).Seconds()
+			alpha = 1 - math.Pow(0.5, elapsed/s.config.HalfLifeSeconds)
+		}
+		state.multiplier += alpha * (target - state.multiplier)
+		state.updatedAt = now
+		// 需要がなく倍率も戻りきったゾーンは捨てる
+		if state.demand == 0 && state.multiplier-s.config.MinMultiplier < 0.001 {
+			delete(s.zones, zone)
+		}
+	}
+}
+
+// Multiplier は管理者の上書き、平滑化された倍率の順に見て、小数第2位に丸めた倍率を返す
+func (s *SurgePricer) Multiplier(latitude, longitude int) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	zone := s.zoneOf(latitude, longitude)
+	now := s.clock.Now()
+	if o, ok := s.overrides[zone]; ok && o.activeAt(now) {
+		return o.multiplier
+	}
+	if s.globalOverride.activeAt(now) {
+		return s.globalOverride.multiplier
+	}
+	if !s.config.Enabled {
+		return 1
+	}
+	state, ok := s.zones[zone]
+	if !ok {
+		return s.config.MinMultiplier
+	}
+	return math.Round(state.multiplier*100) / 100
+}
+
+// zone が nil のときは全ゾーンを上書きする。multiplier が 0 なら上書きを解除する。
+// duration が 0 より大きければ、その時間が経ったところで上書きは切れる
+func (s *SurgePricer) Override(zone *SurgeZone, multiplier float64, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := surgeOverride{multiplier: multiplier}
+	if duration > 0 {
+		o.expiresAt = s.clock.Now().Add(duration)
+	}
+	if zone == nil {
+		s.globalOverride = o
+		return
+	}
+	if multiplier == 0 {
+		delete(s.overrides, *zone)
+		return
+	}
+	s.overrides[*zone] = o
+}
+
+func (s *SurgePricer) Status() []SurgeZoneStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := s.clock.Now()
+	res := []SurgeZoneStatus{}
+	for zone, state := range s.zones {
+		o, ok := s.overrides[zone]
+		res = append(res, SurgeZoneStatus{
+			Zone:       zone,
+			Multiplier: math.Round(state.multiplier*100) / 100,
+			Demand:     state.demand,
+			Supply:     state.supply,
+			Overridden: (ok && o.activeAt(now)) || s.globalOverride.activeAt(now),
+		})
+	}
+	for zone, o := range s.overrides {
+		if _, ok := s.zones[zone]; ok || !o.activeAt(now) {
+			continue
+		}
+		res = append(res, SurgeZoneStatus{
+			Zone:       zone,
+			Multiplier: o.multiplier,
+			Overridden: true,
+		})
+	}
+	return res
+}
+
+func loadSurgeConfig(ctx context.Context) (SurgeConfig, error) {
+	config := defaultSurgeConfig()
+	found, err := getJSONSetting(ctx, surgeSettingName, &config)
+	if err != nil || !found {
+		return config, err
+	}
+	return config, validateSurgeConfig(config)
+}
+
+func observeSurge() {
+	demand := []Location{}
+	for _, r := range waitingRides.List() {
+		demand = append(demand, Location{Latitude: r.PickupLatitude, Longitude: r.PickupLongitude})
+	}
+	freeChairs.Lock()
+	chairs := freeChairs.List()
+	freeChairs.Unlock()
+	supply := []Location{}
+	for _, c := range chairs {
+		if l, ok := getLatestChairLocation(c.ID); ok {
+			supply = append(supply, Location{Latitude: l.Latitude, Longitude: l.Longitude})
+		}
+	}
+	surgePricer.Observe(demand, supply)
+}
+
+func startSurgeLoop() {
+	ticker := time.NewTicker(1 * time.Second)
+	for range ticker.C {
+		observeSurge()
+	}
+}
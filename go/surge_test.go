@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestSurgePricer(config SurgeConfig) (*SurgePricer, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 12, 8, 10, 0, 0, 0, time.UTC)}
+	return NewSurgePricer(clock, config), clock
+}
+
+func testSurgeConfig() SurgeConfig {
+	return SurgeConfig{
+		Enabled:         true,
+		ZoneSize:        50,
+		Sensitivity:     0.5,
+		MinMultiplier:   1,
+		MaxMultiplier:   3,
+		HalfLifeSeconds: 30,
+	}
+}
+
+func repeatLocation(l Location, n int) []Location {
+	locations := make([]Location, n)
+	for i := range locations {
+		locations[i] = l
+	}
+	return locations
+}
+
+func assertMultiplier(t *testing.T, s *SurgePricer, l Location, want float64) {
+	t.Helper()
+	if got := s.Multiplier(l.Latitude, l.Longitude); math.Abs(got-want) > 1e-9 {
+		t.Fatalf("Multiplier(%d, %d) = %v, want %v", l.Latitude, l.Longitude, got, want)
+	}
+}
+
+func TestSurgePricerSmoothing(t *testing.T) {
+	s, clock := newTestSurgePricer(testSurgeConfig())
+	pickup := Location{Latitude: 10, Longitude: 10}
+	// 待ち 5 件に空き椅子 1 台なので、目標の倍率は 1 + 0.5*(5-1) = 3
+	demand := repeatLocation(pickup, 5)
+	supply := []Location{{Latitude: 20, Longitude: 20}}
+
+	// 最初の観測では時間が経っていないので倍率は最小のまま
+	s.Observe(demand, supply)
+	assertMultiplier(t, s, pickup, 1)
+
+	// 半減期ごとに目標との差が半分になる
+	clock.Advance(30 * time.Second)
+	s.Observe(demand, supply)
+	assertMultiplier(t, s, pickup, 2)
+
+	clock.Advance(30 * time.Second)
+	s.Observe(demand, supply)
+	assertMultiplier(t, s, pickup, 2.5)
+
+	// 半減期 2 回分の間隔なら差は 1/4 になる: 2.5 + (3-2.5)*0.75 = 2.875
+	clock.Advance(60 * time.Second)
+	s.Observe(demand, supply)
+	assertMultiplier(t, s, pickup, 2.88)
+
+	// 需要がなくなると同じ速さで最小に戻っていく: 2.875 - (2.875-1)*0.5 = 1.9375
+	clock.Advance(30 * time.Second)
+	s.Observe(nil, supply)
+	assertMultiplier(t, s, pickup, 1.94)
+
+	// 戻りきったゾーンは捨てられ、最小の倍率になる
+	clock.Advance(30 * time.Minute)
+	s.Observe(nil, supply)
+	if status := s.Status(); len(status) != 0 {
+		t.Fatalf("Status() = %+v, want no zones", status)
+	}
+	assertMultiplier(t, s, pickup, 1)
+}
+
+func TestSurgePricerZones(t *testing.T) {
+	s, clock := newTestSurgePricer(testSurgeConfig())
+	busy := Location{Latitude: 10, Longitude: 10}
+	quiet := Location{Latitude: 110, Longitude: 10}
+	// 同じゾーンの空き椅子だけが供給として数えられる
+	demand := append(repeatLocation(busy, 3), quiet)
+	supply := append(repeatLocation(Location{Latitude: 120, Longitude: 20}, 3), Location{Latitude: 30, Longitude: 30})
+
+	s.Observe(demand, supply)
+	clock.Advance(30 * time.Second)
+	s.Observe(demand, supply)
+	// busy: 目標 1 + 0.5*(3-1) = 2 の半分まで、quiet: 需要が供給を超えていないので 1
+	assertMultiplier(t, s, busy, 1.5)
+	assertMultiplier(t, s, quiet, 1)
+}
+
+func TestSurgePricerCaps(t *testing.T) {
+	config := testSurgeConfig()
+	config.MinMultiplier = 1.2
+	config.MaxMultiplier = 1.5
+	config.HalfLifeSeconds = 0
+	s, clock := newTestSurgePricer(config)
+	busy := Location{Latitude: 10, Longitude: 10}
+	quiet := Location{Latitude: 110, Longitude: 10}
+	empty := Location{Latitude: 500, Longitude: 500}
+	demand := append(repeatLocation(busy, 100), quiet)
+	supply := repeatLocation(Location{Latitude: 120, Longitude: 20}, 10)
+
+	s.Observe(demand, supply)
+	clock.Advance(time.Second)
+	s.Observe(demand, supply)
+	// 半減期が 0 なら目標にすぐ追いつき、上限と下限で止まる
+	assertMultiplier(t, s, busy, 1.5)
+	assertMultiplier(t, s, quiet, 1.2)
+	assertMultiplier(t, s, empty, 1.2)
+
+	config.Enabled = false
+	s.SetConfig(config)
+	assertMultiplier(t, s, busy, 1)
+}
+
+func TestSurgePricerOverrideExpiry(t *testing.T) {
+	s, clock := newTestSurgePricer(testSurgeConfig())
+	pickup := Location{Latitude: 10, Longitude: 10}
+	other := Location{Latitude: 110, Longitude: 10}
+	zone := s.ZoneOf(pickup.Latitude, pickup.Longitude)
+
+	s.Override(&zone, 2.5, time.Minute)
+	assertMultiplier(t, s, pickup, 2.5)
+	assertMultiplier(t, s, other, 1)
+	if status := s.Status(); len(status) != 1 || !status[0].Overridden {
+		t.Fatalf("Status() = %+v, want the overridden zone", status)
+	}
+
+	clock.Advance(time.Minute - time.Millisecond)
+	assertMultiplier(t, s, pickup, 2.5)
+
+	clock.Advance(time.Millisecond)
+	assertMultiplier(t, s, pickup, 1)
+	if status := s.Status(); len(status) != 0 {
+		t.Fatalf("Status() = %+v, want no zones after expiry", status)
+	}
+
+	// 期限のない全体の上書きは解除するまで続き、ゾーンの上書きが優先される
+	s.Override(nil, 1.8, 0)
+	s.Override(&zone, 2.2, 10*time.Second)
+	assertMultiplier(t, s, pickup, 2.2)
+	assertMultiplier(t, s, other, 1.8)
+
+	clock.Advance(24 * time.Hour)
+	assertMultiplier(t, s, pickup, 1.8)
+	assertMultiplier(t, s, other, 1.8)
+
+	s.Override(nil, 0, 0)
+	assertMultiplier(t, s, pickup, 1)
+	assertMultiplier(t, s, other, 1)
+}
@@ -28,12 +28,18 @@ func getAppNotification(user *User, ride *Ride, rideStatus string) (*appGetNotif
 				Latitude:  ride.DestinationLatitude,
 				Longitude: ride.DestinationLongitude,
 			},
+			Waypoints: ride.Waypoints,
+			PoolStops: poolStopsOf(ride),
 			Fare:      ride.Fare,
 			Status:    rideStatus,
 			CreatedAt: ride.CreatedAt.UnixMilli(),
 			UpdateAt:  ride.UpdatedAt.UnixMilli(),
 		},
 	}
+	if eta, ok := etaService.Get(ride.ID); ok {
+		response.Data.PickupETA = toETAMillis(eta.PickupAt)
+		response.Data.ArrivalETA = toETAMillis(eta.ArrivalAt)
+	}
 
 	if ride.ChairID.Valid {
 		chair, _ := getChair(ride.ChairID.String)
@@ -51,52 +57,12 @@ func getAppNotification(user *User, ride *Ride, rideStatus string) (*appGetNotif
 
 func getChairStats(chairID string) appGetNotificationResponseChairStats {
 	stats := appGetNotificationResponseChairStats{}
-	if statsCache, ok := getChairStatsCache(chairID); ok {
-		stats.TotalRidesCount = statsCache.RideCount
-		stats.TotalEvaluationAvg = statsCache.TotalEvaluation / float64(statsCache.RideCount)
-	}
+	history := getChairRideHistory(chairID)
+	stats.TotalRidesCount = history.Count()
+	stats.TotalEvaluationAvg = history.Average(0)
 	return stats
 }
 
-func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	return initialFare + meteredFare
-}
-
-func posComma(b []byte) int {
-	if b[13] == 44 {
-		return 13
-	}
-	if b[14] == 44 {
-		return 14
-	}
-	if b[15] == 44 {
-		return 15
-	}
-	return -1
-}
-
-func byteToInt(b []byte) int {
-	sign := 1
-	if b[0] == 45 {
-		b = b[1:]
-		sign = -1
-	}
-	n := 0
-	for _, ch := range b {
-		ch -= '0'
-		n = n*10 + int(ch)
-	}
-	return sign * n
-}
-
-func chairPostCoordinateBindJSON(body []byte, req *Coordinate) {
-	len := len(body)
-	pos := posComma(body)
-	req.Latitude = byteToInt(body[12:pos])
-	req.Longitude = byteToInt(body[pos+13 : len-1])
-}
-
 func getChairNotification(ride *Ride, rideStatus string) (*chairGetNotificationResponse, error) {
 	user, ok := getUser(ride.UserID)
 	if !ok {
@@ -118,24 +84,15 @@ func getChairNotification(ride *Ride, rideStatus string) (*chairGetNotificationR
 				Latitude:  ride.DestinationLatitude,
 				Longitude: ride.DestinationLongitude,
 			},
-			Status: rideStatus,
+			Waypoints: ride.Waypoints,
+			PoolStops: poolStopsOf(ride),
+			Status:    rideStatus,
 		},
 	}, nil
 }
 
+// 料金設定がないときの標準料金表
 const (
 	initialFare     = 500
 	farePerDistance = 100
 )
-
-func sumSales(rides []Ride) int {
-	sale := 0
-	for _, ride := range rides {
-		sale += calculateSale(ride)
-	}
-	return sale
-}
-
-func calculateSale(ride Ride) int {
-	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const watchdogSettingName = "watchdog_config"
+
+const (
+	watchdogActionCompleted  = "AUTO_COMPLETED"
+	watchdogActionReassigned = "REASSIGNED"
+	watchdogActionFlagged    = "FLAGGED"
+)
+
+// 監視の記録はこの件数まで残す
+const maxWatchdogEvents = 1000
+
+type WatchdogConfig struct {
+	// ARRIVED のまま評価されずにこの秒数が経ったら、評価なしで完了にする。0 なら完了にしない
+	ArrivedTimeoutSeconds int `json:"arrived_timeout_seconds"`
+	// ENROUTE のまま椅子がこの秒数動かなければ、別の椅子に割り当て直す。0 なら見ない
+	EnrouteIdleSeconds int `json:"enroute_idle_seconds"`
+	// 椅子を割り当ててからこの秒数 ENROUTE にならなければ、別の椅子に割り当て直す。0 なら見ない
+	MatchingAckSeconds int `json:"matching_ack_seconds"`
+}
+
+func defaultWatchdogConfig() WatchdogConfig {
+	return WatchdogConfig{
+		ArrivedTimeoutSeconds: 600,
+		EnrouteIdleSeconds:    120,
+		MatchingAckSeconds:    60,
+	}
+}
+
+func validateWatchdogConfig(config WatchdogConfig) error {
+	if config.ArrivedTimeoutSeconds < 0 || config.EnrouteIdleSeconds < 0 || config.MatchingAckSeconds < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	return nil
+}
+
+func loadWatchdogConfig(ctx context.Context) (WatchdogConfig, error) {
+	config := defaultWatchdogConfig()
+	found, err := getJSONSetting(ctx, watchdogSettingName, &config)
+	if err != nil || !found {
+		return config, err
+	}
+	return config, validateWatchdogConfig(config)
+}
+
+// watchedRide はライドが今の状態・椅子・位置になった時刻を持つ
+type watchedRide struct {
+	status   string
+	chairID  string
+	location Location
+	since    time.Time
+	movedAt  time.Time
+	flagged  bool
+}
+
+type WatchdogEvent struct {
+	RideID  string `json:"ride_id"`
+	ChairID string `json:"chair_id"`
+	Status  string `json:"status"`
+	Action  string `json:"action"`
+	Reason  string `json:"reason"`
+	At      int64  `json:"at"`
+}
+
+type watchdogAction struct {
+	ride    *Ride
+	chairID string
+	status  string
+	action  string
+	reason  string
+}
+
+// RideWatchdog は椅子が受け持っているライドを定期的に見て、進まなくなったものを片付ける
+type RideWatchdog struct {
+	config WatchdogConfig
+	rides  map[string]*watchedRide
+	events []WatchdogEvent
+	mu     sync.Mutex
+}
+
+func NewRideWatchdog(config WatchdogConfig) *RideWatchdog {
+	return &RideWatchdog{
+		config: config,
+		rides:  map[string]*watchedRide{},
+		events: []WatchdogEvent{},
+		mu:     sync.Mutex{},
+	}
+}
+
+var rideWatchdog = NewRideWatchdog(defaultWatchdogConfig())
+
+// Reset は見ているライドと記録を捨てて設定を入れ替える
+func (w *RideWatchdog) Reset(config WatchdogConfig) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.config = config
+	w.rides = map[string]*watchedRide{}
+	w.events = []WatchdogEvent{}
+}
+
+func (w *RideWatchdog) Config() WatchdogConfig {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.config
+}
+
+func (w *RideWatchdog) SetConfig(config WatchdogConfig) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.config = config
+}
+
+// Events は新しい順に記録を返す
+func (w *RideWatchdog) Events() []WatchdogEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	events := make([]WatchdogEvent, 0, len(w.events))
+	for i := len(w.events) - 1; i >= 0; i-- {
+		events = append(events, w.events[i])
+	}
+	return events
+}
+
+func (w *RideWatchdog) record(a watchdogAction, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.events = append(w.events, WatchdogEvent{
+		RideID:  a.ride.ID,
+		ChairID: a.chairID,
+		Status:  a.status,
+		Action:  a.action,
+		Reason:  a.reason,
+		At:      now.UnixMilli(),
+	})
+	if len(w.events) > maxWatchdogEvents {
+		w.events = w.events[len(w.events)-maxWatchdogEvents:]
+	}
+}
+
+// Tick は椅子が受け持っているライドの状態を記録し、時間切れになったものへの対応を返す
+func (w *RideWatchdog) Tick(now time.Time) []watchdogAction {
+	rides := map[string]*Ride{}
+	latestRide.Range(func(key, _ any) bool {
+		for _, ride := range chairRides(key.(string)) {
+			rides[ride.ID] = ride
+		}
+		return true
+	})
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	actions := []watchdogAction{}
+	for id := range w.rides {
+		if _, ok := rides[id]; !ok {
+			delete(w.rides, id)
+		}
+	}
+	for _, ride := range rides {
+		if !ride.ChairID.Valid {
+			continue
+		}
+		status, _ := getLatestRideStatus(ride.ID)
+		chairID := ride.ChairID.String
+		location := Location{}
+		if l, ok := getLatestChairLocation(chairID); ok {
+			location = Location{Latitude: l.Latitude, Longitude: l.Longitude}
+		}
+		state, ok := w.rides[ride.ID]
+		if !ok || state.status != status || state.chairID != chairID {
+			w.rides[ride.ID] = &watchedRide{status: status, chairID: chairID, location: location, since: now, movedAt: now}
+			continue
+		}
+		if state.location != location {
+			state.location = location
+			state.movedAt = now
+		}
+
+		a := watchdogAction{ride: ride, chairID: chairID, status: status}
+		switch {
+		case status == "ARRIVED" && w.timedOut(state.since, w.config.ArrivedTimeoutSeconds, now):
+			a.action = watchdogActionCompleted
+			a.reason = "not evaluated"
+		case status == "MATCHING" && w.timedOut(state.since, w.config.MatchingAckSeconds, now):
+			a.action = watchdogActionReassigned
+			a.reason = "not acknowledged"
+		case status == "ENROUTE" && w.timedOut(state.movedAt, w.config.EnrouteIdleSeconds, now):
+			a.action = watchdogActionReassigned
+			a.reason = "chair not moving"
+		default:
+			continue
+		}
+		// 相乗りは他の利用者の停車地の予定も絡むので、割り当て直さずに記録だけする
+		if a.action == watchdogActionReassigned && ride.Pooled {
+			if state.flagged {
+				continue
+			}
+			state.flagged = true
+			a.action = watchdogActionFlagged
+		}
+		actions = append(actions, a)
+	}
+	return actions
+}
+
+func (w *RideWatchdog) timedOut(since time.Time, seconds int, now time.Time) bool {
+	return seconds > 0 && !now.Before(since.Add(time.Duration(seconds)*time.Second))
+}
+
+// beginRideCompletion はライドを完了の処理中にする。利用者の評価と自動の完了が重ならないようにする
+func beginRideCompletion(rideID string) bool {
+	_, loaded := completingRides.LoadOrStore(rideID, struct{}{})
+	return !loaded
+}
+
+func abortRideCompletion(rideID string) {
+	completingRides.Delete(rideID)
+}
+
+// autoCompleteRide は評価のないまま運賃を請求してライドを完了にし、椅子を空ける
+func autoCompleteRide(ride *Ride, now time.Time) error {
+	if !beginRideCompletion(ride.ID) {
+		return errors.New("ride is already being completed")
+	}
+	if status, _ := getLatestRideStatus(ride.ID); status != "ARRIVED" {
+		abortRideCompletion(ride.ID)
+		return fmt.Errorf("ride is %s", status)
+	}
+	token, ok := getPaymentToken(ride.UserID)
+	if !ok {
+		abortRideCompletion(ride.ID)
+		return errors.New("payment token not registered")
+	}
+	if err := requestPaymentGatewayPostPayment(context.Background(), paymentGatewayURL, ride.ID, token, &paymentGatewayPostPaymentRequest{
+		Amount: ride.Fare,
+	}); err != nil {
+		// 次の回にもう一度請求する
+		abortRideCompletion(ride.ID)
+		return err
+	}
+	ride.UpdatedAt = now
+	createRide(ride.ID, ride)
+	recordChairRide(ride, ride.UpdatedAt)
+	getCouponWallet(ride.UserID).Commit(ride.ID)
+	processRideStatus(ride, "COMPLETED")
+	// 応答しない椅子の SSE を待たずに椅子を空ける
+	chairID := ride.ChairID.String
+	if !ridePools.Busy(chairID) {
+		releaseLatestRide(chairID, ride)
+		if chair, ok := getChair(chairID); ok && chairDispatchable(chair) && !chairOnRide(chairID) {
+			freeChairs.Add(chair)
+		}
+	}
+	return nil
+}
+
+// reassignRide は応答しない椅子からライドを外して配車待ちに戻す。
+// 椅子は稼働を止め、椅子が稼働を再開するまで空き椅子に戻さない
+func reassignRide(ride *Ride, chairID string, now time.Time) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if ride.ChairID.String != chairID {
+		return false
+	}
+	if status, _ := getLatestRideStatus(ride.ID); status != "MATCHING" && status != "ENROUTE" {
+		return false
+	}
+	if chair, ok := getChair(chairID); ok {
+		setChairActive(chair, false, now)
+		freeChairs.Remove(chairID)
+	}
+	unassignRide(ride, chairID, now)
+	// 元の椅子にはライドが取り消されたことを知らせる。応答しない椅子なので送れなくても待たない
+	tryPublishChairChan(chairID, &Notif{
+		Ride:       ride,
+		RideStatus: "CANCELED",
+	})
+	processRideStatus(ride, "MATCHING")
+	return true
+}
+
+func startWatchdogLoop() {
+	ticker := time.NewTicker(1 * time.Second)
+	for now := range ticker.C {
+		for _, a := range rideWatchdog.Tick(now) {
+			go handleWatchdogAction(a, now)
+		}
+	}
+}
+
+func handleWatchdogAction(a watchdogAction, now time.Time) {
+	switch a.action {
+	case watchdogActionCompleted:
+		if _, busy := completingRides.Load(a.ride.ID); busy {
+			return
+		}
+		if err := autoCompleteRide(a.ride, now); err != nil {
+			slog.Error("failed to auto-complete ride",
+				"ride_id", a.ride.ID,
+				"user_id", a.ride.UserID,
+				"chair_id", a.chairID,
+				"reason", a.reason,
+				"error", err,
+			)
+			return
+		}
+	case watchdogActionReassigned:
+		if !reassignRide(a.ride, a.chairID, now) {
+			return
+		}
+	}
+	rideWatchdog.record(a, now)
+}
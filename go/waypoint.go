@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// 乗車地と目的地の間に立ち寄れる経由地の数
+const maxRideWaypoints = 5
+
+func validateWaypoints(waypoints []Coordinate) error {
+	if len(waypoints) > maxRideWaypoints {
+		return fmt.Errorf("at most %d waypoints are allowed", maxRideWaypoints)
+	}
+	return nil
+}
+
+// routeDistance は経由地を順にたどったときの距離を返す
+func routeDistance(pickup Coordinate, waypoints []Coordinate, destination Coordinate) int {
+	distance := 0
+	from := pickup
+	for _, w := range waypoints {
+		distance += calculateDistance(from.Latitude, from.Longitude, w.Latitude, w.Longitude)
+		from = w
+	}
+	return distance + calculateDistance(from.Latitude, from.Longitude, destination.Latitude, destination.Longitude)
+}
+
+func rideDistance(ride *Ride) int {
+	return routeDistance(
+		Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+		ride.Waypoints,
+		Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+	)
+}
+
+// arriveAtNextStop は乗車中の椅子が次の停車地に着いたかを調べて状態を進める。
+// 経由地をすべて回り終えるまでは目的地に着いても到着にしない
+func arriveAtNextStop(ride *Ride, coord Coordinate, at time.Time) {
+	if ride.WaypointsReached < len(ride.Waypoints) {
+		if coord == ride.Waypoints[ride.WaypointsReached] {
+			ride.WaypointsReached++
+			notifyStopArrived(ride, ride.WaypointsReached, at)
+		}
+		return
+	}
+	if coord.Latitude == ride.DestinationLatitude && coord.Longitude == ride.DestinationLongitude {
+		processRideStatusAt(ride, "ARRIVED", at)
+	}
+}
+
+// notifyStopArrived は経由地に着いたことを知らせる。乗車中のままなので状態は変えず、
+// CARRYING の通知に経由地の番号を付ける
+func notifyStopArrived(ride *Ride, stop int, now time.Time) {
+	addRideStatusHistory(ride.ID, "CARRYING", stop, now)
+	notif := &Notif{
+		Ride:       ride,
+		RideStatus: "CARRYING",
+		Stop:       stop,
+	}
+	publishAppChan(ride.UserID, notif)
+	if ride.ChairID.Valid {
+		publishChairChan(ride.ChairID.String, notif)
+	}
+}
@@ -18,6 +18,7 @@ func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /payments", handleGetPayments)
 	mux.HandleFunc("POST /payments", handlePostPayments)
+	mux.HandleFunc("POST /refunds", handlePostRefunds)
 	http.ListenAndServe(":12345", mux)
 }
 
@@ -57,6 +58,37 @@ func handlePostPayments(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+type PostRefundsRequest struct {
+	Amount int `json:"amount"`
+}
+
+func handlePostRefunds(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenFromAuthorizationHeader(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+
+	var req PostRefundsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "不正なリクエスト形式です"})
+		return
+	}
+
+	if req.Amount <= 0 || req.Amount > 1_000_000 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "返金額が不正です"})
+		return
+	}
+
+	// モックサーバーは返金を負の決済額として記録する
+	dataLock.Lock()
+	data[token] = append(data[token], -req.Amount)
+	dataLock.Unlock()
+
+	slog.Info("返金完了", slog.String("token", token), slog.Int("amount", req.Amount))
+	w.WriteHeader(http.StatusNoContent)
+}
+
 type ResponsePayment struct {
 	Amount int    `json:"amount"`
 	Status string `json:"status"`
@@ -75,6 +107,13 @@ func handleGetPayments(w http.ResponseWriter, r *http.Request) {
 
 	res := make([]ResponsePayment, 0, len(arr))
 	for _, amount := range arr {
+		if amount < 0 {
+			res = append(res, ResponsePayment{
+				Amount: -amount,
+				Status: "返金済み",
+			})
+			continue
+		}
 		res = append(res, ResponsePayment{
 			Amount: amount,
 			Status: "成功",
@@ -152,3 +152,15 @@ CREATE TABLE coupons
   INDEX idx_user_id_created_at (user_id, created_at)
 )
   COMMENT 'クーポンテーブル';
+
+DROP TABLE IF EXISTS chair_activity_events;
+CREATE TABLE chair_activity_events
+(
+  id         VARCHAR(26) NOT NULL,
+  chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  is_active  TINYINT(1)  NOT NULL COMMENT '配椅子受付中かどうか',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '状態変更日時',
+  PRIMARY KEY (id),
+  INDEX idx_chair_id_created_at (chair_id, created_at)
+)
+  COMMENT = '椅子の稼働状態の変更履歴テーブル';